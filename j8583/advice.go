@@ -0,0 +1,353 @@
+package j8583
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network management information codes (field 60.3) of IC card advices.
+const (
+	NetTCUpload     = "203"
+	NetScriptResult = "951"
+)
+
+const (
+	ERR_ORIGINAL_NOT_FOUND string = "original transaction not found; terminal=%s stan=%s"
+	ERR_ADVICE_REJECTED    string = "advice rejected; stan=%s response code=%s"
+	ERR_ADVICE_NO_PAN      string = "no PAN (tag 5A) in the card data; stan=%s"
+)
+
+// Field 55 tags of the script result notification and the TC upload.
+var (
+	ScriptResultTags = []string{"9F33", "95", "9F37", "9F1E", "9F10", "9F26", "9F36", "82", "DF31", "9F1A", "9A"}
+	TCUploadTags     = []string{"9F26", "9F27", "9F10", "9F37", "9F36", "95", "9A", "9C", "9F02", "5F2A", "82",
+		"9F1A", "9F03", "9F33", "9F34", "9F35", "9F1E", "84", "9F09", "9F41"}
+)
+
+// FindOriginal returns the request terminalID sent with stan, completed with
+// the RRN, auth code and response code of its response.
+func FindOriginal(j Journal, terminalID, stan string) (JournalEntry, error) {
+	entries, err := j.Query(JournalQuery{TerminalID: terminalID, STAN: stan})
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	var orig *JournalEntry
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.Direction == JournalSent && (e.MTI == "0100" || e.MTI == "0200" || e.MTI == "0220"):
+			orig = e
+		case e.Direction == JournalReceived && orig != nil && len(e.MTI) == 4 && e.MTI[:2] == orig.MTI[:2]:
+			orig.RRN, orig.AuthCode, orig.ResponseCode = e.RRN, e.AuthCode, e.ResponseCode
+		}
+	}
+	if orig == nil {
+		return JournalEntry{}, fmt.Errorf(ERR_ORIGINAL_NOT_FOUND, terminalID, stan)
+	}
+	return *orig, nil
+}
+
+// AssembleField55 builds field 55 from tags in order, taking each from the
+// first source that has it. Tags no source has are left out.
+func AssembleField55(tags []string, sources ...[]TLV) ([]byte, error) {
+	var out []TLV
+	for _, tag := range tags {
+		for _, source := range sources {
+			if value, ok := FindTLV(source, tag); ok {
+				out = append(out, TLV{Tag: tag, Value: value})
+				break
+			}
+		}
+	}
+	return EncodeTLV(out)
+}
+
+// NewScriptResultNotification builds the 0620 reporting the result of the
+// issuer scripts run after orig. emv is the card data read after the
+// scripts ran, 5A and DF31 included; other tags missing from it come from
+// orig's field 55.
+func NewScriptResultNotification(orig JournalEntry, emv []TLV, tpdu, header, stan, batchNum string) (*Message, error) {
+	return newICAdvice("0620", NetScriptResult, ScriptResultTags, orig, emv, tpdu, header, stan, batchNum)
+}
+
+// NewTCUpload builds the 0320 uploading the transaction certificate the card
+// generated for orig. emv must hold the PAN in tag 5A.
+func NewTCUpload(orig JournalEntry, emv []TLV, tpdu, header, stan, batchNum string) (*Message, error) {
+	return newICAdvice("0320", NetTCUpload, TCUploadTags, orig, emv, tpdu, header, stan, batchNum)
+}
+
+// newICAdvice takes the card data from emv only: the journal keeps the PAN
+// masked and field 55 without its cardholder data.
+func newICAdvice(mti, netCode string, tags []string, orig JournalEntry, emv []TLV, tpdu, header, stan, batchNum string) (*Message, error) {
+	pan, ok := FindTLV(emv, "5A")
+	if !ok {
+		return nil, fmt.Errorf(ERR_ADVICE_NO_PAN, orig.STAN)
+	}
+	var stored []TLV
+	if value, ok := orig.Fields[55]; ok {
+		raw, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		if stored, err = ParseTLV(raw); err != nil {
+			return nil, err
+		}
+	}
+	field55, err := AssembleField55(tags, emv, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newNetworkMessage(mti, tpdu, header, stan, batchNum, orig.TerminalID, orig.MerchantID, netCode)
+	m.Fields[2] = NewFieldVar(LLVAR, BCD, strings.TrimRight(strings.ToUpper(hex.EncodeToString(pan)), "F"))
+	if orig.Processing != "" {
+		m.Fields[3] = NewFieldFix(BCD, 6, orig.Processing)
+	}
+	if orig.Amount != "" {
+		m.Fields[4] = NewFieldFix(BCD, 12, orig.Amount)
+	}
+	if value := orig.Fields[22]; value != "" {
+		m.Fields[22] = NewFieldFix(BCD, 3, value)
+	}
+	if value := orig.Fields[23]; value != "" {
+		m.Fields[23] = NewFieldFix(BCD, 3, value)
+	}
+	if orig.RRN != "" {
+		m.Fields[37] = NewFieldFix(ASCII, 12, orig.RRN)
+	}
+	if orig.AuthCode != "" {
+		m.Fields[38] = NewFieldFix(ASCII, 6, orig.AuthCode)
+	}
+	m.Fields[49] = NewFieldFix(ASCII, 3, "156")
+	m.Fields[55] = NewFieldVar(LLLVAR, BINARY, strings.ToUpper(hex.EncodeToString(field55)))
+	m.Fields[61] = NewFieldVar(LLLVAR, BCD, orig.BatchNum+orig.STAN+orig.Time.Format("0102"))
+	return m, nil
+}
+
+// DefaultAdviceAttempts is how many times an advice is sent while the host
+// cannot be reached before it is set aside.
+const DefaultAdviceAttempts = 3
+
+// QueuedAdvice is an advice waiting for delivery.
+type QueuedAdvice struct {
+	ID       int64     `json:"id"`
+	Raw      []byte    `json:"raw"`
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+	// Failed says why the advice was set aside: declined by the host, out
+	// of attempts or unreadable. Set aside advices are no longer sent.
+	Failed string `json:"failed,omitempty"`
+}
+
+// AdviceQueue stores advices such as script results and TC uploads for
+// delivery in order once the host is reachable. With a path it survives
+// restarts; the file is sealed with AES-GCM as the advices carry the card
+// number in field 2 and field 55.
+type AdviceQueue struct {
+	// MaxAttempts bounds the sends of an advice that gets no answer; 0
+	// means DefaultAdviceAttempts.
+	MaxAttempts int
+
+	file   *sealedFile
+	mu     sync.Mutex
+	items  []*QueuedAdvice
+	nextID int64
+}
+
+// OpenAdviceQueue loads the queue kept at path with key (16, 24 or 32 bytes)
+// sealing the file; an empty path keeps it in memory only and key is not
+// used.
+func OpenAdviceQueue(path string, key []byte) (*AdviceQueue, error) {
+	q := &AdviceQueue{MaxAttempts: DefaultAdviceAttempts, nextID: 1}
+	if path == "" {
+		return q, nil
+	}
+	file, err := newSealedFile(path, "advices", key)
+	if err != nil {
+		return nil, err
+	}
+	q.file = file
+	data, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q.items); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range q.items {
+		if item.ID >= q.nextID {
+			q.nextID = item.ID + 1
+		}
+	}
+	return q, nil
+}
+
+// Add queues m behind the advices already waiting.
+func (q *AdviceQueue) Add(m *Message) error {
+	raw, err := m.Bytes("")
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, &QueuedAdvice{ID: q.nextID, Raw: raw, Created: time.Now()})
+	q.nextID++
+	return q.save()
+}
+
+// Len returns the number of advices waiting, not counting those set aside.
+func (q *AdviceQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, item := range q.items {
+		if item.Failed == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the advices set aside, oldest first, for an operator to
+// look into.
+func (q *AdviceQueue) Failed() []QueuedAdvice {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []QueuedAdvice
+	for _, item := range q.items {
+		if item.Failed != "" {
+			out = append(out, *item)
+		}
+	}
+	return out
+}
+
+// Remove drops the advice id from the queue, whether waiting or set aside.
+func (q *AdviceQueue) Remove(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return q.save()
+		}
+	}
+	return nil
+}
+
+// Forward sends the waiting advices oldest first and removes each once the
+// host approves it. prepare, if not nil, finishes each advice before
+// sending, e.g. by setting its MAC. An advice the host declines is set
+// aside and the next one is sent. When the host cannot be reached Forward
+// stops so that order is kept; the advice is set aside once it has been
+// tried MaxAttempts times. It returns the number delivered.
+func (q *AdviceQueue) Forward(ctx context.Context, sender Sender, prepare func(m *Message) error) (int, error) {
+	sent := 0
+	for {
+		item := q.next()
+		if item == nil {
+			return sent, nil
+		}
+
+		m, err := Decode(item.Raw)
+		if err != nil {
+			if err := q.setAside(item.ID, err.Error()); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if prepare != nil {
+			if err := prepare(m); err != nil {
+				return sent, err
+			}
+		}
+		attempts, err := q.attempted(item.ID)
+		if err != nil {
+			return sent, err
+		}
+
+		resp, err := sender.Send(ctx, m)
+		if err != nil {
+			if attempts >= q.maxAttempts() {
+				if serr := q.setAside(item.ID, err.Error()); serr != nil {
+					return sent, serr
+				}
+			}
+			return sent, err
+		}
+		if code := resp.FieldString(39); code != RespApproved {
+			if err := q.setAside(item.ID, fmt.Sprintf(ERR_ADVICE_REJECTED, m.FieldString(11), code)); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err := q.Remove(item.ID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// next returns a copy of the oldest advice not set aside, or nil.
+func (q *AdviceQueue) next() *QueuedAdvice {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.items {
+		if item.Failed == "" {
+			out := *item
+			return &out
+		}
+	}
+	return nil
+}
+
+// attempted counts a send of advice id and returns the attempts so far.
+func (q *AdviceQueue) attempted(id int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.items {
+		if item.ID == id {
+			item.Attempts++
+			return item.Attempts, q.save()
+		}
+	}
+	return 0, nil
+}
+
+func (q *AdviceQueue) setAside(id int64, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.items {
+		if item.ID == id {
+			item.Failed = reason
+			return q.save()
+		}
+	}
+	return nil
+}
+
+func (q *AdviceQueue) maxAttempts() int {
+	if q.MaxAttempts > 0 {
+		return q.MaxAttempts
+	}
+	return DefaultAdviceAttempts
+}
+
+// save writes the queue; the caller holds q.mu.
+func (q *AdviceQueue) save() error {
+	if q.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(q.items)
+	if err != nil {
+		return err
+	}
+	return q.file.write(data)
+}
@@ -0,0 +1,103 @@
+package j8583
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICAdvices(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "advice")
+	defer os.RemoveAll(dir)
+	j, _ := OpenFileJournal(filepath.Join(dir, "journal"))
+	defer j.Close()
+
+	pan := TLV{Tag: "5A", Value: []byte{0x62, 0x25, 0x88, 0x79, 0x12, 0x34, 0x56, 0x78}}
+	arqc, _ := EncodeTLV([]TLV{{Tag: "9F26", Value: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, {Tag: "9F36", Value: []byte{0, 1}}, pan})
+	sale := newTestRequest("0200", "000011")
+	sale.Fields[4] = NewFieldFix(BCD, 12, "000000000100")
+	sale.Fields[55] = NewFieldVar(LLLVAR, BINARY, hex.EncodeToString(arqc))
+	sale.Fields[60] = NewFields(LLLVAR, BCD, []SubField{NewSubFieldFix(BCD, 2, TypeSale), NewSubFieldFix(BCD, 6, "000001")})
+	assert.NoError(t, Record(j, sale, JournalSent))
+	resp := NewResponse(sale, RespApproved)
+	resp.Fields[37] = NewFieldFix(ASCII, 12, "123456789012")
+	resp.Fields[38] = NewFieldFix(ASCII, 6, "A12345")
+	assert.NoError(t, Record(j, resp, JournalReceived))
+
+	orig, err := FindOriginal(j, "00003042", "000011")
+	assert.NoError(t, err)
+	assert.Equal(t, "123456789012", orig.RRN)
+	_, err = FindOriginal(j, "00003042", "999999")
+	assert.Error(t, err)
+
+	// the TC generated after the online approval replaces the ARQC
+	tc := []TLV{{Tag: "9F26", Value: []byte{8, 7, 6, 5, 4, 3, 2, 1}}, {Tag: "9F27", Value: []byte{0x40}}}
+	_, err = NewTCUpload(orig, tc, "6000030000", "613100313031", "000012", "000001")
+	assert.Error(t, err)
+	upload, err := NewTCUpload(orig, append(tc, pan), "6000030000", "613100313031", "000012", "000001")
+	assert.NoError(t, err)
+	assert.Equal(t, "0320", upload.Mti)
+	assert.Equal(t, "6225887912345678", upload.FieldString(2))
+	assert.Equal(t, "9F260808070605040302019F2701409F36020001", upload.FieldString(55))
+	_, _, netCode := upload.Field60()
+	assert.Equal(t, NetTCUpload, netCode)
+	assert.Equal(t, "000001000011"+orig.Time.Format("0102"), upload.FieldString(61))
+
+	script, err := NewScriptResultNotification(orig, []TLV{{Tag: "DF31", Value: []byte{0x20, 0, 0, 0, 0}}, pan}, "6000030000", "613100313031", "000013", "000001")
+	assert.NoError(t, err)
+	assert.Equal(t, "0620", script.Mti)
+	assert.Equal(t, "A12345", script.FieldString(38))
+
+	// store and forward keeps order and survives a restart
+	path := filepath.Join(dir, "advices.json")
+	q, _ := OpenAdviceQueue(path, testQueueKey)
+	assert.NoError(t, q.Add(upload))
+	assert.NoError(t, q.Add(script))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte{0x62, 0x25, 0x88, 0x79}))
+	q, _ = OpenAdviceQueue(path, testQueueKey)
+	assert.Equal(t, 2, q.Len())
+
+	down := &scriptedSender{replies: []func(*Message) (*Message, error){timeout, timeout, timeout}}
+	n, err := q.Forward(context.Background(), down, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	up := &scriptedSender{replies: []func(*Message) (*Message, error){approve, approve}}
+	n, err = q.Forward(context.Background(), up, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "0320", up.sent[0].Mti)
+	assert.Equal(t, "0620", up.sent[1].Mti)
+	assert.Equal(t, 0, q.Len())
+
+	// a declined advice is set aside without holding up the next one
+	assert.NoError(t, q.Add(upload))
+	assert.NoError(t, q.Add(script))
+	decline := func(m *Message) (*Message, error) { return NewResponse(m, "30"), nil }
+	mixed := &scriptedSender{replies: []func(*Message) (*Message, error){decline, approve}}
+	n, err = q.Forward(context.Background(), mixed, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, q.Len())
+	failed := q.Failed()
+	assert.Equal(t, 1, len(failed))
+	assert.NoError(t, q.Remove(failed[0].ID))
+
+	// one that never gets an answer is set aside after MaxAttempts
+	q.MaxAttempts = 2
+	assert.NoError(t, q.Add(upload))
+	for i := 0; i < 2; i++ {
+		_, err = q.Forward(context.Background(), down, nil)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 1, len(q.Failed()))
+}
@@ -0,0 +1,134 @@
+package j8583
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Network management information codes (field 60.3) of batch upload.
+const (
+	NetBatchUpload    = "201"
+	NetBatchUploadEnd = "202"
+)
+
+// DefaultUploadSize is how many transactions one 0320 carries in field 48.
+const DefaultUploadSize = 8
+
+const (
+	ERR_BATCH_UPLOAD_REJECTED string = "batch upload rejected; stan=%s response code=%s"
+	ERR_BATCH_UPLOAD_NO_PAN   string = "batch upload needs Settlement.PAN: the journal keeps card numbers masked"
+	ERR_BATCH_UPLOAD_BAD_PAN  string = "no card number for batch upload; stan=%s"
+)
+
+// NewBatchUploadRequest builds a 0320 carrying txns in field 48: a two digit
+// count, then per transaction the card organisation (00 domestic), STAN (6),
+// PAN (20, left aligned, zero filled) and amount (12).
+func NewBatchUploadRequest(tpdu, header, stan, batchNum, terminalID, merchantID string, txns []JournalEntry, pan func(e JournalEntry) string) *Message {
+	var field48 strings.Builder
+	field48.WriteString(fmt.Sprintf("%02d", len(txns)))
+	for _, e := range txns {
+		field48.WriteString("00")
+		field48.WriteString(e.STAN)
+		field48.WriteString(fmt.Sprintf("%-20s", pan(e))[:20])
+		field48.WriteString(e.Amount)
+	}
+	value := strings.Replace(field48.String(), " ", "0", -1)
+
+	m := newNetworkMessage("0320", tpdu, header, stan, batchNum, terminalID, merchantID, NetBatchUpload)
+	m.Fields[48] = NewFieldVar(LLLVAR, BCD, value)
+	return m
+}
+
+// NewBatchUploadEnd builds the 0320 that ends a batch upload, with the
+// number of transactions uploaded in field 48.
+func NewBatchUploadEnd(tpdu, header, stan, batchNum, terminalID, merchantID string, count int) *Message {
+	m := newNetworkMessage("0320", tpdu, header, stan, batchNum, terminalID, merchantID, NetBatchUploadEnd)
+	m.Fields[48] = NewFieldVar(LLLVAR, BCD, fmt.Sprintf("%04d", count))
+	return m
+}
+
+// newNetworkMessage builds the fields every network management and batch
+// message carries: STAN, terminal and merchant IDs, and field 60 with the
+// batch number and network management information code.
+func newNetworkMessage(mti, tpdu, header, stan, batchNum, terminalID, merchantID, netCode string) *Message {
+	m := &Message{Tpdu: tpdu, Header: header, Mti: mti}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, stan)
+	m.Fields[41] = NewFieldFix(ASCII, 8, terminalID)
+	if merchantID != "" {
+		m.Fields[42] = NewFieldFix(ASCII, 15, merchantID)
+	}
+
+	subField60 := make([]SubField, 3)
+	subField60[0] = NewSubFieldFix(BCD, 2, "00")
+	subField60[1] = NewSubFieldFix(BCD, 6, batchNum)
+	subField60[2] = NewSubFieldFix(BCD, 3, netCode)
+	m.Fields[60] = NewFields(LLLVAR, BCD, subField60)
+	return m
+}
+
+// UploadBatch uploads every standing transaction of batchNum with 0320s of
+// UploadSize transactions each, then sends the batch upload end. It is run
+// after Settle reports the totals did not balance, with the closed batch's
+// number. PAN must supply the clear card number of each transaction, as the
+// journal only has it masked; nothing is sent unless it gives one for every
+// transaction. It returns the number uploaded.
+func (s *Settlement) UploadBatch(ctx context.Context, batchNum string) (int, error) {
+	entries, err := s.Journal.Query(JournalQuery{TerminalID: s.TerminalID})
+	if err != nil {
+		return 0, err
+	}
+	txns := journalTransactions(entries, batchNum)
+
+	size := s.UploadSize
+	if size <= 0 || size > 99 {
+		size = DefaultUploadSize
+	}
+	if s.PAN == nil {
+		return 0, errors.New(ERR_BATCH_UPLOAD_NO_PAN)
+	}
+	pans := make(map[string]string, len(txns))
+	for _, e := range txns {
+		pan := s.PAN(e)
+		if pan == "" || strings.Trim(pan, "0123456789") != "" {
+			return 0, fmt.Errorf(ERR_BATCH_UPLOAD_BAD_PAN, e.STAN)
+		}
+		pans[e.STAN] = pan
+	}
+	pan := func(e JournalEntry) string { return pans[e.STAN] }
+
+	for start := 0; start < len(txns); start += size {
+		end := start + size
+		if end > len(txns) {
+			end = len(txns)
+		}
+		stan, err := s.State.NextSTAN()
+		if err != nil {
+			return start, err
+		}
+		req := NewBatchUploadRequest(s.Tpdu, s.Header, stan, batchNum, s.TerminalID, s.MerchantID, txns[start:end], pan)
+		if err := s.sendBatch(ctx, req); err != nil {
+			return start, err
+		}
+	}
+
+	stan, err := s.State.NextSTAN()
+	if err != nil {
+		return len(txns), err
+	}
+	req := NewBatchUploadEnd(s.Tpdu, s.Header, stan, batchNum, s.TerminalID, s.MerchantID, len(txns))
+	return len(txns), s.sendBatch(ctx, req)
+}
+
+func (s *Settlement) sendBatch(ctx context.Context, req *Message) error {
+	resp, err := sendRecorded(ctx, s.Sender, s.Journal, req)
+	if err != nil {
+		return err
+	}
+	if code := resp.FieldString(39); code != RespApproved {
+		return fmt.Errorf(ERR_BATCH_UPLOAD_REJECTED, req.FieldString(11), code)
+	}
+	return nil
+}
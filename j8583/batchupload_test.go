@@ -0,0 +1,63 @@
+package j8583
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	j, _ := OpenFileJournal(dir)
+	defer j.Close()
+
+	journalTransaction(t, j, "0200", "000001", TypeSale, "000000000100", "00", "")
+	journalTransaction(t, j, "0200", "000002", TypeRefund, "000000000050", "00", "")
+	journalTransaction(t, j, "0200", "000003", TypeSale, "000000000070", "00", "")
+
+	state, _ := OpenTerminalState("")
+	state.data.STAN = 3
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){approve, approve, approve}}
+	s := &Settlement{Sender: sender, Journal: j, State: state, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175", UploadSize: 2}
+
+	// the journal's masked card numbers are never uploaded
+	_, err := s.UploadBatch(context.Background(), "000001")
+	assert.Error(t, err)
+	s.PAN = func(e JournalEntry) string { return e.PAN }
+	_, err = s.UploadBatch(context.Background(), "000001")
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(sender.sent))
+
+	s.PAN = func(e JournalEntry) string { return "6225887912345678" }
+	n, err := s.UploadBatch(context.Background(), "000001")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 3, len(sender.sent))
+
+	first := sender.sent[0]
+	assert.Equal(t, "0320", first.Mti)
+	assert.Equal(t, "02"+
+		"00"+"000001"+"62258879123456780000"+"000000000100"+
+		"00"+"000002"+"62258879123456780000"+"000000000050", first.FieldString(48))
+	_, batchNum, netCode := first.Field60()
+	assert.Equal(t, "000001", batchNum)
+	assert.Equal(t, NetBatchUpload, netCode)
+
+	end := sender.sent[2]
+	assert.Equal(t, "0003", end.FieldString(48))
+	_, _, netCode = end.Field60()
+	assert.Equal(t, NetBatchUploadEnd, netCode)
+
+	// the uploaded card numbers are journaled masked
+	data, err := ioutil.ReadFile(filepath.Join(dir, "journal.jsonl"))
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(data), "6225887912345678"))
+	assert.True(t, strings.Contains(string(data), "00000001622588**************000000000100"))
+}
@@ -0,0 +1,241 @@
+package j8583
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ERR_CLIENT_CLOSED    string = "client closed"
+	ERR_CLIENT_DUPLICATE string = "request already in flight: %s"
+	ERR_CLIENT_DECODE    string = "dropped undecodable frame of %d bytes: %s"
+)
+
+// Sender sends a request and waits for its response.
+type Sender interface {
+	Send(ctx context.Context, m *Message) (*Message, error)
+}
+
+// NotSentError reports a request that failed before any of it was written,
+// so the host cannot have seen it.
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string { return e.Err.Error() }
+
+func (e *NotSentError) Unwrap() error { return e.Err }
+
+// NotSent reports whether err says the request never reached the host. Any
+// other error from a Sender leaves the outcome unknown.
+func NotSent(err error) bool {
+	var e *NotSentError
+	return errors.As(err, &e)
+}
+
+// MatchKey returns the key pairing a response with its request.
+type MatchKey func(m *Message) string
+
+// DefaultMatchKey pairs messages by request MTI, STAN (field 11) and
+// terminal ID (field 41). A response takes the MTI of its request, its
+// function digit with the low bit cleared, so that a 0200 and its 0210 share
+// a key while a 0220 and its 0230 get another.
+func DefaultMatchKey(m *Message) string {
+	mti := m.Mti
+	if len(mti) == 4 && mti[2] >= '0' && mti[2] <= '9' {
+		mti = mti[:2] + string('0'+(mti[2]-'0')&^1) + mti[3:]
+	}
+	return mti + "|" + m.FieldString(11) + "|" + m.FieldString(41)
+}
+
+// Client keeps a persistent connection to an acquirer host and multiplexes
+// concurrent requests over it. Responses are paired with the waiting request
+// by Match; unmatched messages go to Unsolicited if set and are otherwise
+// dropped. Frames that fail to decode are reported to ErrorLog.
+type Client struct {
+	Framer      *Framer
+	Match       MatchKey
+	Encode      func(m *Message) ([]byte, error)
+	Decode      func(raw []byte) (*Message, error)
+	Unsolicited func(m *Message)
+	// ErrorLog receives errors of received frames; nil discards them.
+	ErrorLog func(err error)
+
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan clientResult
+	err     error
+	done    chan struct{}
+	start   sync.Once
+}
+
+type clientResult struct {
+	m   *Message
+	err error
+}
+
+// NewClient wraps an established connection. The defaults are a 2 byte
+// binary length header, DefaultMatchKey and unencrypted messages; change the
+// exported fields before the first Send.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		Framer:  NewFramer(LengthBinary2),
+		Match:   DefaultMatchKey,
+		Encode:  func(m *Message) ([]byte, error) { return m.Bytes("") },
+		Decode:  Decode,
+		conn:    conn,
+		pending: make(map[string]chan clientResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// Dial connects to addr and returns a Client on the connection.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialTLS connects to addr over TLS and completes the handshake before
+// returning. Set config.Certificates for mutual TLS.
+func DialTLS(addr string, timeout time.Duration, config *tls.Config) (*Client, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Send writes m and waits for the matching response or for ctx to end.
+func (c *Client) Send(ctx context.Context, m *Message) (*Message, error) {
+	c.start.Do(func() { go c.readLoop() })
+
+	data, err := c.Encode(m)
+	if err != nil {
+		return nil, &NotSentError{err}
+	}
+
+	key := c.Match(m)
+	ch := make(chan clientResult, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, &NotSentError{c.err}
+	}
+	if _, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		return nil, &NotSentError{fmt.Errorf(ERR_CLIENT_DUPLICATE, key)}
+	}
+	c.pending[key] = ch
+	c.mu.Unlock()
+	defer c.forget(key, ch)
+
+	c.writeMu.Lock()
+	if err := ctx.Err(); err != nil {
+		c.writeMu.Unlock()
+		return nil, &NotSentError{err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	err = c.Framer.WriteFrame(c.conn, data)
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.m, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the connection and fails requests still waiting.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.fail(errors.New(ERR_CLIENT_CLOSED))
+	return err
+}
+
+// Done is closed once the connection has failed or been closed.
+func (c *Client) Done() <-chan struct{} {
+	c.start.Do(func() { go c.readLoop() })
+	return c.done
+}
+
+// Err returns the error that ended the connection, if any.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop() {
+	for {
+		raw, err := c.Framer.ReadFrame(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(raw) == 0 {
+			// heartbeat
+			continue
+		}
+		m, err := c.Decode(raw)
+		if err != nil {
+			// a frame we cannot decode cannot be matched either; its
+			// request is left to time out
+			if c.ErrorLog != nil {
+				c.ErrorLog(fmt.Errorf(ERR_CLIENT_DECODE, len(raw), err))
+			}
+			continue
+		}
+
+		key := c.Match(m)
+		c.mu.Lock()
+		ch, ok := c.pending[key]
+		delete(c.pending, key)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- clientResult{m: m}
+		} else if c.Unsolicited != nil {
+			c.Unsolicited(m)
+		}
+	}
+}
+
+func (c *Client) forget(key string, ch chan clientResult) {
+	c.mu.Lock()
+	if c.pending[key] == ch {
+		delete(c.pending, key)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for key, ch := range c.pending {
+		ch <- clientResult{err: err}
+		delete(c.pending, key)
+	}
+	close(c.done)
+}
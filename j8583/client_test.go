@@ -0,0 +1,112 @@
+package j8583
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRequest(mti, stan string) *Message {
+	m := &Message{Tpdu: "6000030000", Header: "613100313031", Mti: mti}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, stan)
+	m.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+	return m
+}
+
+func TestClientMatchesOutOfOrder(t *testing.T) {
+	conn, host := net.Pipe()
+	client := NewClient(conn)
+	defer client.Close()
+
+	// the host sends a heartbeat, then answers two requests in reverse order
+	go func() {
+		framer := NewFramer(LengthBinary2)
+		var reqs []*Message
+		for i := 0; i < 2; i++ {
+			raw, err := framer.ReadFrame(host)
+			if err != nil {
+				return
+			}
+			m, _ := Decode(raw)
+			reqs = append(reqs, m)
+		}
+		host.Write([]byte{0x00, 0x00})
+		for i := len(reqs) - 1; i >= 0; i-- {
+			resp := newTestRequest("0210", reqs[i].FieldString(11))
+			resp.Fields[39] = NewFieldFix(ASCII, 2, "00")
+			data, _ := resp.Bytes("")
+			framer.WriteFrame(host, data)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, stan := range []string{"000001", "000002"} {
+		wg.Add(1)
+		go func(stan string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := client.Send(ctx, newTestRequest("0200", stan))
+			assert.NoError(t, err)
+			assert.Equal(t, "0210", resp.Mti)
+			assert.Equal(t, stan, resp.FieldString(11))
+		}(stan)
+	}
+	wg.Wait()
+}
+
+func TestClientContextTimeout(t *testing.T) {
+	conn, host := net.Pipe()
+	client := NewClient(conn)
+	go func() {
+		NewFramer(LengthBinary2).ReadFrame(host)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.Send(ctx, newTestRequest("0200", "000003"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	client.Close()
+	<-client.Done()
+	_, err = client.Send(context.Background(), newTestRequest("0200", "000004"))
+	assert.Error(t, err)
+}
+
+func TestDefaultMatchKeyKeepsRequestClass(t *testing.T) {
+	assert.Equal(t, DefaultMatchKey(newTestRequest("0200", "000001")), DefaultMatchKey(newTestRequest("0210", "000001")))
+	assert.Equal(t, DefaultMatchKey(newTestRequest("0220", "000001")), DefaultMatchKey(newTestRequest("0230", "000001")))
+	assert.NotEqual(t, DefaultMatchKey(newTestRequest("0200", "000001")), DefaultMatchKey(newTestRequest("0220", "000001")))
+	assert.NotEqual(t, DefaultMatchKey(newTestRequest("0800", "000001")), DefaultMatchKey(newTestRequest("0820", "000001")))
+}
+
+func TestClientReportsUndecodableFrame(t *testing.T) {
+	conn, host := net.Pipe()
+	client := NewClient(conn)
+	defer client.Close()
+	errs := make(chan error, 1)
+	client.ErrorLog = func(err error) { errs <- err }
+
+	go func() {
+		framer := NewFramer(LengthBinary2)
+		if _, err := framer.ReadFrame(host); err != nil {
+			return
+		}
+		framer.WriteFrame(host, []byte{0x60, 0x00})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go client.Send(ctx, newTestRequest("0200", "000005"))
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-ctx.Done():
+		t.Fatal("undecodable frame was not reported")
+	}
+}
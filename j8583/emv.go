@@ -0,0 +1,415 @@
+package j8583
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Network management information codes (field 60.3) of the EMV parameter
+// downloads.
+const (
+	NetCAPKDownload    = "370"
+	NetCAPKDownloadEnd = "371"
+	NetCAPKStatus      = "372"
+	NetAIDDownload     = "380"
+	NetAIDDownloadEnd  = "381"
+	NetAIDStatus       = "382"
+)
+
+// Status of a download response, the first byte of field 62.
+const (
+	emvNoData   = '0'
+	emvComplete = '1'
+	emvMore     = '2'
+)
+
+const (
+	ERR_EMV_RESPONSE        string = "invalid EMV download response; netcode=%s mti=%s code=%s"
+	ERR_EMV_NO_DATA         string = "host has no EMV data for %s"
+	ERR_CAPK_HASH           string = "CA public key %s/%s hash mismatch"
+	ERR_CAPK_NO_HASH        string = "CA public key %s/%s has no hash"
+	ERR_CAPK_HASH_ALGORITHM string = "CA public key %s/%s hash algorithm %s is not SHA-1"
+	ERR_EMV_EMPTY_PAGE      string = "EMV status page marked more without entries; netcode=%s"
+	ERR_EMV_LIST_TOO_LONG   string = "EMV status list longer than %d entries; netcode=%s"
+	ERR_EMV_ENTRY           string = "EMV status entry out of place or missing key tag %s"
+	ERR_CAPK_FIELDS         string = "CA public key is missing tag %s"
+	ERR_AID_FIELDS          string = "application parameters missing tag %s"
+)
+
+// CAPKHashSHA1 is the hash algorithm indicator (DF06) of SHA-1.
+const CAPKHashSHA1 = "01"
+
+// CAPK is a certification authority public key. Binary values are upper
+// case hex.
+type CAPK struct {
+	RID           string `json:"rid"`
+	Index         string `json:"index"`
+	Expiry        string `json:"expiry"`
+	HashAlgorithm string `json:"hash_algorithm"`
+	KeyAlgorithm  string `json:"key_algorithm"`
+	Modulus       string `json:"modulus"`
+	Exponent      string `json:"exponent"`
+	Hash          string `json:"hash"`
+}
+
+// ParseCAPK reads a CA public key from its download TLVs: 9F06 RID, 9F22
+// index, DF05 expiry, DF06 hash algorithm, DF07 key algorithm, DF02
+// modulus, DF04 exponent and DF03 hash.
+func ParseCAPK(tlvs []TLV) (*CAPK, error) {
+	k := &CAPK{}
+	for _, f := range []struct {
+		tag string
+		dst *string
+	}{
+		{"9F06", &k.RID}, {"9F22", &k.Index}, {"DF02", &k.Modulus}, {"DF04", &k.Exponent},
+		{"DF03", &k.Hash}, {"DF06", &k.HashAlgorithm}, {"DF07", &k.KeyAlgorithm},
+	} {
+		value, ok := FindTLV(tlvs, f.tag)
+		if !ok && (f.tag == "9F06" || f.tag == "9F22" || f.tag == "DF02" || f.tag == "DF04") {
+			return nil, fmt.Errorf(ERR_CAPK_FIELDS, f.tag)
+		}
+		*f.dst = strings.ToUpper(hex.EncodeToString(value))
+	}
+	if value, ok := FindTLV(tlvs, "DF05"); ok {
+		k.Expiry = emvDate(value)
+	}
+	return k, nil
+}
+
+// Verify checks Hash, the SHA-1 of RID, index, modulus and exponent. Keys
+// without a hash or whose hash algorithm (DF06) is not SHA-1 fail.
+func (k *CAPK) Verify() error {
+	if k.Hash == "" {
+		return fmt.Errorf(ERR_CAPK_NO_HASH, k.RID, k.Index)
+	}
+	if k.HashAlgorithm != CAPKHashSHA1 {
+		return fmt.Errorf(ERR_CAPK_HASH_ALGORITHM, k.RID, k.Index, k.HashAlgorithm)
+	}
+	var data []byte
+	for _, part := range []string{k.RID, k.Index, k.Modulus, k.Exponent} {
+		b, err := hex.DecodeString(part)
+		if err != nil {
+			return err
+		}
+		data = append(data, b...)
+	}
+	sum := sha1.Sum(data)
+	expected, err := hex.DecodeString(k.Hash)
+	if err != nil || !bytes.Equal(sum[:], expected) {
+		return fmt.Errorf(ERR_CAPK_HASH, k.RID, k.Index)
+	}
+	return nil
+}
+
+// AID holds the terminal parameters of one EMV application. Binary values
+// are upper case hex; Tags keeps every tag downloaded.
+type AID struct {
+	AID                   string            `json:"aid"`
+	ASI                   string            `json:"asi"`
+	AppVersion            string            `json:"app_version"`
+	TACDefault            string            `json:"tac_default"`
+	TACOnline             string            `json:"tac_online"`
+	TACDenial             string            `json:"tac_denial"`
+	FloorLimit            string            `json:"floor_limit"`
+	Threshold             string            `json:"threshold"`
+	MaxTargetPercent      string            `json:"max_target_percent"`
+	TargetPercent         string            `json:"target_percent"`
+	DefaultDDOL           string            `json:"default_ddol"`
+	OnlinePIN             string            `json:"online_pin"`
+	ContactlessFloorLimit string            `json:"contactless_floor_limit"`
+	ContactlessLimit      string            `json:"contactless_limit"`
+	CVMLimit              string            `json:"cvm_limit"`
+	Tags                  map[string]string `json:"tags"`
+}
+
+// ParseAID reads application parameters from their download TLVs.
+func ParseAID(tlvs []TLV) (*AID, error) {
+	a := &AID{Tags: make(map[string]string)}
+	for _, t := range tlvs {
+		a.Tags[t.Tag] = strings.ToUpper(hex.EncodeToString(t.Value))
+	}
+	fields := map[string]*string{
+		"9F06": &a.AID, "DF01": &a.ASI, "9F09": &a.AppVersion,
+		"DF11": &a.TACDefault, "DF12": &a.TACOnline, "DF13": &a.TACDenial,
+		"9F1B": &a.FloorLimit, "DF15": &a.Threshold, "DF16": &a.MaxTargetPercent,
+		"DF17": &a.TargetPercent, "DF14": &a.DefaultDDOL, "DF18": &a.OnlinePIN,
+		"DF19": &a.ContactlessFloorLimit, "DF20": &a.ContactlessLimit, "DF21": &a.CVMLimit,
+	}
+	for tag, dst := range fields {
+		*dst = a.Tags[tag]
+	}
+	if a.AID == "" {
+		return nil, fmt.Errorf(ERR_AID_FIELDS, "9F06")
+	}
+	return a, nil
+}
+
+// emvDate returns an expiry sent either as 8 ASCII digits or 4 BCD bytes.
+func emvDate(value []byte) string {
+	if len(value) == 8 {
+		if _, err := strconv.Atoi(string(value)); err == nil {
+			return string(value)
+		}
+	}
+	return strings.ToUpper(hex.EncodeToString(value))
+}
+
+// EMVParams are the downloaded AIDs and CA public keys. With a path every
+// Save writes them to the file.
+type EMVParams struct {
+	path  string
+	mu    sync.Mutex
+	AIDs  []AID  `json:"aids"`
+	CAPKs []CAPK `json:"capks"`
+}
+
+// OpenEMVParams loads the parameters kept at path; a missing file gives
+// empty parameters. An empty path keeps them in memory only.
+func OpenEMVParams(path string) (*EMVParams, error) {
+	p := &EMVParams{path: path}
+	if path == "" {
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PutCAPK adds k, replacing a key with the same RID and index.
+func (p *EMVParams) PutCAPK(k CAPK) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.CAPKs {
+		if p.CAPKs[i].RID == k.RID && p.CAPKs[i].Index == k.Index {
+			p.CAPKs[i] = k
+			return
+		}
+	}
+	p.CAPKs = append(p.CAPKs, k)
+}
+
+// PutAID adds a, replacing parameters for the same AID.
+func (p *EMVParams) PutAID(a AID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.AIDs {
+		if p.AIDs[i].AID == a.AID {
+			p.AIDs[i] = a
+			return
+		}
+	}
+	p.AIDs = append(p.AIDs, a)
+}
+
+// FindCAPK returns the key for rid and index.
+func (p *EMVParams) FindCAPK(rid, index string) (*CAPK, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.CAPKs {
+		if k.RID == rid && k.Index == index {
+			return &k, true
+		}
+	}
+	return nil, false
+}
+
+// Save writes the parameters to their file.
+func (p *EMVParams) Save() error {
+	if p.path == "" {
+		return nil
+	}
+	p.mu.Lock()
+	data, err := json.Marshal(p)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.path, data)
+}
+
+// EMVDownload runs the parameter downloads that follow sign-in: query the
+// status list, download each entry, then end the download.
+type EMVDownload struct {
+	Sender     Sender
+	State      *TerminalState
+	Params     *EMVParams
+	Tpdu       string
+	Header     string
+	TerminalID string
+	MerchantID string
+}
+
+// DownloadCAPKs downloads, verifies and saves every CA public key the host
+// lists. It returns the number of keys stored.
+func (d *EMVDownload) DownloadCAPKs(ctx context.Context) (int, error) {
+	return d.download(ctx, NetCAPKStatus, NetCAPKDownload, NetCAPKDownloadEnd, []string{"9F06", "9F22"}, func(tlvs []TLV) error {
+		k, err := ParseCAPK(tlvs)
+		if err != nil {
+			return err
+		}
+		if err := k.Verify(); err != nil {
+			return err
+		}
+		d.Params.PutCAPK(*k)
+		return nil
+	})
+}
+
+// DownloadAIDs downloads and saves the parameters of every AID the host
+// lists. It returns the number of AIDs stored.
+func (d *EMVDownload) DownloadAIDs(ctx context.Context) (int, error) {
+	return d.download(ctx, NetAIDStatus, NetAIDDownload, NetAIDDownloadEnd, []string{"9F06"}, func(tlvs []TLV) error {
+		a, err := ParseAID(tlvs)
+		if err != nil {
+			return err
+		}
+		d.Params.PutAID(*a)
+		return nil
+	})
+}
+
+func (d *EMVDownload) download(ctx context.Context, statusCode, downloadCode, endCode string, keyTags []string, store func([]TLV) error) (int, error) {
+	entries, err := d.statusList(ctx, statusCode, keyTags)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		var key []TLV
+		for _, tag := range keyTags {
+			if value, ok := FindTLV(entry, tag); ok {
+				key = append(key, TLV{Tag: tag, Value: value})
+			}
+		}
+		status, tlvs, err := d.exchange(ctx, "0800", downloadCode, key)
+		if err != nil {
+			return 0, err
+		}
+		if status == emvNoData {
+			name := ""
+			if len(key) > 0 {
+				name = strings.ToUpper(hex.EncodeToString(key[0].Value))
+			}
+			return 0, fmt.Errorf(ERR_EMV_NO_DATA, name)
+		}
+		if err := store(tlvs); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, _, err := d.exchange(ctx, "0800", endCode, nil); err != nil {
+		return 0, err
+	}
+	return len(entries), d.Params.Save()
+}
+
+// maxEMVEntries is the most entries the two digit page offset of the
+// status query can address.
+const maxEMVEntries = 99
+
+// statusList queries the list of entries to download. The host answers in
+// pages; status '2' asks for the next page, which starts after the entries
+// received so far. A '2' page without entries fails rather than asking
+// for the same page again.
+func (d *EMVDownload) statusList(ctx context.Context, statusCode string, keyTags []string) ([][]TLV, error) {
+	var entries [][]TLV
+	for {
+		if len(entries) > maxEMVEntries {
+			return nil, fmt.Errorf(ERR_EMV_LIST_TOO_LONG, maxEMVEntries, statusCode)
+		}
+		offset := []byte(fmt.Sprintf("1%02d", len(entries)))
+		status, tlvs, err := d.exchangeRaw(ctx, "0820", statusCode, offset)
+		if err != nil {
+			return nil, err
+		}
+		page, err := splitEntries(tlvs, keyTags)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if status != emvMore {
+			return entries, nil
+		}
+		if len(page) == 0 {
+			return nil, fmt.Errorf(ERR_EMV_EMPTY_PAGE, statusCode)
+		}
+	}
+}
+
+// splitEntries cuts a TLV list into entries, each starting with the first
+// of keyTags. Data ahead of the first entry and entries lacking any of
+// keyTags are rejected.
+func splitEntries(tlvs []TLV, keyTags []string) ([][]TLV, error) {
+	var out [][]TLV
+	for _, t := range tlvs {
+		if t.Tag == keyTags[0] {
+			out = append(out, nil)
+		} else if len(out) == 0 {
+			return nil, fmt.Errorf(ERR_EMV_ENTRY, t.Tag)
+		}
+		out[len(out)-1] = append(out[len(out)-1], t)
+	}
+	for _, entry := range out {
+		for _, tag := range keyTags {
+			if _, ok := FindTLV(entry, tag); !ok {
+				return nil, fmt.Errorf(ERR_EMV_ENTRY, tag)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (d *EMVDownload) exchange(ctx context.Context, mti, netCode string, tlvs []TLV) (byte, []TLV, error) {
+	data, err := EncodeTLV(tlvs)
+	if err != nil {
+		return 0, nil, err
+	}
+	return d.exchangeRaw(ctx, mti, netCode, data)
+}
+
+// exchangeRaw sends field62 and returns the status byte and TLVs of the
+// response's field 62.
+func (d *EMVDownload) exchangeRaw(ctx context.Context, mti, netCode string, field62 []byte) (byte, []TLV, error) {
+	stan, err := d.State.NextSTAN()
+	if err != nil {
+		return 0, nil, err
+	}
+	req := newNetworkMessage(mti, d.Tpdu, d.Header, stan, d.State.Batch(), d.TerminalID, d.MerchantID, netCode)
+	if len(field62) > 0 {
+		req.Fields[62] = NewFieldVar(LLLVAR, BINARY, strings.ToUpper(hex.EncodeToString(field62)))
+	}
+	resp, err := d.Sender.Send(ctx, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.FieldString(39) != RespApproved {
+		return 0, nil, fmt.Errorf(ERR_EMV_RESPONSE, netCode, resp.Mti, resp.FieldString(39))
+	}
+
+	raw, err := hex.DecodeString(resp.FieldString(62))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) == 0 {
+		return emvNoData, nil, nil
+	}
+	tlvs, err := ParseTLV(raw[1:])
+	return raw[0], tlvs, err
+}
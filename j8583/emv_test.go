@@ -0,0 +1,172 @@
+package j8583
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLV(t *testing.T) {
+	long := make([]byte, 200)
+	tlvs := []TLV{{Tag: "9F06", Value: []byte{0xA0, 0, 0, 0x03, 0x33}}, {Tag: "DF02", Value: long}, {Tag: "82", Value: []byte{0x7C, 0x00}}}
+	data, err := EncodeTLV(tlvs)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xDF, 0x02, 0x81, 0xC8}, data[8:12])
+
+	parsed, err := ParseTLV(data)
+	assert.NoError(t, err)
+	assert.Equal(t, tlvs, parsed)
+
+	_, err = ParseTLV(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+func testCAPKTLVs(index byte, corrupt bool) []TLV {
+	rid := []byte{0xA0, 0x00, 0x00, 0x03, 0x33}
+	modulus := []byte(strings.Repeat("\xC6", 128))
+	exponent := []byte{0x03}
+	sum := sha1.Sum(append(append(append(append([]byte{}, rid...), index), modulus...), exponent...))
+	if corrupt {
+		sum[0] ^= 0xFF
+	}
+	return []TLV{
+		{Tag: "9F06", Value: rid}, {Tag: "9F22", Value: []byte{index}}, {Tag: "DF05", Value: []byte("20291231")},
+		{Tag: "DF06", Value: []byte{0x01}}, {Tag: "DF07", Value: []byte{0x01}},
+		{Tag: "DF02", Value: modulus}, {Tag: "DF04", Value: exponent}, {Tag: "DF03", Value: sum[:]},
+	}
+}
+
+// emvHost answers the CAPK status query with two keys and each download
+// with the key asked for.
+func emvHost(corrupt bool) func(m *Message) (*Message, error) {
+	return func(m *Message) (*Message, error) {
+		resp := NewResponse(m, RespApproved)
+		_, _, netCode := m.Field60()
+		var status byte = '1'
+		var tlvs []TLV
+		switch netCode {
+		case NetCAPKStatus:
+			tlvs = append(testCAPKTLVs(0x01, false)[:3], testCAPKTLVs(0x02, false)[:3]...)
+		case NetCAPKDownload:
+			raw, _ := hex.DecodeString(m.FieldString(62))
+			req, _ := ParseTLV(raw)
+			index, _ := FindTLV(req, "9F22")
+			tlvs = testCAPKTLVs(index[0], corrupt && index[0] == 0x02)
+		default:
+			return resp, nil
+		}
+		data, _ := EncodeTLV(tlvs)
+		resp.Fields[62] = NewFieldVar(LLLVAR, BINARY, hex.EncodeToString(append([]byte{status}, data...)))
+		return resp, nil
+	}
+}
+
+func TestDownloadCAPKs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "emv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "emv.json")
+
+	params, _ := OpenEMVParams(path)
+	state, _ := OpenTerminalState("")
+	sender := &scriptedSender{}
+	for i := 0; i < 4; i++ {
+		sender.replies = append(sender.replies, emvHost(false))
+	}
+	d := &EMVDownload{Sender: sender, State: state, Params: params, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175"}
+
+	n, err := d.DownloadCAPKs(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "0820", sender.sent[0].Mti)
+	_, _, netCode := sender.sent[3].Field60()
+	assert.Equal(t, NetCAPKDownloadEnd, netCode)
+
+	params, _ = OpenEMVParams(path)
+	k, ok := params.FindCAPK("A000000333", "02")
+	assert.True(t, ok)
+	assert.Equal(t, "20291231", k.Expiry)
+	assert.Equal(t, "03", k.Exponent)
+}
+
+func TestDownloadCAPKBadHash(t *testing.T) {
+	params, _ := OpenEMVParams("")
+	state, _ := OpenTerminalState("")
+	sender := &scriptedSender{}
+	for i := 0; i < 3; i++ {
+		sender.replies = append(sender.replies, emvHost(true))
+	}
+	d := &EMVDownload{Sender: sender, State: state, Params: params, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175"}
+	_, err := d.DownloadCAPKs(context.Background())
+	assert.Error(t, err)
+}
+
+func TestParseAID(t *testing.T) {
+	a, err := ParseAID([]TLV{{Tag: "9F06", Value: []byte{0xA0, 0, 0, 0x03, 0x33, 0x01, 0x01, 0x01}}, {Tag: "DF01", Value: []byte{0x00}},
+		{Tag: "9F1B", Value: []byte{0, 0, 0x27, 0x10}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "A000000333010101", a.AID)
+	assert.Equal(t, "00002710", a.FloorLimit)
+
+	_, err = ParseAID([]TLV{{Tag: "DF01", Value: []byte{0x00}}})
+	assert.Error(t, err)
+}
+
+func TestCAPKVerify(t *testing.T) {
+	k, err := ParseCAPK(testCAPKTLVs(0x01, false))
+	assert.NoError(t, err)
+	assert.NoError(t, k.Verify())
+
+	noHash := *k
+	noHash.Hash = ""
+	assert.Error(t, noHash.Verify())
+
+	otherHash := *k
+	otherHash.HashAlgorithm = "02"
+	assert.Error(t, otherHash.Verify())
+}
+
+func TestStatusListEmptyPage(t *testing.T) {
+	// the host keeps asking for another page without sending any entries
+	more := func(m *Message) (*Message, error) {
+		resp := NewResponse(m, RespApproved)
+		resp.Fields[62] = NewFieldVar(LLLVAR, BINARY, "32")
+		return resp, nil
+	}
+	state, _ := OpenTerminalState("")
+	params, _ := OpenEMVParams("")
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){more, more}}
+	d := &EMVDownload{Sender: sender, State: state, Params: params, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175"}
+	_, err := d.DownloadCAPKs(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(sender.sent))
+}
+
+func TestStatusListMissingKeyTags(t *testing.T) {
+	// an entry of the CAPK list without its index must not reach the download
+	broken := func(m *Message) (*Message, error) {
+		resp := NewResponse(m, RespApproved)
+		data, _ := EncodeTLV([]TLV{{Tag: "9F06", Value: []byte{0xA0, 0, 0, 0x03, 0x33}}})
+		resp.Fields[62] = NewFieldVar(LLLVAR, BINARY, hex.EncodeToString(append([]byte{'1'}, data...)))
+		return resp, nil
+	}
+	state, _ := OpenTerminalState("")
+	params, _ := OpenEMVParams("")
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){broken}}
+	d := &EMVDownload{Sender: sender, State: state, Params: params, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175"}
+	_, err := d.DownloadCAPKs(context.Background())
+	assert.Error(t, err)
+
+	_, err = splitEntries([]TLV{{Tag: "DF05", Value: []byte("2029")}}, []string{"9F06", "9F22"})
+	assert.Error(t, err)
+}
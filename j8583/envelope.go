@@ -0,0 +1,150 @@
+package j8583
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"8583/security"
+)
+
+const (
+	EnvelopeFlag      byte = 0xE6
+	EnvelopeHeaderLen      = 1 + envelopeMerchantLen + envelopeTerminalLen + envelopeLengthLen + envelopeReservedLen
+
+	envelopeMerchantLen = 15
+	envelopeTerminalLen = 8
+	envelopeLengthLen   = 4
+	envelopeReservedLen = 12
+)
+
+const (
+	ERR_ENVELOPE_SHORT    string = "envelope is shorter than its header"
+	ERR_ENVELOPE_FLAG     string = "invalid envelope flag: %02X"
+	ERR_ENVELOPE_LENGTH   string = "invalid envelope length: %s"
+	ERR_ENVELOPE_MISMATCH string = "envelope length mismatch; declared=%d, decrypted=%d"
+	ERR_ENVELOPE_BLOCK    string = "envelope body is not a multiple of the cipher block size"
+)
+
+// Envelope is the clear header sent in front of a message body encrypted with
+// the TDK: flag byte, merchant ID (field 42), terminal ID (field 41), the
+// plaintext length as four ASCII digits and twelve reserved bytes. Algorithm
+// selects DES or SM4 for the body.
+type Envelope struct {
+	Flag       byte
+	MerchantID string
+	TerminalID string
+	Length     int
+	Reserved   string
+	Algorithm  security.Algorithm
+}
+
+// NewEnvelope builds the envelope header for m from its fields 41 and 42.
+func NewEnvelope(m *Message) *Envelope {
+	e := &Envelope{Flag: EnvelopeFlag, Algorithm: m.Algorithm}
+	if value, ok := m.getFieldValue(42).(string); ok {
+		e.MerchantID = value
+	}
+	if value, ok := m.getFieldValue(41).(string); ok {
+		e.TerminalID = value
+	}
+	return e
+}
+
+// Seal encrypts plain with tdk and returns the header followed by the cipher
+// text. Length is set to len(plain).
+func (e *Envelope) Seal(plain, tdk []byte) ([]byte, error) {
+	if len(e.MerchantID) > envelopeMerchantLen || len(e.TerminalID) > envelopeTerminalLen {
+		return nil, errors.New("merchant or terminal id is too long for envelope")
+	}
+	if len(plain) > 9999 {
+		return nil, fmt.Errorf(ERR_VALUE_TOO_LONG, "Envelope", 9999, len(plain))
+	}
+	e.Length = len(plain)
+
+	encrypted, err := e.Algorithm.Encrypt(plain, tdk)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 0, EnvelopeHeaderLen+len(encrypted))
+	ret = append(ret, e.Flag)
+	ret = append(ret, padRight(e.MerchantID, envelopeMerchantLen)...)
+	ret = append(ret, padRight(e.TerminalID, envelopeTerminalLen)...)
+	ret = append(ret, []byte(fmt.Sprintf("%04d", e.Length))...)
+	ret = append(ret, padLeft(e.Reserved, envelopeReservedLen, '0')...)
+	ret = append(ret, encrypted...)
+	return ret, nil
+}
+
+// OpenEnvelope parses the envelope header at the start of raw, decrypts the
+// body with tdk and checks it against the declared length.
+func OpenEnvelope(raw, tdk []byte) (*Envelope, []byte, error) {
+	return OpenEnvelopeWith(raw, tdk, security.AlgDES)
+}
+
+// OpenEnvelopeWith is OpenEnvelope for a body encrypted with alg.
+func OpenEnvelopeWith(raw, tdk []byte, alg security.Algorithm) (e *Envelope, plain []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("Critical error:" + fmt.Sprint(r))
+			e, plain = nil, nil
+		}
+	}()
+
+	if len(raw) < EnvelopeHeaderLen {
+		return nil, nil, errors.New(ERR_ENVELOPE_SHORT)
+	}
+	if raw[0] != EnvelopeFlag {
+		return nil, nil, fmt.Errorf(ERR_ENVELOPE_FLAG, raw[0])
+	}
+
+	e = &Envelope{Flag: raw[0], Algorithm: alg}
+	start := 1
+	e.MerchantID = string(raw[start : start+envelopeMerchantLen])
+	start += envelopeMerchantLen
+	e.TerminalID = string(raw[start : start+envelopeTerminalLen])
+	start += envelopeTerminalLen
+	length := string(raw[start : start+envelopeLengthLen])
+	start += envelopeLengthLen
+	e.Length, err = strconv.Atoi(length)
+	if err != nil || e.Length < 0 {
+		return nil, nil, fmt.Errorf(ERR_ENVELOPE_LENGTH, length)
+	}
+	e.Reserved = string(raw[start : start+envelopeReservedLen])
+	start += envelopeReservedLen
+
+	body := raw[start:]
+	if len(body) == 0 || len(body)%alg.BlockSize() != 0 {
+		return nil, nil, errors.New(ERR_ENVELOPE_BLOCK)
+	}
+
+	plain, err = alg.Decrypt(body, tdk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plain) != e.Length {
+		return nil, nil, fmt.Errorf(ERR_ENVELOPE_MISMATCH, e.Length, len(plain))
+	}
+	return e, plain, nil
+}
+
+func padRight(value string, length int) []byte {
+	out := make([]byte, length)
+	copy(out, value)
+	for i := len(value); i < length; i++ {
+		out[i] = ' '
+	}
+	return out
+}
+
+func padLeft(value string, length int, pad byte) []byte {
+	if len(value) >= length {
+		return []byte(value[:length])
+	}
+	out := make([]byte, length-len(value))
+	for i := range out {
+		out[i] = pad
+	}
+	return append(out, value...)
+}
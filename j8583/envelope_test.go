@@ -0,0 +1,58 @@
+package j8583
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"8583/security"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	tdk, _ := hex.DecodeString("4551E676DFEFE6109252683B64B66E1F")
+	plain := []byte("0200 message body")
+
+	e := &Envelope{Flag: EnvelopeFlag, MerchantID: "666100041213175", TerminalID: "00003042"}
+	sealed, err := e.Seal(plain, tdk)
+	assert.NoError(t, err)
+	assert.Equal(t, "666100041213175", string(sealed[1:16]))
+	assert.Equal(t, "00003042", string(sealed[16:24]))
+	assert.Equal(t, "0017", string(sealed[24:28]))
+
+	opened, out, err := OpenEnvelope(sealed, tdk)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, out)
+	assert.Equal(t, "00003042", opened.TerminalID)
+	assert.Equal(t, 17, opened.Length)
+}
+
+func TestEnvelopeLengthMismatch(t *testing.T) {
+	tdk, _ := hex.DecodeString("4551E676DFEFE6109252683B64B66E1F")
+	sealed, err := (&Envelope{Flag: EnvelopeFlag}).Seal([]byte("12345678"), tdk)
+	assert.NoError(t, err)
+
+	copy(sealed[24:28], "0007")
+	_, _, err = OpenEnvelope(sealed, tdk)
+	assert.Error(t, err)
+
+	sealed[0] = 0x00
+	_, _, err = OpenEnvelope(sealed, tdk)
+	assert.Error(t, err)
+}
+
+func TestEnvelopeSM4(t *testing.T) {
+	m := &Message{Tpdu: "6004010000", Header: "602200000000", Mti: "0200", Algorithm: security.AlgSM4}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, "000025")
+	m.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+
+	data, err := m.Bytes("0123456789ABCDEFFEDCBA9876543210")
+	assert.NoError(t, err)
+	decoded, err := DecodeSealed(data, "0123456789ABCDEFFEDCBA9876543210", security.AlgSM4)
+	assert.NoError(t, err)
+	assert.Equal(t, "000025", decoded.Fields[11].Value)
+
+	_, err = DecodeDes(data, "0123456789ABCDEFFEDCBA9876543210")
+	assert.Error(t, err)
+}
@@ -24,6 +24,7 @@ const (
 	ERR_VALUE_TOO_LONG string = "length of value is longer than definition; type=%s, def_len=%d, len=%d"
 	ERR_BAD_RAW string = "bad raw data"
 	ERR_PARSE_LENGTH_FAILED string = "parse length head failed"
+	ERR_LENGTH_OVERFLOW string = "length of value does not fit the length head; max_len=%d, len=%d"
 )
 
 type Field struct {
@@ -31,6 +32,23 @@ type Field struct {
 	Value   interface{}
 	Encoder int
 	Length  int
+	Cipher  FieldCipher
+}
+
+// FieldCipher encrypts a field value when the field is encoded and decrypts
+// it when decoded, so Value always holds clear data
+type FieldCipher interface {
+	EncryptField(value string) (string, error)
+	DecryptField(value string) (string, error)
+}
+
+type FieldOption func(*Field)
+
+// WithCipher sets the cipher applied to the field on the wire
+func WithCipher(cipher FieldCipher) FieldOption {
+	return func(f *Field) {
+		f.Cipher = cipher
+	}
 }
 
 type SubField struct {
@@ -85,17 +103,24 @@ func NewFields(isoType, encoder int, subFields []SubField) Field {
 
 
 
-func NewFieldFix(encoder, length int, value  string) Field {
-	return Field{IsoType:FIXED, Value:value, Encoder:encoder, Length:length}
+func NewFieldFix(encoder, length int, value  string, opts ...FieldOption) Field {
+	field := Field{IsoType:FIXED, Value:value, Encoder:encoder, Length:length}
+	for _, opt := range opts {
+		opt(&field)
+	}
+	return field
 }
 
-func NewFieldVar(isoType, encoder int, value  string) Field {
+func NewFieldVar(isoType, encoder int, value  string, opts ...FieldOption) Field {
 	field := &Field{IsoType:isoType, Encoder:encoder, Value:value}
 	if encoder==BINARY{
 		field.Length=len(value)/2
 	}else {
 		field.Length=len(value)
 	}
+	for _, opt := range opts {
+		opt(field)
+	}
 	return *field
 }
 
@@ -104,18 +129,18 @@ func NewSubFieldFix(encoder, length int, value  string) SubField {
 }
 
 func (f *Field) Bytes() ([]byte, error) {
-	data := make([]byte, 0)
-	switch f.IsoType {
-	case LLVAR:
-		data = append(data, utils.Int2Byte(((f.Length / 10) << 4) | (f.Length % 10))...)
-	case LLLVAR:
-		data = append(data, utils.Int2Byte(f.Length / 100 + ((f.Length % 100) << 4) | (f.Length % 10))...)
-	case LLLLVAR:
-		data = append(data, utils.Int2Byte(((f.Length / 1000) << 4) | (f.Length / 100 % 10))...)
-		data = append(data, utils.Int2Byte((((f.Length % 100) / 10) << 4) | (f.Length % 10))...)
+	data, err := encodeLength(f.IsoType, f.Length)
+	if err != nil {
+		return nil, err
 	}
 
 	if value, ok := f.Value.(string); ok {
+		if f.Cipher != nil {
+			var err error
+			if value, err = f.Cipher.EncryptField(value); err != nil {
+				return nil, err
+			}
+		}
 		switch f.Encoder {
 		case ASCII:
 			data = append(data, []byte(value)...)
@@ -145,15 +170,9 @@ func (f *Field) Bytes() ([]byte, error) {
 }
 
 func (f *SubField) Bytes() ([]byte, error) {
-	data := make([]byte, 0)
-	switch f.IsoType {
-	case LLVAR:
-		data = append(data, utils.Int2Byte(((f.Length / 10) << 4) | (f.Length % 10))...)
-	case LLLVAR:
-		data = append(data, utils.Int2Byte(f.Length / 100 + ((f.Length % 100) << 4) | (f.Length % 10))...)
-	case LLLLVAR:
-		data = append(data, utils.Int2Byte(((f.Length / 1000) << 4) | (f.Length / 100 % 10))...)
-		data = append(data, utils.Int2Byte((((f.Length % 100) / 10) << 4) | (f.Length % 10))...)
+	data, err := encodeLength(f.IsoType, f.Length)
+	if err != nil {
+		return nil, err
 	}
 
 	switch f.Encoder {
@@ -173,27 +192,10 @@ func (f *SubField) Bytes() ([]byte, error) {
 	return data, nil
 }
 
-func (f *SubField)load(raw []byte) (read int, err error) {
-	var contentLen int
-	switch f.IsoType {
-	case LLVAR:
-		read = 1
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 2)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[0]))
-		}
-	case LLLVAR:
-		read = 2
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 3)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[:2]))
-		}
-	case LLLLVAR:
-		read = 2
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 4)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[:2]))
-		}
+func (f *SubField)load(raw []byte) (int, error) {
+	contentLen, read, err := decodeLength(f.IsoType, f.Length, raw)
+	if err != nil {
+		return 0, err
 	}
 
 	// parse body:
@@ -211,7 +213,12 @@ func (f *SubField)load(raw []byte) (read int, err error) {
 		f.Value = string(raw[read : read + contentLen])
 		read += contentLen
 	case rBCD:
-		fallthrough
+		bcdLen := (contentLen + 1) / 2
+		if len(raw) < (read + bcdLen) {
+			return 0, errors.New(ERR_BAD_RAW)
+		}
+		f.Value = string(bcdr2Ascii(raw[read:read + bcdLen], contentLen))
+		read += bcdLen
 	case BCD:
 		bcdLen := (contentLen + 1) / 2
 		if len(raw) < (read + bcdLen) {
@@ -225,27 +232,10 @@ func (f *SubField)load(raw []byte) (read int, err error) {
 	return read, nil
 }
 
-func (f *Field)load(raw []byte) (read int, err error) {
-	var contentLen int
-	switch f.IsoType {
-	case LLVAR:
-		read = 1
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 2)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[0]))
-		}
-	case LLLVAR:
-		read = 2
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 3)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[:2]))
-		}
-	case LLLLVAR:
-		read = 2
-		contentLen, err = strconv.Atoi(string(bcdr2Ascii(raw[:read], 4)))
-		if err != nil {
-			return 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + string(raw[:2]))
-		}
+func (f *Field)load(raw []byte) (int, error) {
+	contentLen, read, err := decodeLength(f.IsoType, f.Length, raw)
+	if err != nil {
+		return 0, err
 	}
 
 	// parse body:
@@ -263,7 +253,12 @@ func (f *Field)load(raw []byte) (read int, err error) {
 		f.Value = string(raw[read : read + contentLen])
 		read += contentLen
 	case rBCD:
-		fallthrough
+		bcdLen := (contentLen + 1) / 2
+		if len(raw) < (read + bcdLen) {
+			return 0, errors.New(ERR_BAD_RAW)
+		}
+		f.Value = string(bcdr2Ascii(raw[read:read + bcdLen], contentLen))
+		read += bcdLen
 	case BCD:
 		bcdLen := (contentLen + 1) / 2
 		if len(raw) < (read + bcdLen) {
@@ -275,6 +270,14 @@ func (f *Field)load(raw []byte) (read int, err error) {
 		return 0, errors.New(ERR_INVALID_ENCODER)
 	}
 
+	if value, ok := f.Value.(string); ok && f.Cipher != nil {
+		clear, err := f.Cipher.DecryptField(value)
+		if err != nil {
+			return 0, err
+		}
+		f.Value = clear
+	}
+
 	if value, ok := f.Value.([]SubField); ok {
 		for _, subField := range value {
 			length, error := subField.load(raw[read:])
@@ -287,6 +290,48 @@ func (f *Field)load(raw []byte) (read int, err error) {
 	return read, nil
 }
 
+// encodeLength returns the BCD length prefix for a variable field; a length
+// the prefix cannot hold is an error
+func encodeLength(isoType, length int) ([]byte, error) {
+	var max int
+	var format string
+	switch isoType {
+	case LLVAR:
+		max, format = 99, "%02d"
+	case LLLVAR:
+		max, format = 999, "%04d"
+	case LLLLVAR:
+		max, format = 9999, "%04d"
+	default:
+		return nil, nil
+	}
+	if length < 0 || length > max {
+		return nil, fmt.Errorf(ERR_LENGTH_OVERFLOW, max, length)
+	}
+	return rbcd([]byte(fmt.Sprintf(format, length))), nil
+}
+
+// decodeLength reads the length prefix of a field, returning the content
+// length and the number of prefix bytes consumed
+func decodeLength(isoType, fixed int, raw []byte) (contentLen, read int, err error) {
+	switch isoType {
+	case LLVAR:
+		read = 1
+	case LLLVAR, LLLLVAR:
+		read = 2
+	default:
+		return fixed, 0, nil
+	}
+	if len(raw) < read {
+		return 0, 0, errors.New(ERR_BAD_RAW)
+	}
+	contentLen, err = strconv.Atoi(string(bcd2Ascii(raw[:read])))
+	if err != nil {
+		return 0, 0, errors.New(ERR_PARSE_LENGTH_FAILED + ": " + utils.EncodeToString(raw[:read]))
+	}
+	return contentLen, read, nil
+}
+
 // Bytes encode Numeric field to bytes
 func endcode(encoder, length int, value string) ([]byte, error) {
 	val := []byte(value)
@@ -0,0 +1,95 @@
+package j8583
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const ERR_FILE_CORRUPT string = "%s cannot be decrypted"
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new content, never a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// sealedFile keeps a file sealed with AES-GCM under a local key, so that the
+// card data of queued messages never reaches the disk in clear. The file
+// holds the nonce followed by the sealed content, bound to a label naming
+// what it holds so that one queue's file cannot be loaded as another's.
+type sealedFile struct {
+	path  string
+	label []byte
+	aead  cipher.AEAD
+}
+
+// newSealedFile opens path for sealing under key, which must be 16, 24 or 32
+// bytes.
+func newSealedFile(path, label string, key []byte) (*sealedFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedFile{path: path, label: []byte(label), aead: aead}, nil
+}
+
+// read returns the clear content of the file; a missing file reads as
+// empty.
+func (f *sealedFile) read() ([]byte, error) {
+	sealed, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < f.aead.NonceSize() {
+		return nil, fmt.Errorf(ERR_FILE_CORRUPT, f.path)
+	}
+	nonce, body := sealed[:f.aead.NonceSize()], sealed[f.aead.NonceSize():]
+	data, err := f.aead.Open(nil, nonce, body, f.label)
+	if err != nil {
+		return nil, fmt.Errorf(ERR_FILE_CORRUPT, f.path)
+	}
+	return data, nil
+}
+
+// write seals data under a fresh nonce and replaces the file atomically.
+func (f *sealedFile) write(data []byte) error {
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, f.aead.Seal(nonce, nonce, data, f.label))
+}
@@ -0,0 +1,160 @@
+package j8583
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// LengthHeader selects how a frame's length prefix is encoded.
+type LengthHeader int
+
+const (
+	// LengthBinary2 is a 2 byte big endian binary length.
+	LengthBinary2 LengthHeader = iota
+	// LengthASCII4 is a 4 digit ASCII length, e.g. "0123".
+	LengthASCII4
+	// LengthBCD2 is a 4 digit BCD length in 2 bytes, e.g. 0x01 0x23.
+	LengthBCD2
+)
+
+// DefaultMaxFrame is the largest frame a Framer accepts unless told otherwise.
+const DefaultMaxFrame = 8192
+
+const (
+	ERR_FRAME_TOO_LONG      string = "frame length %d exceeds limit %d"
+	ERR_FRAME_LENGTH        string = "invalid frame length header: %X"
+	ERR_FRAME_LENGTH_HEADER string = "unknown frame length header: %d"
+	ERR_FRAME_EMPTY         string = "empty frame"
+)
+
+func (h LengthHeader) size() int {
+	switch h {
+	case LengthASCII4:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// limit is the largest length the header encoding can carry.
+func (h LengthHeader) limit() int {
+	switch h {
+	case LengthBinary2:
+		return 0xFFFF
+	default:
+		return 9999
+	}
+}
+
+// Framer reads and writes length prefixed frames over a stream such as a
+// net.Conn. When IncludeHeader is set the length counts the header bytes
+// as well as the payload.
+type Framer struct {
+	Header        LengthHeader
+	IncludeHeader bool
+	MaxFrame      int
+}
+
+func NewFramer(header LengthHeader) *Framer {
+	return &Framer{Header: header, MaxFrame: DefaultMaxFrame}
+}
+
+// Encode returns payload with its length header.
+func (f *Framer) Encode(payload []byte) ([]byte, error) {
+	length := len(payload)
+	if length == 0 {
+		return nil, errors.New(ERR_FRAME_EMPTY)
+	}
+	if err := f.checkLength(length); err != nil {
+		return nil, err
+	}
+	if f.IncludeHeader {
+		length += f.Header.size()
+	}
+	if length > f.Header.limit() {
+		return nil, fmt.Errorf(ERR_FRAME_TOO_LONG, length, f.Header.limit())
+	}
+
+	var header []byte
+	switch f.Header {
+	case LengthBinary2:
+		header = []byte{byte(length >> 8), byte(length)}
+	case LengthASCII4:
+		header = []byte(fmt.Sprintf("%04d", length))
+	case LengthBCD2:
+		header = bcd([]byte(fmt.Sprintf("%04d", length)))
+	default:
+		return nil, fmt.Errorf(ERR_FRAME_LENGTH_HEADER, f.Header)
+	}
+	return append(header, payload...), nil
+}
+
+// WriteFrame writes payload with its length header in a single Write.
+func (f *Framer) WriteFrame(w io.Writer, payload []byte) error {
+	frame, err := f.Encode(payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame and returns its payload. Frames longer than
+// MaxFrame are rejected before the payload is read. A zero length, which
+// hosts send on its own as a heartbeat, gives an empty payload.
+func (f *Framer) ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, f.Header.size())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var length int
+	switch f.Header {
+	case LengthBinary2:
+		length = int(header[0])<<8 | int(header[1])
+	case LengthASCII4, LengthBCD2:
+		digits := string(header)
+		if f.Header == LengthBCD2 {
+			digits = string(bcd2Ascii(header))
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf(ERR_FRAME_LENGTH, header)
+		}
+		length = n
+	default:
+		return nil, fmt.Errorf(ERR_FRAME_LENGTH_HEADER, f.Header)
+	}
+
+	if f.IncludeHeader {
+		length -= len(header)
+		if length < 0 {
+			return nil, fmt.Errorf(ERR_FRAME_LENGTH, header)
+		}
+	}
+	if err := f.checkLength(length); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (f *Framer) checkLength(length int) error {
+	max := f.MaxFrame
+	if max <= 0 {
+		max = DefaultMaxFrame
+	}
+	if length > max {
+		return fmt.Errorf(ERR_FRAME_TOO_LONG, length, max)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package j8583
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFramerHeaders(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 123)
+	cases := []struct {
+		framer *Framer
+		header []byte
+	}{
+		{&Framer{Header: LengthBinary2}, []byte{0x00, 0x7B}},
+		{&Framer{Header: LengthASCII4}, []byte("0123")},
+		{&Framer{Header: LengthBCD2}, []byte{0x01, 0x23}},
+		{&Framer{Header: LengthBinary2, IncludeHeader: true}, []byte{0x00, 0x7D}},
+		{&Framer{Header: LengthASCII4, IncludeHeader: true}, []byte("0127")},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		assert.NoError(t, c.framer.WriteFrame(&buf, payload))
+		assert.Equal(t, c.header, buf.Bytes()[:len(c.header)])
+
+		// a second frame behind the first must be left unread
+		assert.NoError(t, c.framer.WriteFrame(&buf, []byte{0x01}))
+		out, err := c.framer.ReadFrame(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, out)
+		out, err = c.framer.ReadFrame(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x01}, out)
+	}
+}
+
+func TestFramerLimits(t *testing.T) {
+	f := &Framer{Header: LengthBinary2, MaxFrame: 16}
+	assert.Error(t, f.WriteFrame(&bytes.Buffer{}, make([]byte, 17)))
+
+	_, err := f.ReadFrame(bytes.NewReader([]byte{0xFF, 0xFF}))
+	assert.Error(t, err)
+
+	_, err = f.ReadFrame(bytes.NewReader([]byte{0x00, 0x08, 0x01}))
+	assert.Error(t, err)
+
+	_, err = NewFramer(LengthASCII4).ReadFrame(bytes.NewReader([]byte("00x1a")))
+	assert.Error(t, err)
+
+	// a heartbeat is an empty frame, not an error
+	out, err := f.ReadFrame(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x01, 0x7F}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(out))
+	assert.Error(t, f.WriteFrame(&bytes.Buffer{}, nil))
+}
@@ -0,0 +1,307 @@
+package j8583
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Journal directions.
+const (
+	JournalSent     = "sent"
+	JournalReceived = "received"
+)
+
+// DefaultJournalSize is the size at which a FileJournal starts a new file.
+const DefaultJournalSize = 10 << 20
+
+// JournalEntry records one message. Sensitive fields are masked before an
+// entry is built: PAN, track data, expiry date, PIN block, key data, the
+// cardholder data objects of field 55 and the card numbers of a batch upload.
+type JournalEntry struct {
+	Time         time.Time      `json:"time"`
+	Direction    string         `json:"direction"`
+	MTI          string         `json:"mti"`
+	TerminalID   string         `json:"terminal_id"`
+	MerchantID   string         `json:"merchant_id"`
+	STAN         string         `json:"stan"`
+	RRN          string         `json:"rrn,omitempty"`
+	AuthCode     string         `json:"auth_code,omitempty"`
+	ResponseCode string         `json:"response_code,omitempty"`
+	Amount       string         `json:"amount,omitempty"`
+	Processing   string         `json:"processing_code,omitempty"`
+	TypeCode     string         `json:"type_code,omitempty"`
+	BatchNum     string         `json:"batch_num,omitempty"`
+	PAN          string         `json:"pan,omitempty"`
+	Fields       map[int]string `json:"fields"`
+}
+
+// NewJournalEntry records m as sent or received now.
+func NewJournalEntry(m *Message, direction string) JournalEntry {
+	typeCode, batchNum, netCode := m.Field60()
+	e := JournalEntry{
+		Time:         time.Now(),
+		Direction:    direction,
+		MTI:          m.Mti,
+		TerminalID:   m.FieldString(41),
+		MerchantID:   m.FieldString(42),
+		STAN:         m.FieldString(11),
+		RRN:          m.FieldString(37),
+		AuthCode:     m.FieldString(38),
+		ResponseCode: m.FieldString(39),
+		Amount:       m.FieldString(4),
+		Processing:   m.FieldString(3),
+		TypeCode:     typeCode,
+		BatchNum:     batchNum,
+		PAN:          MaskField(2, m.FieldString(2)),
+		Fields:       make(map[int]string),
+	}
+	for i := 1; i < len(m.Fields); i++ {
+		if value, ok := m.Fields[i].Value.(string); ok && value != "" {
+			e.Fields[i] = MaskField(i, value)
+		}
+	}
+	if value, ok := e.Fields[48]; ok && m.Mti == "0320" && netCode == NetBatchUpload {
+		e.Fields[48] = maskBatchUpload(value)
+	}
+	return e
+}
+
+// MaskField hides the sensitive part of field i: the PAN keeps its first six
+// and last four digits, track data, expiry, PIN block and key fields are
+// replaced entirely and field 55 loses its cardholder data objects.
+func MaskField(i int, value string) string {
+	if value == "" {
+		return ""
+	}
+	switch i {
+	case 2:
+		if len(value) <= 10 {
+			return strings.Repeat("*", len(value))
+		}
+		return value[:6] + strings.Repeat("*", len(value)-10) + value[len(value)-4:]
+	case 14, 35, 36, 45, 52, 62, 96:
+		return strings.Repeat("*", len(value))
+	case 55:
+		return maskICCData(value)
+	}
+	return value
+}
+
+// maskBatchUpload masks the card numbers of a batch upload field 48 (see
+// NewBatchUploadRequest), keeping their first six digits. Data that does not
+// follow the layout is replaced entirely.
+func maskBatchUpload(value string) string {
+	const record = 2 + 6 + 20 + 12
+	if len(value) < 2 || (len(value)-2)%record != 0 {
+		return strings.Repeat("*", len(value))
+	}
+	masked := []byte(value)
+	for i := 2; i < len(masked); i += record {
+		copy(masked[i+8+6:i+8+20], strings.Repeat("*", 14))
+	}
+	return string(masked)
+}
+
+// iccSensitiveTags are the field 55 data objects holding the PAN, track
+// data, cardholder name or expiry date.
+var iccSensitiveTags = map[string]bool{
+	"56": true, "57": true, "5A": true, "5F20": true, "5F24": true,
+	"9F0B": true, "9F1F": true, "9F20": true, "9F6B": true,
+}
+
+// maskICCData drops the sensitive data objects from the hex field 55 value.
+// Data that does not parse is replaced entirely.
+func maskICCData(value string) string {
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return strings.Repeat("*", len(value))
+	}
+	tlvs, err := ParseTLV(raw)
+	if err != nil {
+		return strings.Repeat("*", len(value))
+	}
+	kept := tlvs[:0]
+	for _, t := range tlvs {
+		if !iccSensitiveTags[t.Tag] {
+			kept = append(kept, t)
+		}
+	}
+	out, err := EncodeTLV(kept)
+	if err != nil {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.ToUpper(hex.EncodeToString(out))
+}
+
+// JournalQuery selects entries. Empty fields match everything; From and To
+// bound the entry time, To exclusive.
+type JournalQuery struct {
+	TerminalID string
+	STAN       string
+	RRN        string
+	BatchNum   string
+	From       time.Time
+	To         time.Time
+}
+
+func (q JournalQuery) match(e JournalEntry) bool {
+	switch {
+	case q.TerminalID != "" && q.TerminalID != e.TerminalID:
+		return false
+	case q.STAN != "" && q.STAN != e.STAN:
+		return false
+	case q.RRN != "" && q.RRN != e.RRN:
+		return false
+	case q.BatchNum != "" && q.BatchNum != e.BatchNum:
+		return false
+	case !q.From.IsZero() && e.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !e.Time.Before(q.To):
+		return false
+	}
+	return true
+}
+
+// Journal is the audit trail of messages sent and received.
+type Journal interface {
+	Append(e JournalEntry) error
+	// Query returns matching entries oldest first.
+	Query(q JournalQuery) ([]JournalEntry, error)
+	Close() error
+}
+
+// Record appends m to j as sent or received.
+func Record(j Journal, m *Message, direction string) error {
+	return j.Append(NewJournalEntry(m, direction))
+}
+
+// FileJournal appends entries as JSON lines to journal.jsonl in a directory.
+// When the file reaches MaxSize it is renamed with a timestamp and a new
+// one is started; queries read every file.
+type FileJournal struct {
+	MaxSize int64
+
+	dir  string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+const journalName = "journal.jsonl"
+
+func OpenFileJournal(dir string) (*FileJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &FileJournal{MaxSize: DefaultJournalSize, dir: dir}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *FileJournal) open() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, journalName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file, j.size = f, info.Size()
+	return nil
+}
+
+func (j *FileJournal) Append(e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.MaxSize > 0 && j.size > 0 && j.size+int64(len(line)) > j.MaxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// rotate renames the current file and opens a new one; the caller holds j.mu.
+func (j *FileJournal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	name := "journal-" + time.Now().Format("20060102T150405.000000000") + ".jsonl"
+	if err := os.Rename(filepath.Join(j.dir, journalName), filepath.Join(j.dir, name)); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+func (j *FileJournal) Query(q JournalQuery) ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rotated, err := filepath.Glob(filepath.Join(j.dir, "journal-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	files := append(rotated, filepath.Join(j.dir, journalName))
+
+	var out []JournalEntry
+	for _, name := range files {
+		entries, err := readJournalFile(name, q)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entries...)
+	}
+	return out, nil
+}
+
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+func readJournalFile(name string, q JournalQuery) ([]JournalEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn last line from a crash is skipped, not fatal
+			continue
+		}
+		if q.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,65 @@
+package j8583
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskField(t *testing.T) {
+	assert.Equal(t, "622588******5678", MaskField(2, "6225887912345678"))
+	assert.Equal(t, "*****", MaskField(35, "62258"))
+	assert.Equal(t, "000000000100", MaskField(4, "000000000100"))
+	// 9F26, 5A, 57 and 9F36: only the cryptogram and ATC are kept
+	assert.Equal(t, "9F260811223344556677889F36020001",
+		MaskField(55, "9F26081122334455667788"+"5A086225887912345678"+"570A6225887912345678D491"+"9F36020001"))
+	assert.Equal(t, "******", MaskField(55, "9F2608"))
+}
+
+func TestFileJournal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+
+	j, err := OpenFileJournal(dir)
+	assert.NoError(t, err)
+	j.MaxSize = 600
+
+	start := time.Now()
+	for _, stan := range []string{"000001", "000002", "000003", "000004"} {
+		m := newTestRequest("0200", stan)
+		m.Fields[2] = NewFieldVar(LLVAR, BCD, "6225887912345678")
+		m.Fields[35] = NewFieldVar(LLVAR, BCD, "6225887912345678D49121010000000000")
+		assert.NoError(t, Record(j, m, JournalSent))
+
+		resp := NewResponse(m, RespApproved)
+		resp.Fields[37] = NewFieldFix(ASCII, 12, "RRN"+stan+"000")
+		assert.NoError(t, Record(j, resp, JournalReceived))
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "journal-*.jsonl"))
+	assert.True(t, len(rotated) > 0)
+
+	entries, err := j.Query(JournalQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(entries))
+	assert.Equal(t, "622588******5678", entries[0].PAN)
+	assert.Equal(t, "**********************************", entries[0].Fields[35])
+
+	entries, _ = j.Query(JournalQuery{STAN: "000003"})
+	assert.Equal(t, 2, len(entries))
+	entries, _ = j.Query(JournalQuery{RRN: "RRN000002000"})
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "0210", entries[0].MTI)
+	entries, _ = j.Query(JournalQuery{From: start.Add(time.Hour)})
+	assert.Equal(t, 0, len(entries))
+	assert.NoError(t, j.Close())
+
+	j, err = OpenFileJournal(dir)
+	assert.NoError(t, err)
+	entries, _ = j.Query(JournalQuery{TerminalID: "00003042"})
+	assert.Equal(t, 8, len(entries))
+	j.Close()
+}
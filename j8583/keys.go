@@ -0,0 +1,140 @@
+package j8583
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"8583/security"
+	"8583/utils"
+)
+
+// SetMAC fills field 64 with the MAC of the message under the terminal's MAK.
+// The MAC block runs from the MTI to the last field before 64, with the bitmap
+// already announcing field 64.
+func (m *Message) SetMAC(store security.KeyStore, terminalID string) error {
+	return m.SetMACWith(security.NewSoftHSM(store), terminalID)
+}
+
+// VerifyMAC recomputes field 64 of a received message under the terminal's
+// MAK and reports whether it matches.
+func (m *Message) VerifyMAC(store security.KeyStore, terminalID string) (bool, error) {
+	return m.VerifyMACWith(security.NewSoftHSM(store), terminalID)
+}
+
+// SetMACWith is SetMAC with the MAC generated by hsm.
+func (m *Message) SetMACWith(hsm security.HSM, terminalID string) error {
+	data, err := m.macBlock()
+	if err != nil {
+		return err
+	}
+	mac, err := hsm.GenerateMAC(security.KeyRef{TerminalID: terminalID, Type: security.MAK}, m.Algorithm, data)
+	if err != nil {
+		return err
+	}
+	m.Fields[64] = NewFieldFix(BINARY, 8, utils.EncodeToString(mac))
+	return nil
+}
+
+// VerifyMACWith is VerifyMAC with the MAC checked by hsm.
+func (m *Message) VerifyMACWith(hsm security.HSM, terminalID string) (bool, error) {
+	received, _ := m.getFieldValue(64).(string)
+	mac, err := hex.DecodeString(received)
+	if err != nil || len(mac) == 0 {
+		return false, err
+	}
+	data, err := m.macBlock()
+	if err != nil {
+		return false, err
+	}
+	return hsm.VerifyMAC(security.KeyRef{TerminalID: terminalID, Type: security.MAK}, m.Algorithm, data, mac)
+}
+
+// macBlock returns the bytes covered by the MAC, leaving m untouched.
+func (m *Message) macBlock() ([]byte, error) {
+	check := *m
+	check.Fields = append([]Field(nil), m.Fields...)
+	check.Fields[64] = NewFieldFix(BINARY, 8, "0000000000000000")
+	data, err := check.BytesFields()
+	if err != nil {
+		return nil, err
+	}
+	return data[:len(data)-8], nil
+}
+
+// SetPinBlock fills field 52 with the PIN block of pin and pan encrypted under
+// the terminal's PIK. SM4 PIN blocks are 16 bytes.
+func (m *Message) SetPinBlock(pin, pan string, store security.KeyStore, terminalID string) error {
+	pik, err := store.Get(terminalID, security.PIK)
+	if err != nil {
+		return err
+	}
+	block, err := m.Algorithm.EncryptPinBlock(pin, pan, pik)
+	if err != nil {
+		return err
+	}
+	m.Fields[52] = NewFieldFix(BINARY, m.Algorithm.BlockSize(), utils.EncodeToString(block))
+	return nil
+}
+
+// BytesWithStore marshals m, sealing it in an envelope when the terminal has
+// a TDK in store.
+func (m *Message) BytesWithStore(store security.KeyStore, terminalID string) ([]byte, error) {
+	tdk, err := store.Get(terminalID, security.TDK)
+	if err == security.ErrKeyNotFound {
+		return m.Bytes("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.Bytes(utils.EncodeToString(tdk))
+}
+
+// DecodeWithStore decodes raw, opening the envelope with the TDK of the
+// terminal named in the envelope header when the body is encrypted. alg is
+// the algorithm of the envelope, PIN block and MAC.
+func DecodeWithStore(raw []byte, store security.KeyStore, alg security.Algorithm) (*Message, error) {
+	clearSize := 10/2 + 12/2
+	if len(raw) <= clearSize || raw[clearSize] != EnvelopeFlag {
+		return DecodeWithAlgorithm(raw, alg)
+	}
+	if len(raw) < clearSize+EnvelopeHeaderLen {
+		return nil, errors.New(ERR_ENVELOPE_SHORT)
+	}
+	start := clearSize + 1 + envelopeMerchantLen
+	terminalID := strings.TrimRight(string(raw[start:start+envelopeTerminalLen]), " ")
+	tdk, err := store.Get(terminalID, security.TDK)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeSealed(raw, utils.EncodeToString(tdk), alg)
+}
+
+// ImportKeyBlocks imports the TR-31 key blocks carried in field 62 or 96 of
+// a response, unwrapping them under the terminal's TMK.
+func ImportKeyBlocks(m *Message, store security.KeyStore, terminalID string) ([]*security.TR31Header, error) {
+	var headers []*security.TR31Header
+	for _, i := range []int{62, 96} {
+		value, _ := m.getFieldValue(i).(string)
+		if len(value) == 0 {
+			continue
+		}
+		raw, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %s", i, err)
+		}
+		blocks, err := security.SplitTR31(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %s", i, err)
+		}
+		for _, block := range blocks {
+			h, err := security.ImportTR31(store, terminalID, block)
+			if err != nil {
+				return nil, fmt.Errorf("field %d: %s", i, err)
+			}
+			headers = append(headers, h)
+		}
+	}
+	return headers, nil
+}
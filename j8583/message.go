@@ -5,7 +5,6 @@ import (
 	"errors"
 	"strconv"
 	"encoding/hex"
-	"bytes"
 	"8583/security"
 	"8583/utils"
 )
@@ -21,6 +20,7 @@ type Message struct {
 	Bitmap       string
 	Fields       []Field
 	SecondBitmap bool
+	Algorithm    security.Algorithm
 }
 
 func (m *Message)SetField(i int, field Field) {
@@ -44,6 +44,30 @@ func (m *Message)getFieldValue(i int) interface{} {
 	return m.Fields[i].Value
 }
 
+// FieldString returns the value of field i when it is a plain string field,
+// or "" when the field is absent
+func (m *Message) FieldString(i int) string {
+	if i < 1 || i >= len(m.Fields) {
+		return ""
+	}
+	value, _ := m.Fields[i].Value.(string)
+	return value
+}
+
+// Field60 splits field 60 into the message type code (60.1), batch number
+// (60.2) and network management information code (60.3). Parts beyond the
+// end of the field are returned empty.
+func (m *Message) Field60() (typeCode, batchNum, netCode string) {
+	value := m.FieldString(60)
+	part := func(from, to int) string {
+		if len(value) < to {
+			return ""
+		}
+		return value[from:to]
+	}
+	return part(0, 2), part(2, 8), part(8, 11)
+}
+
 func (m *Message)fieldLength() int {
 	size := 64
 	if (m.SecondBitmap) {
@@ -62,35 +86,27 @@ func (m *Message) BytesFields() (ret []byte, err error) {
 	bitmap := make([]byte, byteNum)
 	data := make([]byte, 0, 512)
 
-	for byteIndex := 0; byteIndex < byteNum; byteIndex++ {
-		for bitIndex := 0; bitIndex < 8; bitIndex++ {
-
-			i := byteIndex * 8 + bitIndex + 1
-
-			// if we need second bitmap (additional 8 bytes) - set first bit in first bitmap
-			if m.SecondBitmap && i == 1 {
-				step := uint(7 - bitIndex)
-				bitmap[byteIndex] |= (0x01 << step)
-			}
-
-			for i, f := range m.Fields {
-				//判断不好
-				if i < 2 || f.Value == nil {
-					continue
-				}
+	// if we need second bitmap (additional 8 bytes) - set first bit in first bitmap
+	if m.SecondBitmap {
+		bitmap[0] |= 0x80
+	}
 
-				// mark 1 in bitmap:
-				step := uint(7 - bitIndex)
-				bitmap[byteIndex] |= (0x01 << step)
+	for i, f := range m.Fields {
+		if i < 2 || i > byteNum * 8 || f.Value == nil {
+			continue
+		}
 
-				d, err := f.Bytes();
-				if err != nil {
-					return nil, err
-				}
+		// mark 1 in bitmap:
+		byteIndex := (i - 1) / 8
+		step := uint(7 - (i - 1) % 8)
+		bitmap[byteIndex] |= (0x01 << step)
 
-				data = append(data, d...)
-			}
+		d, err := f.Bytes();
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %s", i, err)
 		}
+
+		data = append(data, d...)
 	}
 
 	ret = append(ret, bitmap...)
@@ -134,31 +150,17 @@ func (m *Message) Bytes(tdk string) (ret []byte, err error) {
 		return ret, nil
 	}
 
-	hexByte1, err := hex.DecodeString("E6")
+	key, err := hex.DecodeString(tdk)
 	if err != nil {
 		return nil, err
 	}
-	ret = append(ret, hexByte1...)
-	if value42, ok := m.Fields[42].Value.(string); ok {
-		ret = append(ret, []byte(value42)...)
-	}
-	if value41, ok := m.Fields[42].Value.(string); ok {
-		ret = append(ret, []byte(value41)...)
-	}
-	ret = append(ret, []byte(fmt.Sprintf("%04d", len(fieldsByte)))...)
-	ret = append(ret, []byte("000000000000")...)
 
-	hexByte2, err := hex.DecodeString(tdk)
+	envelope, err := NewEnvelope(m).Seal(fieldsByte, key)
 	if err != nil {
 		return nil, err
 	}
 
-	encryBytes, err := security.EncryptWithDESKey(fieldsByte, hexByte2)
-	if err != nil {
-		return nil, err
-	}
-
-	ret = append(ret, encryBytes...)
+	ret = append(ret, envelope...)
 
 	return ret, nil
 }
@@ -168,11 +170,7 @@ func (m *Message) BytesLenHeader(tdk string) (ret []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
-	length := len(data)
-	buf := bytes.NewBuffer(utils.Int2Byte((length & 0xff00) >> 8))
-	buf.WriteByte((byte)((length & 0x00ff)))
-	buf.Write(data)
-	return buf.Bytes(), nil
+	return NewFramer(LengthBinary2).Encode(data)
 }
 
 func (m *Message) encodeTpdu() ([]byte, error) {
@@ -206,6 +204,22 @@ func (m *Message) encodeHeader() ([]byte, error) {
 }
 
 func Decode(raw []byte) (m *Message, err error) {
+	return decode(raw, security.AlgDES, nil)
+}
+
+// DecodeWithAlgorithm decodes a message whose PIN block and MAC use alg; an
+// SM4 PIN block in field 52 is 16 bytes
+func DecodeWithAlgorithm(raw []byte, alg security.Algorithm) (m *Message, err error) {
+	return decode(raw, alg, nil)
+}
+
+// DecodeWithCiphers decodes raw, decrypting the fields listed in ciphers
+// (e.g. 35 and 36 under the TDK) as they are loaded
+func DecodeWithCiphers(raw []byte, ciphers map[int]FieldCipher) (m *Message, err error) {
+	return decode(raw, security.AlgDES, ciphers)
+}
+
+func decode(raw []byte, alg security.Algorithm, ciphers map[int]FieldCipher) (m *Message, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("Critical error:" + fmt.Sprint(r))
@@ -217,19 +231,21 @@ func Decode(raw []byte) (m *Message, err error) {
 	isoHeader, err := decodeMti(raw[5:11], BCD, 12)
 	mti, err := decodeMti(raw[11:13], BCD, 4)
 	bitmap := utils.EncodeToString(raw[13:21])
-	m = &Message{Tpdu:tpdu, Mti:mti, Header:isoHeader, Bitmap:bitmap, SecondBitmap:false}
+	m = &Message{Tpdu:tpdu, Mti:mti, Header:isoHeader, Bitmap:bitmap, SecondBitmap:false, Algorithm:alg}
 
-	fields := parseFields()
+	fields := parseFields(alg)
 
 	byteNum := 8
-	start := 21
+	start := 13
 	if raw[start] & 0x80 == 0x80 {
 		// 1st bit == 1
 		m.SecondBitmap = true
 		byteNum = 16
+		m.Bitmap = utils.EncodeToString(raw[start : start + byteNum])
 	}
 	bitByte := raw[start : start + byteNum]
 	start += byteNum
+	m.Fields = make([]Field, byteNum * 8 + 1)
 
 	for byteIndex := 0; byteIndex < byteNum; byteIndex++ {
 		for bitIndex := 0; bitIndex < 8; bitIndex++ {
@@ -247,43 +263,53 @@ func Decode(raw []byte) (m *Message, err error) {
 			if !ok {
 				return nil, fmt.Errorf("field %d not defined", i)
 			}
+			f.Cipher = ciphers[i]
 
 			l, err := f.load(raw[start:])
 			if err != nil {
 				return nil, fmt.Errorf("field %d: %s", i, err)
 			}
 			start += l
+			m.Fields[i] = *f
 		}
 	}
 	return m, err
 }
 
 func DecodeDes(raw []byte, tdk string) (m *Message, err error) {
-	minSize := 10 / 2 + 10 % 2 + 12 / 2 + 12 % 2 + 1 / 2 + 1 + 39
-	if len(raw) <= 0 {
+	return DecodeSealed(raw, tdk, security.AlgDES)
+}
+
+// DecodeSealed decodes a message whose body is enveloped under tdk with alg
+func DecodeSealed(raw []byte, tdk string, alg security.Algorithm) (m *Message, err error) {
+	// tpdu and iso header stay in clear ahead of the envelope
+	clearSize := 10 / 2 + 12 / 2
+	if len(raw) <= clearSize {
 		return nil, errors.New("buf size is not enough")
 	}
 
 	if len(tdk) <= 0 {
-		return nil, errors.New("messageCalculator should not be null")
+		return nil, errors.New("tdk should not be empty")
 	}
 
-	hexByte, err := hex.DecodeString(tdk)
+	key, err := hex.DecodeString(tdk)
 	if err != nil {
 		return nil, err
 	}
 
-	encryBytes, err := security.EncryptWithDESKey(raw[minSize:], hexByte)
+	_, plain, err := OpenEnvelopeWith(raw[clearSize:], key, alg)
 	if err != nil {
 		return nil, err
 	}
 
-	data := append(raw[:minSize - 1 - 39], encryBytes...)
+	data := make([]byte, 0, clearSize + len(plain))
+	data = append(data, raw[:clearSize]...)
+	data = append(data, plain...)
 
-	return Decode(data)
+	return decode(data, alg, nil)
 }
 
-func parseFields() map[int]*Field {
+func parseFields(alg security.Algorithm) map[int]*Field {
 	fieldmap := make(map[int]*Field, 0)
 	fieldmap[2] = &Field{IsoType:LLVAR, Encoder:BCD, }
 	fieldmap[3] = &Field{IsoType:FIXED, Encoder:BCD, Length:6, }
@@ -302,6 +328,7 @@ func parseFields() map[int]*Field {
 
 	fieldmap[32] = &Field{IsoType:LLVAR, Encoder:BCD, }
 	fieldmap[35] = &Field{IsoType:LLVAR, Encoder:BCD, }
+	fieldmap[36] = &Field{IsoType:LLLVAR, Encoder:BCD, }
 
 	fieldmap[37] = &Field{IsoType:FIXED, Encoder:ASCII, Length:12, }
 	fieldmap[38] = &Field{IsoType:FIXED, Encoder:ASCII, Length:6, }
@@ -315,7 +342,7 @@ func parseFields() map[int]*Field {
 
 	fieldmap[49] = &Field{IsoType:FIXED, Encoder:ASCII, Length:3, }
 	fieldmap[51] = &Field{IsoType:FIXED, Encoder:ASCII, Length:3, }
-	fieldmap[52] = &Field{IsoType:FIXED, Encoder:BINARY, Length:8, }
+	fieldmap[52] = &Field{IsoType:FIXED, Encoder:BINARY, Length:alg.BlockSize(), }
 	fieldmap[53] = &Field{IsoType:FIXED, Encoder:BCD, Length:16, }
 
 	fieldmap[54] = &Field{IsoType:LLLVAR, Encoder:ASCII, }
@@ -338,11 +365,12 @@ func parseFields() map[int]*Field {
 
 	fieldmap[62] = &Field{IsoType:LLLVAR, Encoder:BINARY, }
 
-	subField63 := make([]*SubField, 1)
-	subField63[0] = &SubField{IsoType:FIXED, Encoder:BCD, Length:3, }
-	fieldmap[63] = NewSubField(LLLVAR, BCD, subField63)
+	fieldmap[63] = &Field{IsoType:LLLVAR, Encoder:ASCII, }
 
 	fieldmap[64] = &Field{IsoType:FIXED, Encoder:BINARY, Length:8, }
+
+	// key blocks (TR-31) delivered with a second bitmap
+	fieldmap[96] = &Field{IsoType:LLLVAR, Encoder:BINARY, }
 	return fieldmap
 }
 
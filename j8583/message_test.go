@@ -7,4 +7,46 @@ import (
 
 func TestExp(t *testing.T) {
 	assert.Equal(t, false, "" == "", "token should not empty")
-}
\ No newline at end of file
+}
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{Tpdu: "6004010000", Header: "602200000000", Mti: "0200"}
+	m.Fields = make([]Field, 65)
+	m.Fields[2] = NewFieldVar(LLVAR, BCD, "6222021234567890123")
+	m.Fields[3] = NewFieldFix(BCD, 6, "000000")
+	m.Fields[11] = NewFieldFix(BCD, 6, "000025")
+	m.Fields[22] = NewFieldFix(BCD, 3, "040")
+	m.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+	m.Fields[62] = NewFieldVar(LLLVAR, BINARY, "0102030405")
+
+	data, err := m.Bytes("")
+	assert.NoError(t, err)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "0200", decoded.Mti)
+	assert.Equal(t, "6222021234567890123", decoded.Fields[2].Value)
+	assert.Equal(t, "000025", decoded.Fields[11].Value)
+	assert.Equal(t, "040", decoded.Fields[22].Value)
+	assert.Equal(t, "00003042", decoded.Fields[41].Value)
+	assert.Equal(t, "0102030405", decoded.Fields[62].Value)
+	assert.Nil(t, decoded.Fields[4].Value)
+
+	data, err = m.Bytes("4551E676DFEFE6109252683B64B66E1F")
+	assert.NoError(t, err)
+	decoded, err = DecodeDes(data, "4551E676DFEFE6109252683B64B66E1F")
+	assert.NoError(t, err)
+	assert.Equal(t, "000025", decoded.Fields[11].Value)
+}
+
+func TestFieldLengthOverflow(t *testing.T) {
+	long := NewFieldVar(LLVAR, BCD, "62220212345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345")
+	_, err := long.Bytes()
+	assert.Error(t, err)
+
+	m := &Message{Tpdu: "6004010000", Header: "602200000000", Mti: "0200"}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, "000001")
+	m.Fields[63] = NewFieldVar(LLLVAR, ASCII, string(make([]byte, 1000)))
+	_, err = m.Bytes("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,274 @@
+package j8583
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EchoTest is the network management information code (field 60.3) of an
+// echo test.
+const EchoTest = "301"
+
+const (
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+const (
+	ERR_POOL_NO_LINK string = "no healthy connection available"
+	ERR_POOL_CLOSED  string = "pool closed"
+	ERR_ECHO_FAILED  string = "echo test failed; response code=%s"
+)
+
+// NewEchoRequest builds the 0820 echo test sent on idle links.
+func NewEchoRequest(tpdu, header, stan, batchNum, terminalID, merchantID string) *Message {
+	m := &Message{Tpdu: tpdu, Header: header, Mti: "0820"}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, stan)
+	m.Fields[41] = NewFieldFix(ASCII, 8, terminalID)
+	m.Fields[42] = NewFieldFix(ASCII, 15, merchantID)
+
+	subField60 := make([]SubField, 3)
+	subField60[0] = NewSubFieldFix(BCD, 2, "00")
+	subField60[1] = NewSubFieldFix(BCD, 6, batchNum)
+	subField60[2] = NewSubFieldFix(BCD, 3, EchoTest)
+	m.Fields[60] = NewFields(LLLVAR, BCD, subField60)
+	return m
+}
+
+// Pool keeps Size connections to one host open, reconnecting each with
+// exponential back-off when it fails, and spreads requests over the healthy
+// links, least busy first. When EchoInterval and Echo are set, a link idle
+// for EchoInterval is probed with the message Echo builds and closed if the
+// probe fails. Set the fields before Start.
+type Pool struct {
+	Dial         func() (*Client, error)
+	Size         int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	EchoInterval time.Duration
+	EchoTimeout  time.Duration
+	Echo         func() *Message
+
+	links  []*poolLink
+	next   uint32
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+type poolLink struct {
+	mu       sync.Mutex
+	client   *Client
+	failures int
+	lastUsed time.Time
+	inFlight int32
+}
+
+func NewPool(dial func() (*Client, error), size int) *Pool {
+	return &Pool{
+		Dial:       dial,
+		Size:       size,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		closed:     make(chan struct{}),
+	}
+}
+
+// Start opens the links in the background.
+func (p *Pool) Start() {
+	if p.Size < 1 {
+		p.Size = 1
+	}
+	p.links = make([]*poolLink, p.Size)
+	for i := range p.links {
+		p.links[i] = &poolLink{}
+		p.wg.Add(1)
+		go p.maintain(p.links[i])
+	}
+}
+
+// Send sends m on the least busy healthy link.
+func (p *Pool) Send(ctx context.Context, m *Message) (*Message, error) {
+	select {
+	case <-p.closed:
+		return nil, &NotSentError{errors.New(ERR_POOL_CLOSED)}
+	default:
+	}
+	link, client := p.pick()
+	if client == nil {
+		return nil, &NotSentError{errors.New(ERR_POOL_NO_LINK)}
+	}
+	atomic.AddInt32(&link.inFlight, 1)
+	defer atomic.AddInt32(&link.inFlight, -1)
+	link.touch()
+	return client.Send(ctx, m)
+}
+
+// Healthy returns the number of connected links.
+func (p *Pool) Healthy() int {
+	n := 0
+	for _, link := range p.links {
+		if link.get() != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes every link and stops reconnecting.
+func (p *Pool) Close() {
+	p.once.Do(func() {
+		close(p.closed)
+		for _, link := range p.links {
+			if client := link.get(); client != nil {
+				client.Close()
+			}
+		}
+	})
+	p.wg.Wait()
+}
+
+// pick chooses the healthy link with the fewest requests in flight, starting
+// from a rotating offset so that ties are spread round robin.
+func (p *Pool) pick() (*poolLink, *Client) {
+	n := len(p.links)
+	if n == 0 {
+		return nil, nil
+	}
+	start := int(atomic.AddUint32(&p.next, 1)) % n
+	var best *poolLink
+	var bestClient *Client
+	for i := 0; i < n; i++ {
+		link := p.links[(start+i)%n]
+		client := link.get()
+		if client == nil {
+			continue
+		}
+		if best == nil || atomic.LoadInt32(&link.inFlight) < atomic.LoadInt32(&best.inFlight) {
+			best, bestClient = link, client
+		}
+	}
+	return best, bestClient
+}
+
+func (p *Pool) maintain(link *poolLink) {
+	defer p.wg.Done()
+	for {
+		client, err := p.Dial()
+		if err != nil {
+			link.mu.Lock()
+			link.failures++
+			wait := p.backoff(link.failures)
+			link.mu.Unlock()
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		link.mu.Lock()
+		link.client = client
+		link.failures = 0
+		link.lastUsed = time.Now()
+		link.mu.Unlock()
+
+		p.watch(link, client)
+
+		link.mu.Lock()
+		link.client = nil
+		link.mu.Unlock()
+		client.Close()
+
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+	}
+}
+
+// watch returns when client fails, fails an echo test or the pool closes.
+func (p *Pool) watch(link *poolLink, client *Client) {
+	var tick <-chan time.Time
+	if p.EchoInterval > 0 && p.Echo != nil {
+		ticker := time.NewTicker(p.EchoInterval / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-client.Done():
+			return
+		case <-tick:
+			if link.idle() < p.EchoInterval {
+				continue
+			}
+			if err := p.echo(client); err != nil {
+				return
+			}
+			link.touch()
+		}
+	}
+}
+
+func (p *Pool) echo(client *Client) error {
+	timeout := p.EchoTimeout
+	if timeout <= 0 {
+		timeout = p.EchoInterval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := client.Send(ctx, p.Echo())
+	if err != nil {
+		return err
+	}
+	if code := resp.FieldString(39); code != "" && code != "00" {
+		return fmt.Errorf(ERR_ECHO_FAILED, code)
+	}
+	return nil
+}
+
+func (p *Pool) backoff(failures int) time.Duration {
+	wait := p.MinBackoff
+	if wait <= 0 {
+		wait = DefaultMinBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	for i := 1; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (l *poolLink) get() *Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.client
+}
+
+func (l *poolLink) touch() {
+	l.mu.Lock()
+	l.lastUsed = time.Now()
+	l.mu.Unlock()
+}
+
+func (l *poolLink) idle() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Since(l.lastUsed)
+}
@@ -0,0 +1,122 @@
+package j8583
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHost answers every request with the matching response MTI and field 39
+// "00", counting echo tests.
+type testHost struct {
+	listener net.Listener
+	conns    chan net.Conn
+	echoes   int32
+}
+
+func newTestHost(t *testing.T) *testHost {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	h := &testHost{listener: l, conns: make(chan net.Conn, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			h.conns <- conn
+			go h.serve(conn)
+		}
+	}()
+	return h
+}
+
+func (h *testHost) serve(conn net.Conn) {
+	defer conn.Close()
+	framer := NewFramer(LengthBinary2)
+	for {
+		raw, err := framer.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		req, err := Decode(raw)
+		if err != nil {
+			return
+		}
+		if _, _, code := req.Field60(); code == EchoTest {
+			atomic.AddInt32(&h.echoes, 1)
+		}
+		resp := newTestRequest(req.Mti[:2]+"1"+req.Mti[3:], req.FieldString(11))
+		resp.Fields[39] = NewFieldFix(ASCII, 2, "00")
+		data, _ := resp.Bytes("")
+		if framer.WriteFrame(conn, data) != nil {
+			return
+		}
+	}
+}
+
+func (h *testHost) dial() (*Client, error) {
+	return Dial(h.listener.Addr().String(), time.Second)
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPoolReconnects(t *testing.T) {
+	host := newTestHost(t)
+	defer host.listener.Close()
+
+	pool := NewPool(host.dial, 2)
+	pool.MinBackoff = 10 * time.Millisecond
+	pool.Start()
+	defer pool.Close()
+	assert.True(t, waitFor(func() bool { return pool.Healthy() == 2 }))
+
+	resp, err := pool.Send(context.Background(), newTestRequest("0200", "000001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0210", resp.Mti)
+
+	// drop one link on the host side; the pool must notice and redial
+	(<-host.conns).Close()
+	assert.True(t, waitFor(func() bool { return len(host.conns) == 2 && pool.Healthy() == 2 }))
+
+	resp, err = pool.Send(context.Background(), newTestRequest("0200", "000002"))
+	assert.NoError(t, err)
+	assert.Equal(t, "000002", resp.FieldString(11))
+}
+
+func TestPoolEcho(t *testing.T) {
+	host := newTestHost(t)
+	defer host.listener.Close()
+
+	pool := NewPool(host.dial, 1)
+	pool.EchoInterval = 20 * time.Millisecond
+	pool.Echo = func() *Message {
+		return NewEchoRequest("6000030000", "613100313031", "000009", "000001", "00003042", "666100041213175")
+	}
+	pool.Start()
+	defer pool.Close()
+
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt32(&host.echoes) >= 2 }))
+	assert.Equal(t, 1, pool.Healthy())
+}
+
+func TestPoolBackoff(t *testing.T) {
+	pool := NewPool(nil, 1)
+	pool.MinBackoff = time.Second
+	pool.MaxBackoff = 5 * time.Second
+	assert.Equal(t, time.Second, pool.backoff(1))
+	assert.Equal(t, 4*time.Second, pool.backoff(3))
+	assert.Equal(t, 5*time.Second, pool.backoff(10))
+}
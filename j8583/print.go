@@ -5,6 +5,8 @@ import (
 	"strconv"
 )
 
+// PrintMessage dumps m to stdout with sensitive fields masked as in the
+// journal.
 func PrintMessage(m *Message) {
 	fmt.Println("[j8583]----------begin---------")
 	printField("H000D", m.Tpdu)
@@ -17,7 +19,7 @@ func PrintMessage(m *Message) {
 			printField(fmt.Sprintf("F%03dL", i), strconv.Itoa(field.Length))
 		}
 		if value,ok:=field.Value.(string);ok{
-			printField(fmt.Sprintf("F%03dD", i), value)
+			printField(fmt.Sprintf("F%03dD", i), MaskField(i, value))
 		}
 	}
 	fmt.Println("[j8583]----------end---------")
@@ -0,0 +1,324 @@
+package j8583
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reversal reasons (field 39 of the 0400).
+const (
+	ReversalTimeout  = "98"
+	ReversalMACError = "A0"
+)
+
+const (
+	ERR_REVERSAL_PENDING  string = "reversal pending for terminal %s: %s"
+	ERR_REVERSAL_REJECTED string = "reversal rejected; response code=%s"
+	ERR_RESPONSE_MAC      string = "response MAC verification failed"
+)
+
+// NewReversal builds the 0400 reversing orig. It keeps the original STAN and
+// card, amount and terminal data, sets field 39 to reason and carries the
+// original batch number, STAN and date in field 61. CUP POS terminals send
+// the original data in field 61 only; field 90 is not used.
+func NewReversal(orig *Message, reason string) *Message {
+	m := &Message{Tpdu: orig.Tpdu, Header: orig.Header, Mti: "0400", Algorithm: orig.Algorithm}
+	m.Fields = make([]Field, 65)
+	for _, i := range []int{2, 3, 4, 11, 14, 22, 23, 25, 38, 41, 42, 49, 60} {
+		if i < len(orig.Fields) && orig.Fields[i].Value != nil {
+			m.Fields[i] = orig.Fields[i]
+		}
+	}
+	m.Fields[39] = NewFieldFix(ASCII, 2, reason)
+
+	_, batchNum, _ := orig.Field60()
+	date := orig.FieldString(13)
+	if batchNum == "" {
+		batchNum = "000000"
+	}
+	if date == "" {
+		date = "0000"
+	}
+	m.Fields[61] = NewFieldVar(LLLVAR, BCD, batchNum+orig.FieldString(11)+date)
+	return m
+}
+
+// ReversalAcknowledged reports whether resp settles a reversal. The host
+// answers 0410 whether or not it found the original; only a system error
+// leaves the reversal outstanding.
+func ReversalAcknowledged(resp *Message) bool {
+	code := resp.FieldString(39)
+	return resp.Mti == "0410" && code != "" && code != RespSystemError
+}
+
+// reversible reports whether a request must be reversed when its outcome is
+// unknown: authorisations and financial transactions.
+func reversible(m *Message) bool {
+	return m.Mti == "0100" || m.Mti == "0200"
+}
+
+// PendingReversal is a reversal waiting for its 0410.
+type PendingReversal struct {
+	TerminalID string    `json:"terminal_id"`
+	STAN       string    `json:"stan"`
+	Reason     string    `json:"reason"`
+	Raw        []byte    `json:"raw"`
+	Attempts   int       `json:"attempts"`
+	Created    time.Time `json:"created"`
+}
+
+// Message decodes the stored reversal.
+func (p *PendingReversal) Message() (*Message, error) {
+	return Decode(p.Raw)
+}
+
+// ReversalQueue holds at most one pending reversal per terminal, as a
+// terminal may not start another transaction while one is outstanding. With
+// a path it survives restarts: every change is written to the file, sealed
+// with AES-GCM as the reversals carry the card number and expiry date.
+type ReversalQueue struct {
+	file    *sealedFile
+	mu      sync.Mutex
+	pending map[string]*PendingReversal
+}
+
+// OpenReversalQueue loads the queue kept at path, creating it if missing,
+// with key (16, 24 or 32 bytes) sealing the file. An empty path gives a
+// queue held in memory only and key is not used.
+func OpenReversalQueue(path string, key []byte) (*ReversalQueue, error) {
+	q := &ReversalQueue{pending: make(map[string]*PendingReversal)}
+	if path == "" {
+		return q, nil
+	}
+	file, err := newSealedFile(path, "reversals", key)
+	if err != nil {
+		return nil, err
+	}
+	q.file = file
+	data, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q.pending); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Add queues the reversal m, replacing any older one for the same terminal.
+func (q *ReversalQueue) Add(m *Message, reason string) error {
+	raw, err := m.Bytes("")
+	if err != nil {
+		return err
+	}
+	terminalID := m.FieldString(41)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[terminalID] = &PendingReversal{
+		TerminalID: terminalID,
+		STAN:       m.FieldString(11),
+		Reason:     reason,
+		Raw:        raw,
+		Created:    time.Now(),
+	}
+	return q.save()
+}
+
+// Pending returns a copy of the reversal queued for terminalID.
+func (q *ReversalQueue) Pending(terminalID string) (*PendingReversal, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, ok := q.pending[terminalID]
+	if !ok {
+		return nil, false
+	}
+	copied := *p
+	return &copied, true
+}
+
+// Remove drops the reversal queued for terminalID.
+func (q *ReversalQueue) Remove(terminalID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[terminalID]; !ok {
+		return nil
+	}
+	delete(q.pending, terminalID)
+	return q.save()
+}
+
+// Terminals returns the terminals with a pending reversal.
+func (q *ReversalQueue) Terminals() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make([]string, 0, len(q.pending))
+	for id := range q.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Len returns the number of pending reversals.
+func (q *ReversalQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *ReversalQueue) attempted(terminalID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p, ok := q.pending[terminalID]; ok {
+		p.Attempts++
+		return q.save()
+	}
+	return nil
+}
+
+// save writes the queue; the caller holds q.mu.
+func (q *ReversalQueue) save() error {
+	if q.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(q.pending)
+	if err != nil {
+		return err
+	}
+	return q.file.write(data)
+}
+
+// ReversalSender sends requests through Sender and reverses authorisations
+// and financial transactions whose outcome is unknown: any failure after the
+// request may have reached the host (a timeout, a lost connection, a
+// cancelled ctx) queues a 0400 with reason 98 and a response failing
+// VerifyMAC one with reason A0.
+// Before the next such request from the same terminal the pending reversal
+// is sent until a 0410 arrives; the request fails while it is outstanding.
+type ReversalSender struct {
+	Sender Sender
+	Queue  *ReversalQueue
+	// Timeout bounds each request and reversal attempt; 0 leaves it to ctx.
+	Timeout time.Duration
+	// Prepare, if set, finishes a reversal before each attempt, e.g. by
+	// setting its MAC.
+	Prepare func(m *Message) error
+	// VerifyMAC, if set, checks the MAC of approved responses.
+	VerifyMAC func(resp *Message) (bool, error)
+
+	locks sync.Map
+}
+
+func NewReversalSender(sender Sender, queue *ReversalQueue) *ReversalSender {
+	return &ReversalSender{Sender: sender, Queue: queue}
+}
+
+func (r *ReversalSender) Send(ctx context.Context, m *Message) (*Message, error) {
+	if !reversible(m) {
+		return r.send(ctx, m)
+	}
+
+	terminalID := m.FieldString(41)
+	lock := r.lock(terminalID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := r.clear(ctx, terminalID); err != nil {
+		return nil, err
+	}
+
+	resp, err := r.send(ctx, m)
+	if err != nil {
+		if !NotSent(err) {
+			if qerr := r.Queue.Add(NewReversal(m, ReversalTimeout), ReversalTimeout); qerr != nil {
+				return nil, qerr
+			}
+		}
+		return nil, err
+	}
+
+	if r.VerifyMAC != nil && resp.FieldString(39) == RespApproved {
+		ok, verr := r.VerifyMAC(resp)
+		if verr != nil || !ok {
+			if qerr := r.Queue.Add(NewReversal(m, ReversalMACError), ReversalMACError); qerr != nil {
+				return nil, qerr
+			}
+			return resp, errors.New(ERR_RESPONSE_MAC)
+		}
+	}
+	return resp, nil
+}
+
+// Clear sends the reversal pending for terminalID, if any, and removes it
+// from the queue once the host answers with a 0410.
+func (r *ReversalSender) Clear(ctx context.Context, terminalID string) error {
+	lock := r.lock(terminalID)
+	lock.Lock()
+	defer lock.Unlock()
+	return r.clear(ctx, terminalID)
+}
+
+// Run retries every pending reversal each interval until ctx ends, so that
+// reversals clear even when a terminal sends nothing further.
+func (r *ReversalSender) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, terminalID := range r.Queue.Terminals() {
+				r.Clear(ctx, terminalID)
+			}
+		}
+	}
+}
+
+// clear is Clear with the terminal lock held.
+func (r *ReversalSender) clear(ctx context.Context, terminalID string) error {
+	pending, ok := r.Queue.Pending(terminalID)
+	if !ok {
+		return nil
+	}
+	reversal, err := pending.Message()
+	if err != nil {
+		return err
+	}
+	if r.Prepare != nil {
+		if err := r.Prepare(reversal); err != nil {
+			return err
+		}
+	}
+	if err := r.Queue.attempted(terminalID); err != nil {
+		return err
+	}
+
+	resp, err := r.send(ctx, reversal)
+	if err != nil {
+		return fmt.Errorf(ERR_REVERSAL_PENDING, terminalID, err)
+	}
+	if !ReversalAcknowledged(resp) {
+		return fmt.Errorf(ERR_REVERSAL_PENDING, terminalID, fmt.Errorf(ERR_REVERSAL_REJECTED, resp.FieldString(39)))
+	}
+	return r.Queue.Remove(terminalID)
+}
+
+func (r *ReversalSender) send(ctx context.Context, m *Message) (*Message, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	return r.Sender.Send(ctx, m)
+}
+
+func (r *ReversalSender) lock(terminalID string) *sync.Mutex {
+	lock, _ := r.locks.LoadOrStore(terminalID, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
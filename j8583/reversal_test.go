@@ -0,0 +1,136 @@
+package j8583
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testQueueKey seals the queue files of the tests.
+var testQueueKey = []byte("0123456789abcdef")
+
+// scriptedSender answers each request with the next scripted reply.
+type scriptedSender struct {
+	mu      sync.Mutex
+	sent    []*Message
+	replies []func(m *Message) (*Message, error)
+}
+
+func (s *scriptedSender) Send(ctx context.Context, m *Message) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, m)
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	return reply(m)
+}
+
+func approve(m *Message) (*Message, error) {
+	return NewResponse(m, RespApproved), nil
+}
+
+func timeout(m *Message) (*Message, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestNewReversal(t *testing.T) {
+	orig := newTestRequest("0200", "000123")
+	orig.Fields[4] = NewFieldFix(BCD, 12, "000000000100")
+	orig.Fields[60] = NewFields(LLLVAR, BCD, []SubField{NewSubFieldFix(BCD, 2, "22"), NewSubFieldFix(BCD, 6, "000007")})
+
+	r := NewReversal(orig, ReversalTimeout)
+	assert.Equal(t, "0400", r.Mti)
+	assert.Equal(t, "98", r.FieldString(39))
+	assert.Equal(t, "000123", r.FieldString(11))
+	assert.Equal(t, "000000000100", r.FieldString(4))
+	assert.Equal(t, "0000070001230000", r.FieldString(61))
+}
+
+func TestReversalOnTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reversal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reversals.json")
+
+	queue, err := OpenReversalQueue(path, testQueueKey)
+	assert.NoError(t, err)
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){timeout, timeout, approve, approve}}
+	r := NewReversalSender(sender, queue)
+
+	sale := newTestRequest("0200", "000001")
+	sale.Fields[2] = NewFieldVar(LLVAR, BCD, "6225887912345678")
+	_, err = r.Send(context.Background(), sale)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, queue.Len())
+
+	// the card number is not written in clear, and the file only opens
+	// with its key
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("00003042")))
+	assert.False(t, bytes.Contains(data, []byte{0x62, 0x25, 0x88, 0x79}))
+	_, err = OpenReversalQueue(path, make([]byte, 16))
+	assert.Error(t, err)
+
+	// the queue survives a restart
+	queue, err = OpenReversalQueue(path, testQueueKey)
+	assert.NoError(t, err)
+	pending, ok := queue.Pending("00003042")
+	assert.True(t, ok)
+	assert.Equal(t, "000001", pending.STAN)
+	r.Queue = queue
+
+	// the reversal times out too, so the next sale is blocked
+	_, err = r.Send(context.Background(), newTestRequest("0200", "000002"))
+	assert.Error(t, err)
+	assert.Equal(t, "0400", sender.sent[1].Mti)
+	assert.Equal(t, 2, len(sender.sent))
+
+	// the reversal is acknowledged and the sale goes through
+	resp, err := r.Send(context.Background(), newTestRequest("0200", "000003"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0210", resp.Mti)
+	assert.Equal(t, "0400", sender.sent[2].Mti)
+	assert.Equal(t, "000001", sender.sent[2].FieldString(11))
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestReversalOnMACFailure(t *testing.T) {
+	queue, _ := OpenReversalQueue("", nil)
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){approve}}
+	r := NewReversalSender(sender, queue)
+	r.VerifyMAC = func(resp *Message) (bool, error) { return false, nil }
+
+	_, err := r.Send(context.Background(), newTestRequest("0200", "000001"))
+	assert.Error(t, err)
+	pending, ok := queue.Pending("00003042")
+	assert.True(t, ok)
+	assert.Equal(t, ReversalMACError, pending.Reason)
+}
+
+func TestReversalOnLostConnection(t *testing.T) {
+	queue, _ := OpenReversalQueue("", nil)
+	notSent := func(m *Message) (*Message, error) { return nil, &NotSentError{errors.New(ERR_POOL_NO_LINK)} }
+	lost := func(m *Message) (*Message, error) { return nil, io.EOF }
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){notSent, lost}}
+	r := NewReversalSender(sender, queue)
+
+	// a request that never went out needs no reversal
+	_, err := r.Send(context.Background(), newTestRequest("0200", "000001"))
+	assert.True(t, NotSent(err))
+	assert.Equal(t, 0, queue.Len())
+
+	// one whose connection dropped after writing does
+	_, err = r.Send(context.Background(), newTestRequest("0200", "000002"))
+	assert.Equal(t, io.EOF, err)
+	pending, ok := queue.Pending("00003042")
+	assert.True(t, ok)
+	assert.Equal(t, "000002", pending.STAN)
+}
@@ -0,0 +1,335 @@
+package j8583
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Control characters of the serial link protocol.
+const (
+	STX byte = 0x02
+	ETX byte = 0x03
+	ACK byte = 0x06
+	NAK byte = 0x15
+)
+
+const (
+	DefaultSerialRetries = 3
+	DefaultSerialTimeout = 3 * time.Second
+)
+
+const (
+	ERR_SERIAL_LRC    string = "serial frame LRC mismatch; expected=%02X, actual=%02X"
+	ERR_SERIAL_ETX    string = "serial frame missing ETX; got %02X"
+	ERR_SERIAL_LENGTH string = "invalid serial frame length: %X"
+	ERR_SERIAL_NO_ACK string = "no ACK after %d attempts"
+	ERR_SERIAL_FAILED string = "no valid frame after %d attempts: %s"
+)
+
+// SerialLink frames messages for serial and dial-up terminals:
+//
+//	STX | length (2 byte BCD) | payload | ETX | LRC
+//
+// where LRC is the XOR of every byte after STX up to and including ETX. Each
+// frame is answered with ACK, or NAK to have it sent again.
+//
+// Timeout bounds the wait for an ACK and for the rest of a frame once STX has
+// arrived. A ReadWriter with deadlines, such as net.Conn, enforces it
+// itself; any other is read from a goroutine whose reads are abandoned once
+// Timeout passes. That goroutine lives as long as reads of the ReadWriter
+// keep returning.
+type SerialLink struct {
+	Retries  int
+	Timeout  time.Duration
+	MaxFrame int
+
+	rw     io.ReadWriter
+	src    io.Reader
+	pump   *pumpReader
+	reader *bufio.Reader
+}
+
+func NewSerialLink(rw io.ReadWriter) *SerialLink {
+	l := &SerialLink{
+		Retries:  DefaultSerialRetries,
+		Timeout:  DefaultSerialTimeout,
+		MaxFrame: DefaultMaxFrame,
+		rw:       rw,
+		src:      rw,
+	}
+	if _, ok := rw.(deadliner); !ok {
+		l.pump = &pumpReader{r: rw, results: make(chan pumpResult)}
+		l.src = l.pump
+	}
+	l.reader = bufio.NewReader(l.src)
+	return l
+}
+
+// LRC returns the XOR of data.
+func LRC(data []byte) byte {
+	var lrc byte
+	for _, b := range data {
+		lrc ^= b
+	}
+	return lrc
+}
+
+// EncodeSerialFrame wraps payload in STX, length, ETX and LRC.
+func EncodeSerialFrame(payload []byte) ([]byte, error) {
+	if len(payload) > 9999 {
+		return nil, fmt.Errorf(ERR_FRAME_TOO_LONG, len(payload), 9999)
+	}
+	frame := make([]byte, 0, len(payload)+5)
+	frame = append(frame, STX)
+	frame = append(frame, bcd([]byte(fmt.Sprintf("%04d", len(payload))))...)
+	frame = append(frame, payload...)
+	frame = append(frame, ETX)
+	return append(frame, LRC(frame[1:])), nil
+}
+
+// Send writes payload as a frame and waits for it to be acknowledged,
+// sending it again on NAK or timeout.
+func (l *SerialLink) Send(payload []byte) error {
+	frame, err := EncodeSerialFrame(payload)
+	if err != nil {
+		return err
+	}
+	attempts := l.attempts()
+	for i := 0; i < attempts; i++ {
+		l.setDeadline()
+		if _, err := l.rw.Write(frame); err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return err
+		}
+		acked, err := l.waitAck()
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return err
+		}
+		if acked {
+			l.clearDeadline()
+			return nil
+		}
+	}
+	l.clearDeadline()
+	return fmt.Errorf(ERR_SERIAL_NO_ACK, attempts)
+}
+
+// Receive reads the next valid frame, answering it with ACK. Corrupt frames
+// are answered with NAK until Retries is exhausted.
+func (l *SerialLink) Receive() ([]byte, error) {
+	attempts := l.attempts()
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		payload, err := l.readFrame()
+		l.clearDeadline()
+		if err == nil {
+			_, err = l.rw.Write([]byte{ACK})
+			return payload, err
+		}
+		if !isFrameError(err) && !isTimeout(err) {
+			return nil, err
+		}
+		lastErr = err
+		l.reader.Reset(l.src)
+		if _, err := l.rw.Write([]byte{NAK}); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf(ERR_SERIAL_FAILED, attempts, lastErr)
+}
+
+// SendMessage sends m unencrypted.
+func (l *SerialLink) SendMessage(m *Message) error {
+	data, err := m.Bytes("")
+	if err != nil {
+		return err
+	}
+	return l.Send(data)
+}
+
+// ReceiveMessage receives the next frame and decodes it.
+func (l *SerialLink) ReceiveMessage() (*Message, error) {
+	data, err := l.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+func (l *SerialLink) waitAck() (bool, error) {
+	for {
+		b, err := l.reader.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case ACK:
+			return true, nil
+		case NAK:
+			return false, nil
+		}
+	}
+}
+
+// readFrame skips line noise up to STX, then reads the rest of the frame.
+func (l *SerialLink) readFrame() ([]byte, error) {
+	for {
+		b, err := l.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == STX {
+			break
+		}
+	}
+	l.setDeadline()
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(l.reader, head); err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(bcd2Ascii(head)))
+	if err != nil || length > l.maxFrame() {
+		return nil, frameError{fmt.Errorf(ERR_SERIAL_LENGTH, head)}
+	}
+
+	rest := make([]byte, length+2)
+	if _, err := io.ReadFull(l.reader, rest); err != nil {
+		return nil, err
+	}
+	if rest[length] != ETX {
+		return nil, frameError{fmt.Errorf(ERR_SERIAL_ETX, rest[length])}
+	}
+	lrc := LRC(head) ^ LRC(rest[:length+1])
+	if lrc != rest[length+1] {
+		return nil, frameError{fmt.Errorf(ERR_SERIAL_LRC, lrc, rest[length+1])}
+	}
+	return rest[:length], nil
+}
+
+func (l *SerialLink) attempts() int {
+	if l.Retries < 0 {
+		return 1
+	}
+	return l.Retries + 1
+}
+
+func (l *SerialLink) maxFrame() int {
+	if l.MaxFrame <= 0 {
+		return DefaultMaxFrame
+	}
+	return l.MaxFrame
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+func (l *SerialLink) setDeadline() {
+	if l.Timeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(l.Timeout)
+	if l.pump != nil {
+		l.pump.deadline = deadline
+	} else if d, ok := l.rw.(deadliner); ok {
+		d.SetDeadline(deadline)
+	}
+}
+
+func (l *SerialLink) clearDeadline() {
+	if l.pump != nil {
+		l.pump.deadline = time.Time{}
+	} else if d, ok := l.rw.(deadliner); ok {
+		d.SetDeadline(time.Time{})
+	}
+}
+
+// pumpReader gives reads of a reader without deadlines a deadline: a
+// goroutine does the reading and Read stops waiting for it once the
+// deadline passes. Nothing read is lost; it is returned by a later Read.
+type pumpReader struct {
+	r        io.Reader
+	results  chan pumpResult
+	deadline time.Time
+	buf      []byte
+	err      error
+	start    sync.Once
+}
+
+type pumpResult struct {
+	data []byte
+	err  error
+}
+
+func (p *pumpReader) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.start.Do(func() { go p.run() })
+
+		var expired <-chan time.Time
+		if !p.deadline.IsZero() {
+			timer := time.NewTimer(time.Until(p.deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case r := <-p.results:
+			p.buf, p.err = r.data, r.err
+			if len(p.buf) == 0 {
+				return 0, p.err
+			}
+		case <-expired:
+			return 0, pumpTimeout{}
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *pumpReader) run() {
+	for {
+		buf := make([]byte, 512)
+		n, err := p.r.Read(buf)
+		p.results <- pumpResult{buf[:n], err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pumpTimeout is the net.Error of a pumpReader read that ran out of time.
+type pumpTimeout struct{}
+
+func (pumpTimeout) Error() string   { return "serial read timeout" }
+func (pumpTimeout) Timeout() bool   { return true }
+func (pumpTimeout) Temporary() bool { return true }
+
+// frameError marks a corrupt frame that is answered with NAK.
+type frameError struct {
+	error
+}
+
+func isFrameError(err error) bool {
+	_, ok := err.(frameError)
+	return ok
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
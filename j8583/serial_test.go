@@ -0,0 +1,127 @@
+package j8583
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialFrame(t *testing.T) {
+	frame, err := EncodeSerialFrame([]byte{0x60, 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{STX, 0x00, 0x02, 0x60, 0x00, ETX, 0x00 ^ 0x02 ^ 0x60 ^ 0x00 ^ ETX}, frame)
+}
+
+func TestSerialMessage(t *testing.T) {
+	terminal, host := net.Pipe()
+	defer terminal.Close()
+	defer host.Close()
+
+	m := &Message{Tpdu: "6000030000", Header: "613100313031", Mti: "0800"}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, "000025")
+	m.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewSerialLink(terminal).SendMessage(m)
+	}()
+
+	received, err := NewSerialLink(host).ReceiveMessage()
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+	assert.Equal(t, "0800", received.Mti)
+	assert.Equal(t, "000025", received.getFieldValue(11))
+}
+
+func TestSerialRetransmitOnNAK(t *testing.T) {
+	terminal, host := net.Pipe()
+	defer terminal.Close()
+	defer host.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewSerialLink(terminal).Send([]byte("payload"))
+	}()
+
+	frame := make([]byte, 5+len("payload"))
+	_, err := io.ReadFull(host, frame)
+	assert.NoError(t, err)
+	host.Write([]byte{NAK})
+
+	_, err = io.ReadFull(host, frame)
+	assert.NoError(t, err)
+	host.Write([]byte{ACK})
+	assert.NoError(t, <-done)
+}
+
+func TestSerialNAKCorruptFrame(t *testing.T) {
+	terminal, host := net.Pipe()
+	defer terminal.Close()
+	defer host.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := NewSerialLink(host).Receive()
+		received <- data
+	}()
+
+	frame, _ := EncodeSerialFrame([]byte("payload"))
+	bad := append([]byte{}, frame...)
+	bad[len(bad)-1] ^= 0xFF
+
+	reply := make([]byte, 1)
+	terminal.Write(bad)
+	io.ReadFull(terminal, reply)
+	assert.Equal(t, NAK, reply[0])
+
+	terminal.Write(frame)
+	io.ReadFull(terminal, reply)
+	assert.Equal(t, ACK, reply[0])
+	assert.Equal(t, []byte("payload"), <-received)
+}
+
+func TestSerialNoAck(t *testing.T) {
+	terminal, host := net.Pipe()
+	defer terminal.Close()
+	defer host.Close()
+	go io.Copy(ioutil.Discard, host)
+
+	link := NewSerialLink(terminal)
+	link.Retries = 2
+	link.Timeout = 20 * time.Millisecond
+	assert.Error(t, link.Send([]byte("payload")))
+}
+
+// plainPipe is one end of a link without deadline support.
+type plainPipe struct {
+	io.Reader
+	io.Writer
+}
+
+func TestSerialTimeoutWithoutDeadlines(t *testing.T) {
+	hostReader, terminalWriter := io.Pipe()
+	terminalReader, hostWriter := io.Pipe()
+	defer hostWriter.Close()
+	go io.Copy(ioutil.Discard, hostReader)
+
+	link := NewSerialLink(plainPipe{terminalReader, terminalWriter})
+	link.Retries = 1
+	link.Timeout = 20 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- link.Send([]byte("payload")) }()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked without an ACK")
+	}
+
+	// a late ACK is still read by the next Send
+	go hostWriter.Write([]byte{ACK})
+	assert.NoError(t, link.Send([]byte("payload")))
+}
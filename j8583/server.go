@@ -0,0 +1,403 @@
+package j8583
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"8583/security"
+)
+
+// Response codes (field 39) the server and its middleware answer with.
+const (
+	RespApproved    = "00"
+	RespSystemError = "96"
+	RespMACError    = "A0"
+	RespSecurity    = "63"
+)
+
+// DefaultHandshakeTimeout bounds the TLS handshake of an accepted connection.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+const (
+	ERR_NO_ROUTE      string = "no handler for mti=%s processing code=%s type code=%s"
+	ERR_SERVER_CLOSED string = "server closed"
+	ERR_HANDLER_PANIC string = "handler panic: %v"
+	ERR_PEER_MISMATCH string = "peer certificate %q does not match terminal %s"
+	ERR_MAC_MISSING   string = "mti=%s from terminal %s carries no MAC"
+)
+
+// Request is a decoded message received by a Server.
+type Request struct {
+	Message    *Message
+	RemoteAddr net.Addr
+	Conn       net.Conn
+	// TLS is the connection state of a TLS link, nil otherwise.
+	TLS *tls.ConnectionState
+}
+
+// PeerCommonName returns the subject common name of the verified client
+// certificate, or "" when the peer did not present one.
+func (r *Request) PeerCommonName() string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Handler answers a request. A nil response with a nil error sends nothing.
+type Handler func(ctx context.Context, req *Request) (*Message, error)
+
+// Middleware wraps a Handler.
+type Middleware func(next Handler) Handler
+
+// Router dispatches by MTI, and optionally by processing code (field 3) or
+// message type code (field 60.1). The most specific route wins: processing
+// code, then type code, then MTI alone.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]Handler)}
+}
+
+// Handle routes every mti message without a more specific route to h.
+func (r *Router) Handle(mti string, h Handler) {
+	r.add(mti+"|", h)
+}
+
+// HandleProcessingCode routes mti messages with field 3 equal to code.
+func (r *Router) HandleProcessingCode(mti, code string, h Handler) {
+	r.add(mti+"|3:"+code, h)
+}
+
+// HandleTypeCode routes mti messages with field 60.1 equal to code.
+func (r *Router) HandleTypeCode(mti, code string, h Handler) {
+	r.add(mti+"|60:"+code, h)
+}
+
+func (r *Router) add(key string, h Handler) {
+	r.mu.Lock()
+	r.routes[key] = h
+	r.mu.Unlock()
+}
+
+// Serve is the Handler that dispatches to the registered routes.
+func (r *Router) Serve(ctx context.Context, req *Request) (*Message, error) {
+	m := req.Message
+	code := m.FieldString(3)
+	typeCode, _, _ := m.Field60()
+
+	r.mu.RLock()
+	var h Handler
+	var ok bool
+	if code != "" {
+		h, ok = r.routes[m.Mti+"|3:"+code]
+	}
+	if !ok && typeCode != "" {
+		h, ok = r.routes[m.Mti+"|60:"+typeCode]
+	}
+	if !ok {
+		h, ok = r.routes[m.Mti+"|"]
+	}
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf(ERR_NO_ROUTE, m.Mti, code, typeCode)
+	}
+	return h(ctx, req)
+}
+
+// NewResponse starts the response to req: the MTI with its function digit
+// set, the TPDU addresses swapped, fields 11, 41 and 42 copied and field 39
+// set to code.
+func NewResponse(req *Message, code string) *Message {
+	mti := req.Mti
+	if len(mti) == 4 {
+		mti = mti[:2] + string(mti[2]+1) + mti[3:]
+	}
+	tpdu := req.Tpdu
+	if len(tpdu) == 10 {
+		tpdu = tpdu[:2] + tpdu[6:] + tpdu[2:6]
+	}
+	m := &Message{Tpdu: tpdu, Header: req.Header, Mti: mti, Algorithm: req.Algorithm}
+	m.Fields = make([]Field, 65)
+	for _, i := range []int{3, 4, 11, 41, 42} {
+		if i < len(req.Fields) && req.Fields[i].Value != nil {
+			m.Fields[i] = req.Fields[i]
+		}
+	}
+	m.Fields[39] = NewFieldFix(ASCII, 2, code)
+	return m
+}
+
+// Server accepts connections, reads framed messages and answers each with
+// its Handler. Requests on one connection are handled concurrently and
+// responses written as they complete.
+type Server struct {
+	Handler Handler
+	Framer  *Framer
+	Encode  func(m *Message) ([]byte, error)
+	Decode  func(raw []byte) (*Message, error)
+	// ErrorLog receives handler and connection errors; nil discards them.
+	ErrorLog func(err error)
+	// TLSConfig, when set, makes Serve accept TLS connections only. Set
+	// ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS.
+	TLSConfig        *tls.Config
+	HandshakeTimeout time.Duration
+
+	middleware []Middleware
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewServer(h Handler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		Handler: h,
+		Framer:  NewFramer(LengthBinary2),
+		Encode:  func(m *Message) ([]byte, error) { return m.Bytes("") },
+		Decode:  Decode,
+		conns:   make(map[net.Conn]struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Use adds middleware. The first added is the outermost.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New(ERR_SERVER_CLOSED)
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	h := s.Handler
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			// accepted while Close ran; it will not see this connection
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn, h)
+	}
+}
+
+// Close stops accepting, closes open connections and waits for handlers.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) handle(conn net.Conn, h Handler) {
+	var writeMu sync.Mutex
+	var requests sync.WaitGroup
+	defer func() {
+		requests.Wait()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		timeout := s.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = DefaultHandshakeTimeout
+		}
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			s.logError(err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+
+	for {
+		raw, err := s.Framer.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if len(raw) == 0 {
+			// heartbeat
+			continue
+		}
+		m, err := s.Decode(raw)
+		if err != nil {
+			s.logError(err)
+			continue
+		}
+
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			resp, err := h(s.ctx, &Request{Message: m, RemoteAddr: conn.RemoteAddr(), Conn: conn, TLS: state})
+			if err != nil {
+				s.logError(err)
+			}
+			if resp == nil {
+				return
+			}
+			data, err := s.Encode(resp)
+			if err != nil {
+				s.logError(err)
+				return
+			}
+			writeMu.Lock()
+			err = s.Framer.WriteFrame(conn, data)
+			writeMu.Unlock()
+			if err != nil {
+				s.logError(err)
+			}
+		}()
+	}
+}
+
+func (s *Server) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
+
+// Logging logs every request with its response code and duration.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Message, error) {
+			start := time.Now()
+			resp, err := next(ctx, req)
+			m := req.Message
+			code := ""
+			if resp != nil {
+				code = resp.FieldString(39)
+			}
+			logger.Printf("%s mti=%s stan=%s tid=%s resp=%s err=%v elapsed=%s",
+				req.RemoteAddr, m.Mti, m.FieldString(11), m.FieldString(41), code, err, time.Since(start))
+			return resp, err
+		}
+	}
+}
+
+// Recovery turns a handler panic into a system error response.
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (resp *Message, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					resp = NewResponse(req.Message, RespSystemError)
+					err = fmt.Errorf(ERR_HANDLER_PANIC, r)
+				}
+			}()
+			return next(ctx, req)
+		}
+	}
+}
+
+// NetworkManagement reports whether m is a network management message
+// (08xx), such as sign-in or echo test, which CUP terminals send unMACed.
+func NetworkManagement(m *Message) bool {
+	return strings.HasPrefix(m.Mti, "08")
+}
+
+// MACCheck verifies field 64 with the MAK of the terminal in field 41 and
+// answers A0 when it does not match or is missing. Messages for which exempt
+// returns true may omit field 64; pass NetworkManagement to let sign-in and
+// echo through, or nil to require a MAC on everything. Responses to MACed
+// requests are MACed the same way.
+func MACCheck(store security.KeyStore, exempt func(m *Message) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Message, error) {
+			m := req.Message
+			terminalID := m.FieldString(41)
+			if m.FieldString(64) == "" {
+				if exempt != nil && exempt(m) {
+					return next(ctx, req)
+				}
+				return NewResponse(m, RespMACError), fmt.Errorf(ERR_MAC_MISSING, m.Mti, terminalID)
+			}
+			ok, err := m.VerifyMAC(store, terminalID)
+			if err != nil || !ok {
+				return NewResponse(m, RespMACError), err
+			}
+			resp, err := next(ctx, req)
+			if resp != nil && resp.FieldString(39) == RespApproved {
+				if macErr := resp.SetMAC(store, terminalID); macErr != nil {
+					return nil, macErr
+				}
+			}
+			return resp, err
+		}
+	}
+}
+
+// TerminalCertificate rejects requests whose field 41 differs from the
+// common name of the client certificate, tying each terminal ID to the
+// certificate issued for it. Use it with mutual TLS.
+func TerminalCertificate() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Message, error) {
+			terminalID := req.Message.FieldString(41)
+			if cn := req.PeerCommonName(); cn == "" || cn != terminalID {
+				return NewResponse(req.Message, RespSecurity), fmt.Errorf(ERR_PEER_MISMATCH, cn, terminalID)
+			}
+			return next(ctx, req)
+		}
+	}
+}
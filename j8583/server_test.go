@@ -0,0 +1,160 @@
+package j8583
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"8583/security"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	answer := func(code string) Handler {
+		return func(ctx context.Context, req *Request) (*Message, error) {
+			return NewResponse(req.Message, code), nil
+		}
+	}
+	router.Handle("0200", answer("01"))
+	router.HandleProcessingCode("0200", "310000", answer("02"))
+	router.HandleTypeCode("0200", "22", answer("03"))
+
+	route := func(code, typeCode string) string {
+		m := newTestRequest("0200", "000001")
+		if code != "" {
+			m.Fields[3] = NewFieldFix(BCD, 6, code)
+		}
+		if typeCode != "" {
+			m.Fields[60] = NewFields(LLLVAR, BCD, []SubField{NewSubFieldFix(BCD, 2, typeCode), NewSubFieldFix(BCD, 6, "000001")})
+		}
+		resp, err := router.Serve(context.Background(), &Request{Message: m})
+		if err != nil {
+			return err.Error()
+		}
+		return resp.FieldString(39)
+	}
+	assert.Equal(t, "02", route("310000", "22"))
+	assert.Equal(t, "03", route("000000", "22"))
+	assert.Equal(t, "01", route("000000", ""))
+	assert.Equal(t, "02", route("310000", ""))
+
+	_, err := router.Serve(context.Background(), &Request{Message: newTestRequest("0400", "000001")})
+	assert.Error(t, err)
+}
+
+func TestNewResponse(t *testing.T) {
+	resp := NewResponse(newTestRequest("0200", "000007"), RespApproved)
+	assert.Equal(t, "0210", resp.Mti)
+	assert.Equal(t, "6000000003", resp.Tpdu)
+	assert.Equal(t, "000007", resp.FieldString(11))
+	assert.Equal(t, "00003042", resp.FieldString(41))
+}
+
+// lateListener hands out one connection only after it is released, to stand
+// in for a connection accepted while Close runs.
+type lateListener struct {
+	accepting chan struct{}
+	release   chan struct{}
+	conn      net.Conn
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	close(l.accepting)
+	<-l.release
+	return l.conn, nil
+}
+
+func (l *lateListener) Close() error   { return nil }
+func (l *lateListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerCloseDuringAccept(t *testing.T) {
+	conn, peer := net.Pipe()
+	l := &lateListener{accepting: make(chan struct{}), release: make(chan struct{}), conn: conn}
+	s := NewServer(NewRouter().Serve)
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	<-l.accepting
+	s.Close()
+	close(l.release)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	assert.Error(t, err, "late connection was left open")
+}
+
+func startTestServer(t *testing.T, s *Server) (*Client, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(l)
+	client, err := Dial(l.Addr().String(), time.Second)
+	assert.NoError(t, err)
+	return client, func() {
+		client.Close()
+		s.Close()
+	}
+}
+
+func TestServerMiddleware(t *testing.T) {
+	store := security.NewMemoryKeyStore()
+	mak, _ := hex.DecodeString("1CDC70ABD616015E")
+	store.Put("00003042", security.MAK, mak)
+
+	router := NewRouter()
+	router.Handle("0200", func(ctx context.Context, req *Request) (*Message, error) {
+		return NewResponse(req.Message, RespApproved), nil
+	})
+	router.Handle("0400", func(ctx context.Context, req *Request) (*Message, error) {
+		panic("boom")
+	})
+	router.Handle("0800", func(ctx context.Context, req *Request) (*Message, error) {
+		return NewResponse(req.Message, RespApproved), nil
+	})
+	server := NewServer(router.Serve)
+	server.Use(Recovery(), MACCheck(store, NetworkManagement))
+	client, stop := startTestServer(t, server)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := newTestRequest("0200", "000001")
+	assert.NoError(t, req.SetMAC(store, "00003042"))
+	resp, err := client.Send(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, RespApproved, resp.FieldString(39))
+	ok, err := resp.VerifyMAC(store, "00003042")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	req = newTestRequest("0200", "000002")
+	assert.NoError(t, req.SetMAC(store, "00003042"))
+	req.Fields[64] = NewFieldFix(BINARY, 8, "0000000000000000")
+	resp, err = client.Send(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, RespMACError, resp.FieldString(39))
+
+	resp, err = client.Send(ctx, newTestRequest("0200", "000003"))
+	assert.NoError(t, err)
+	assert.Equal(t, RespMACError, resp.FieldString(39))
+
+	req = newTestRequest("0400", "000004")
+	assert.NoError(t, req.SetMAC(store, "00003042"))
+	resp, err = client.Send(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, RespSystemError, resp.FieldString(39))
+
+	resp, err = client.Send(ctx, newTestRequest("0800", "000005"))
+	assert.NoError(t, err)
+	assert.Equal(t, RespApproved, resp.FieldString(39))
+}
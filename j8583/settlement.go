@@ -0,0 +1,235 @@
+package j8583
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Message type codes (field 60.1).
+const (
+	TypePreAuth          = "10"
+	TypePreAuthVoid      = "11"
+	TypeCompletion       = "20"
+	TypeCompletionVoid   = "21"
+	TypeSale             = "22"
+	TypeSaleVoid         = "23"
+	TypeCompletionAdvice = "24"
+	TypeRefund           = "25"
+	TypeBalanceInquiry   = "01"
+)
+
+// NetSettlement is the network management information code (field 60.3)
+// of a settlement.
+const NetSettlement = "201"
+
+// Reconciliation flags in field 48 of the 0510.
+const (
+	ReconcileBalanced   = "1"
+	ReconcileUnbalanced = "2"
+	ReconcileError      = "3"
+)
+
+const (
+	ERR_SETTLEMENT_REJECTED string = "settlement rejected; response code=%s"
+	ERR_SETTLEMENT_FIELD48  string = "invalid settlement field 48: %q"
+	ERR_RECONCILE           string = "host reported a reconciliation error"
+)
+
+// field 48 of a settlement: for domestic then foreign cards, debit amount
+// (12), debit count (3), credit amount (12), credit count (3) and the
+// reconciliation flag (1)
+const settlementHalfLen = 12 + 3 + 12 + 3 + 1
+
+// Totals are the debit and credit totals of a batch, amounts in cents.
+type Totals struct {
+	DebitAmount  int64
+	DebitCount   int
+	CreditAmount int64
+	CreditCount  int
+}
+
+func (t Totals) field48() string {
+	return fmt.Sprintf("%012d%03d%012d%03d", t.DebitAmount, t.DebitCount%1000, t.CreditAmount, t.CreditCount%1000)
+}
+
+// BatchTotals computes the totals of batchNum from journal entries. Only
+// transactions the host approved count, and neither a voided transaction nor
+// its void does, nor any transaction a reversal was sent for. Sales and
+// pre-authorisation completions are debits, refunds credits.
+func BatchTotals(entries []JournalEntry, batchNum string) Totals {
+	var t Totals
+	for _, e := range journalTransactions(entries, batchNum) {
+		amount, _ := strconv.ParseInt(e.Amount, 10, 64)
+		switch e.TypeCode {
+		case TypeSale, TypeCompletion, TypeCompletionAdvice:
+			t.DebitAmount += amount
+			t.DebitCount++
+		case TypeRefund:
+			t.CreditAmount += amount
+			t.CreditCount++
+		}
+	}
+	return t
+}
+
+// journalTransactions returns the sent requests of batchNum that stand: the
+// host approved them, they were not reversed and not voided. Voids are
+// dropped along with what they voided.
+func journalTransactions(entries []JournalEntry, batchNum string) []JournalEntry {
+	approved := make(map[string]bool)
+	reversed := make(map[string]bool)
+	for _, e := range entries {
+		switch {
+		case e.Direction == JournalReceived && (e.MTI == "0210" || e.MTI == "0230") && e.ResponseCode == RespApproved:
+			approved[e.TerminalID+e.STAN] = true
+		case e.Direction == JournalSent && e.MTI == "0400":
+			reversed[e.TerminalID+e.STAN] = true
+		}
+	}
+
+	var requests []JournalEntry
+	voided := make(map[string]bool)
+	for _, e := range entries {
+		if e.Direction != JournalSent || (e.MTI != "0200" && e.MTI != "0220") || e.BatchNum != batchNum {
+			continue
+		}
+		key := e.TerminalID + e.STAN
+		if !approved[key] || reversed[key] {
+			continue
+		}
+		if e.TypeCode == TypeSaleVoid || e.TypeCode == TypeCompletionVoid {
+			// field 61 holds the original batch number and STAN
+			if orig := e.Fields[61]; len(orig) >= 12 {
+				voided[e.TerminalID+orig[6:12]] = true
+			}
+			continue
+		}
+		requests = append(requests, e)
+	}
+
+	out := requests[:0]
+	for _, e := range requests {
+		if !voided[e.TerminalID+e.STAN] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// NewSettlementRequest builds the 0500 carrying the batch totals. Foreign
+// card totals are sent as zero.
+func NewSettlementRequest(tpdu, header, stan, batchNum, terminalID, merchantID, operator string, totals Totals) *Message {
+	m := &Message{Tpdu: tpdu, Header: header, Mti: "0500"}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, stan)
+	m.Fields[41] = NewFieldFix(ASCII, 8, terminalID)
+	m.Fields[42] = NewFieldFix(ASCII, 15, merchantID)
+	m.Fields[48] = NewFieldVar(LLLVAR, BCD, totals.field48()+"0"+Totals{}.field48()+"0")
+	m.Fields[49] = NewFieldFix(ASCII, 3, "156")
+
+	subField60 := make([]SubField, 3)
+	subField60[0] = NewSubFieldFix(BCD, 2, "00")
+	subField60[1] = NewSubFieldFix(BCD, 6, batchNum)
+	subField60[2] = NewSubFieldFix(BCD, 3, NetSettlement)
+	m.Fields[60] = NewFields(LLLVAR, BCD, subField60)
+	m.Fields[63] = NewFieldVar(LLLVAR, ASCII, operator)
+	return m
+}
+
+// ReconcileFlags returns the domestic and foreign reconciliation flags from
+// field 48 of a 0510.
+func ReconcileFlags(resp *Message) (domestic, foreign string, err error) {
+	field48 := resp.FieldString(48)
+	if len(field48) < settlementHalfLen {
+		return "", "", fmt.Errorf(ERR_SETTLEMENT_FIELD48, field48)
+	}
+	domestic = field48[settlementHalfLen-1 : settlementHalfLen]
+	if len(field48) >= 2*settlementHalfLen {
+		foreign = field48[2*settlementHalfLen-1 : 2*settlementHalfLen]
+	}
+	return domestic, foreign, nil
+}
+
+// Settlement closes a terminal's batch.
+type Settlement struct {
+	Sender     Sender
+	Journal    Journal
+	State      *TerminalState
+	Tpdu       string
+	Header     string
+	TerminalID string
+	MerchantID string
+	Operator   string
+	// UploadSize and PAN configure UploadBatch; PAN returns the clear card
+	// number of a journalled transaction.
+	UploadSize int
+	PAN        func(e JournalEntry) string
+}
+
+// SettlementResult is the outcome of Settle. Batch is the batch that was
+// closed; a batch upload of it follows when Balanced is false.
+type SettlementResult struct {
+	Batch    string
+	Totals   Totals
+	Balanced bool
+	Response *Message
+}
+
+// Settle sends the 0500 with the current batch's totals, reads the
+// reconciliation flag and advances the batch number once the host has
+// accepted the settlement.
+func (s *Settlement) Settle(ctx context.Context) (*SettlementResult, error) {
+	batchNum := s.State.Batch()
+	entries, err := s.Journal.Query(JournalQuery{TerminalID: s.TerminalID})
+	if err != nil {
+		return nil, err
+	}
+	totals := BatchTotals(entries, batchNum)
+
+	stan, err := s.State.NextSTAN()
+	if err != nil {
+		return nil, err
+	}
+	req := NewSettlementRequest(s.Tpdu, s.Header, stan, batchNum, s.TerminalID, s.MerchantID, s.Operator, totals)
+	resp, err := sendRecorded(ctx, s.Sender, s.Journal, req)
+	if err != nil {
+		return nil, err
+	}
+	if code := resp.FieldString(39); code != RespApproved {
+		return nil, fmt.Errorf(ERR_SETTLEMENT_REJECTED, code)
+	}
+	domestic, foreign, err := ReconcileFlags(resp)
+	if err != nil {
+		return nil, err
+	}
+	if domestic == ReconcileError || foreign == ReconcileError {
+		return nil, errors.New(ERR_RECONCILE)
+	}
+
+	if _, err := s.State.NextBatch(); err != nil {
+		return nil, err
+	}
+	return &SettlementResult{
+		Batch:    batchNum,
+		Totals:   totals,
+		Balanced: domestic == ReconcileBalanced && foreign != ReconcileUnbalanced,
+		Response: resp,
+	}, nil
+}
+
+// sendRecorded sends m and journals the request and its response.
+func sendRecorded(ctx context.Context, sender Sender, journal Journal, m *Message) (*Message, error) {
+	if err := Record(journal, m, JournalSent); err != nil {
+		return nil, err
+	}
+	resp, err := sender.Send(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := Record(journal, resp, JournalReceived); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
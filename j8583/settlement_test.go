@@ -0,0 +1,61 @@
+package j8583
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func journalTransaction(t *testing.T, j Journal, mti, stan, typeCode, amount, code, orig string) {
+	m := newTestRequest(mti, stan)
+	m.Fields[4] = NewFieldFix(BCD, 12, amount)
+	m.Fields[60] = NewFields(LLLVAR, BCD, []SubField{NewSubFieldFix(BCD, 2, typeCode), NewSubFieldFix(BCD, 6, "000001")})
+	if orig != "" {
+		m.Fields[61] = NewFieldVar(LLLVAR, BCD, "000001"+orig+"0000")
+	}
+	assert.NoError(t, Record(j, m, JournalSent))
+	if code != "" {
+		assert.NoError(t, Record(j, NewResponse(m, code), JournalReceived))
+	}
+}
+
+func TestSettle(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "settle")
+	defer os.RemoveAll(dir)
+	j, _ := OpenFileJournal(dir)
+	defer j.Close()
+
+	journalTransaction(t, j, "0200", "000001", TypeSale, "000000000100", "00", "")
+	journalTransaction(t, j, "0200", "000002", TypeSale, "000000000200", "00", "")
+	journalTransaction(t, j, "0200", "000003", TypeSaleVoid, "000000000200", "00", "000002")
+	journalTransaction(t, j, "0200", "000004", TypeRefund, "000000000050", "00", "")
+	journalTransaction(t, j, "0200", "000005", TypeSale, "000000000300", "", "")
+	journalTransaction(t, j, "0400", "000005", TypeSale, "000000000300", "", "")
+	journalTransaction(t, j, "0200", "000006", TypeSale, "000000000400", "51", "")
+
+	entries, _ := j.Query(JournalQuery{})
+	assert.Equal(t, Totals{DebitAmount: 100, DebitCount: 1, CreditAmount: 50, CreditCount: 1}, BatchTotals(entries, "000001"))
+
+	state, _ := OpenTerminalState("")
+	state.data.STAN = 6
+	sender := &scriptedSender{replies: []func(*Message) (*Message, error){
+		func(m *Message) (*Message, error) {
+			resp := NewResponse(m, RespApproved)
+			field48 := m.FieldString(48)
+			resp.Fields[48] = NewFieldVar(LLLVAR, BCD, field48[:30]+ReconcileUnbalanced+field48[31:])
+			return resp, nil
+		},
+	}}
+	s := &Settlement{Sender: sender, Journal: j, State: state, Tpdu: "6000030000", Header: "613100313031",
+		TerminalID: "00003042", MerchantID: "666100041213175", Operator: "01 "}
+	result, err := s.Settle(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0500", sender.sent[0].Mti)
+	assert.Equal(t, "000000000100001000000000050001", sender.sent[0].FieldString(48)[:30])
+	assert.False(t, result.Balanced)
+	assert.Equal(t, "000001", result.Batch)
+	assert.Equal(t, "000002", state.Batch())
+}
@@ -0,0 +1,170 @@
+package j8583
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"8583/security"
+)
+
+// network management information codes for sign-in (field 60.3)
+const (
+	SignInSingleDES        = "001"
+	SignInDoubleDES        = "003"
+	SignInDoubleDESWithTDK = "004"
+)
+
+const (
+	ERR_SIGN_IN_REJECTED string = "sign-in rejected; response code=%s"
+	ERR_WORKING_KEYS     string = "invalid working key data in field 62; len=%d"
+	ERR_WORKING_KEY_KCV  string = "%s check value mismatch"
+)
+
+// NewSignInRequest builds the 0800 sign-in request sent before any financial
+// transaction. netCode selects the key scheme the terminal asks for.
+func NewSignInRequest(tpdu, header, stan, batchNum, terminalID, merchantID, operator, netCode string) *Message {
+	m := &Message{Tpdu: tpdu, Header: header, Mti: "0800"}
+	m.Fields = make([]Field, 65)
+	m.Fields[11] = NewFieldFix(BCD, 6, stan)
+	m.Fields[41] = NewFieldFix(ASCII, 8, terminalID)
+	m.Fields[42] = NewFieldFix(ASCII, 15, merchantID)
+
+	subField60 := make([]SubField, 3)
+	subField60[0] = NewSubFieldFix(BCD, 2, "00")
+	subField60[1] = NewSubFieldFix(BCD, 6, batchNum)
+	subField60[2] = NewSubFieldFix(BCD, 3, netCode)
+	m.Fields[60] = NewFields(LLLVAR, BCD, subField60)
+	m.Fields[63] = NewFieldVar(LLLVAR, ASCII, operator)
+	return m
+}
+
+// WorkingKeys are the PIK, MAK and TDK delivered in field 62 of the 0810
+// sign-in response, each encrypted under the TMK and followed by a 4 byte
+// check value of the clear key. TDK is only present in the 60 byte layout.
+type WorkingKeys struct {
+	PIK      []byte
+	PIKCheck []byte
+	MAK      []byte
+	MAKCheck []byte
+	TDK      []byte
+	TDKCheck []byte
+}
+
+// ParseWorkingKeys splits field 62 of a sign-in response. Supported layouts
+// are 24 bytes (single DES PIK, MAK), 40 bytes (double length PIK, MAK) and
+// 60 bytes (double length PIK, MAK, TDK).
+func ParseWorkingKeys(field62 []byte) (*WorkingKeys, error) {
+	keyLen := 16
+	switch len(field62) {
+	case 24:
+		keyLen = 8
+	case 40, 60:
+	default:
+		return nil, fmt.Errorf(ERR_WORKING_KEYS, len(field62))
+	}
+
+	slot := keyLen + 4
+	w := &WorkingKeys{}
+	w.PIK, w.PIKCheck = field62[:keyLen], field62[keyLen:slot]
+	w.MAK, w.MAKCheck = field62[slot:slot+keyLen], field62[slot+keyLen:2*slot]
+	if len(field62) == 60 {
+		w.TDK, w.TDKCheck = field62[2*slot:2*slot+keyLen], field62[2*slot+keyLen:]
+	}
+
+	// a single length MAK is sent in a double length slot followed by zeros
+	if keyLen == 16 && bytes.Equal(w.MAK[8:], make([]byte, 8)) {
+		w.MAK = w.MAK[:8]
+	}
+	return w, nil
+}
+
+// Decrypt decrypts the DES working keys under tmk and verifies their check
+// values, returning the clear keys.
+func (w *WorkingKeys) Decrypt(tmk []byte) (*WorkingKeys, error) {
+	return w.DecryptWith(tmk, security.AlgDES)
+}
+
+// DecryptWith is Decrypt for working keys encrypted with alg; SM4 keys and
+// their check values use SM4 throughout.
+func (w *WorkingKeys) DecryptWith(tmk []byte, alg security.Algorithm) (*WorkingKeys, error) {
+	clear := &WorkingKeys{PIKCheck: w.PIKCheck, MAKCheck: w.MAKCheck, TDKCheck: w.TDKCheck}
+	var err error
+	if clear.PIK, err = decryptWorkingKey(security.PIK, alg, w.PIK, w.PIKCheck, tmk); err != nil {
+		return nil, err
+	}
+	if clear.MAK, err = decryptWorkingKey(security.MAK, alg, w.MAK, w.MAKCheck, tmk); err != nil {
+		return nil, err
+	}
+	if w.TDK != nil {
+		if clear.TDK, err = decryptWorkingKey(security.TDK, alg, w.TDK, w.TDKCheck, tmk); err != nil {
+			return nil, err
+		}
+	}
+	return clear, nil
+}
+
+// Install stores clear working keys for terminalID.
+func (w *WorkingKeys) Install(store security.KeyStore, terminalID string) error {
+	if err := store.Put(terminalID, security.PIK, w.PIK); err != nil {
+		return err
+	}
+	if err := store.Put(terminalID, security.MAK, w.MAK); err != nil {
+		return err
+	}
+	if w.TDK != nil {
+		return store.Put(terminalID, security.TDK, w.TDK)
+	}
+	return nil
+}
+
+// HandleSignInResponse checks a 0810 response, decrypts the working keys in
+// field 62 under the terminal's TMK from store and installs them. The keys
+// are decrypted with resp.Algorithm.
+func HandleSignInResponse(resp *Message, store security.KeyStore) error {
+	if resp.Mti != "0810" {
+		return fmt.Errorf("unexpected sign-in response mti: %s", resp.Mti)
+	}
+	if code, _ := resp.getFieldValue(39).(string); code != "00" {
+		return fmt.Errorf(ERR_SIGN_IN_REJECTED, code)
+	}
+	terminalID, _ := resp.getFieldValue(41).(string)
+	field62, _ := resp.getFieldValue(62).(string)
+	if len(terminalID) == 0 || len(field62) == 0 {
+		return errors.New("sign-in response missing field 41 or 62")
+	}
+
+	raw, err := hex.DecodeString(field62)
+	if err != nil {
+		return err
+	}
+	encrypted, err := ParseWorkingKeys(raw)
+	if err != nil {
+		return err
+	}
+	tmk, err := store.Get(terminalID, security.TMK)
+	if err != nil {
+		return err
+	}
+	keys, err := encrypted.DecryptWith(tmk, resp.Algorithm)
+	if err != nil {
+		return err
+	}
+	return keys.Install(store, terminalID)
+}
+
+func decryptWorkingKey(keyType security.KeyType, alg security.Algorithm, encrypted, kcv, tmk []byte) ([]byte, error) {
+	key, err := alg.Decrypt(encrypted, tmk, security.WithMode(security.ECB), security.WithPadding(security.NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	check, err := alg.CheckValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(kcv) == 0 || len(kcv) > len(check) || !bytes.Equal(check[:len(kcv)], kcv) {
+		return nil, fmt.Errorf(ERR_WORKING_KEY_KCV, keyType)
+	}
+	return key, nil
+}
@@ -0,0 +1,117 @@
+package j8583
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"8583/security"
+	"8583/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptUnder(t *testing.T, tmk []byte, clear string) string {
+	key, _ := hex.DecodeString(clear)
+	encrypted, err := security.EncryptWithDESKey(key, tmk, security.WithMode(security.ECB), security.WithPadding(security.NoPadding))
+	assert.NoError(t, err)
+	kcv, err := security.CheckValue(key)
+	assert.NoError(t, err)
+	return utils.EncodeToString(encrypted) + utils.EncodeToString(kcv)
+}
+
+func TestSignInInstallsWorkingKeys(t *testing.T) {
+	tmk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	store := security.NewMemoryKeyStore()
+	assert.NoError(t, store.Put("00003042", security.TMK, tmk))
+
+	req := NewSignInRequest("6004010000", "602200000000", "000001", "000001", "00003042", "666100041213175", "01 ", SignInDoubleDESWithTDK)
+	_, err := req.Bytes("")
+	assert.NoError(t, err)
+
+	// single length MAK travels in a double length slot padded with zeros
+	encryptedMak := encryptUnder(t, tmk, "1CDC70ABD616015E")
+	field62 := encryptUnder(t, tmk, "1C1C1C1C1C1C1C1C2A2A2A2A2A2A2A2A") +
+		encryptedMak[:16] + "0000000000000000" + encryptedMak[16:] +
+		encryptUnder(t, tmk, "4551E676DFEFE6109252683B64B66E1F")
+
+	resp := &Message{Tpdu: "6000000401", Header: "602200000000", Mti: "0810", Fields: make([]Field, 65)}
+	resp.Fields[11] = NewFieldFix(BCD, 6, "000001")
+	resp.Fields[39] = NewFieldFix(ASCII, 2, "00")
+	resp.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+	resp.Fields[62] = NewFieldVar(LLLVAR, BINARY, field62)
+	data, err := resp.Bytes("")
+	assert.NoError(t, err)
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+
+	assert.NoError(t, HandleSignInResponse(decoded, store))
+	mak, err := store.Get("00003042", security.MAK)
+	assert.NoError(t, err)
+	assert.Equal(t, "1CDC70ABD616015E", utils.EncodeToString(mak))
+	tdk, err := store.Get("00003042", security.TDK)
+	assert.NoError(t, err)
+	assert.Equal(t, "4551E676DFEFE6109252683B64B66E1F", utils.EncodeToString(tdk))
+
+	req.Fields[4] = NewFieldFix(BCD, 12, "000000000001")
+	assert.NoError(t, req.SetMAC(store, "00003042"))
+	ok, err := req.VerifyMAC(store, "00003042")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSignInBadCheckValue(t *testing.T) {
+	tmk, _ := hex.DecodeString("0123456789ABCDEF")
+	keys, err := ParseWorkingKeys(make([]byte, 24))
+	assert.NoError(t, err)
+	_, err = keys.Decrypt(tmk)
+	assert.Error(t, err)
+
+	_, err = ParseWorkingKeys(make([]byte, 10))
+	assert.Error(t, err)
+}
+
+func TestSignInSM4(t *testing.T) {
+	tmk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	store := security.NewMemoryKeyStore()
+	assert.NoError(t, store.Put("00003042", security.TMK, tmk))
+
+	var field62 string
+	for _, clear := range []string{"1C1C1C1C1C1C1C1C2A2A2A2A2A2A2A2A", "1CDC70ABD616015E4551E676DFEFE610"} {
+		key, _ := hex.DecodeString(clear)
+		encrypted, err := security.SM4Encrypt(key, tmk, security.WithMode(security.ECB), security.WithPadding(security.NoPadding))
+		assert.NoError(t, err)
+		kcv, err := security.AlgSM4.CheckValue(key)
+		assert.NoError(t, err)
+		field62 += utils.EncodeToString(encrypted) + utils.EncodeToString(kcv)
+	}
+	resp := &Message{Tpdu: "6000000401", Header: "602200000000", Mti: "0810", Algorithm: security.AlgSM4, Fields: make([]Field, 65)}
+	resp.Fields[39] = NewFieldFix(ASCII, 2, "00")
+	resp.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+	resp.Fields[62] = NewFieldVar(LLLVAR, BINARY, field62)
+
+	assert.NoError(t, HandleSignInResponse(resp, store))
+	mak, err := store.Get("00003042", security.MAK)
+	assert.NoError(t, err)
+	assert.Equal(t, "1CDC70ABD616015E4551E676DFEFE610", utils.EncodeToString(mak))
+
+	// the same keys do not pass as DES keys
+	resp.Algorithm = security.AlgDES
+	assert.Error(t, HandleSignInResponse(resp, store))
+}
+
+func TestSM4PinBlockField(t *testing.T) {
+	store := security.NewMemoryKeyStore()
+	pik, _ := hex.DecodeString("1C1C1C1C1C1C1C1C2A2A2A2A2A2A2A2A")
+	assert.NoError(t, store.Put("00003042", security.PIK, pik))
+
+	m := &Message{Tpdu: "6004010000", Header: "602200000000", Mti: "0200", Algorithm: security.AlgSM4, Fields: make([]Field, 65)}
+	m.Fields[11] = NewFieldFix(BCD, 6, "000001")
+	assert.NoError(t, m.SetPinBlock("123456", "6225887912345678", store, "00003042"))
+	m.Fields[53] = NewFieldFix(BCD, 16, "2600000000000000")
+	data, err := m.Bytes("")
+	assert.NoError(t, err)
+
+	decoded, err := DecodeWithAlgorithm(data, security.AlgSM4)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, len(decoded.FieldString(52)))
+	assert.Equal(t, "2600000000000000", decoded.FieldString(53))
+}
@@ -0,0 +1,125 @@
+package j8583
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// MaxSTAN is the last STAN before field 11 wraps back to 000001. Batch
+// numbers (field 60.2) wrap the same way.
+const MaxSTAN = 999999
+
+const ERR_INVALID_BATCH string = "invalid batch number: %s"
+
+// TerminalState allocates a terminal's STANs (field 11) and tracks its
+// current batch number (field 60.2). With a path every change is written to
+// the file before it is handed out, so a restart never reuses a STAN.
+type TerminalState struct {
+	path string
+	mu   sync.Mutex
+	data terminalStateData
+}
+
+type terminalStateData struct {
+	STAN  int `json:"stan"`
+	Batch int `json:"batch"`
+}
+
+// OpenTerminalState loads the state kept at path, starting from STAN 000000
+// and batch 000001 if the file does not exist. An empty path keeps the state
+// in memory only.
+func OpenTerminalState(path string) (*TerminalState, error) {
+	s := &TerminalState{path: path, data: terminalStateData{Batch: 1}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NextSTAN allocates the next STAN.
+func (s *TerminalState) NextSTAN() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.data
+	next.STAN = wrap(next.STAN + 1)
+	if err := s.save(next); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", s.data.STAN), nil
+}
+
+// STAN returns the last allocated STAN.
+func (s *TerminalState) STAN() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%06d", s.data.STAN)
+}
+
+// Batch returns the current batch number.
+func (s *TerminalState) Batch() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%06d", s.data.Batch)
+}
+
+// SetBatch sets the batch number, e.g. from field 60.2 of a sign-in
+// response.
+func (s *TerminalState) SetBatch(batchNum string) error {
+	n, err := strconv.Atoi(batchNum)
+	if err != nil || n < 1 || n > MaxSTAN {
+		return fmt.Errorf(ERR_INVALID_BATCH, batchNum)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.data
+	next.Batch = n
+	return s.save(next)
+}
+
+// NextBatch closes the current batch and returns the new batch number.
+func (s *TerminalState) NextBatch() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.data
+	next.Batch = wrap(next.Batch + 1)
+	if err := s.save(next); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", s.data.Batch), nil
+}
+
+// save persists next and makes it current; the caller holds s.mu.
+func (s *TerminalState) save(next terminalStateData) error {
+	if s.path != "" {
+		data, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path, data); err != nil {
+			return err
+		}
+	}
+	s.data = next
+	return nil
+}
+
+func wrap(n int) int {
+	if n < 1 || n > MaxSTAN {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package j8583
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminalStatePersists(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "state")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := OpenTerminalState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "000001", s.Batch())
+	stan, err := s.NextSTAN()
+	assert.NoError(t, err)
+	assert.Equal(t, "000001", stan)
+	assert.NoError(t, s.SetBatch("000042"))
+
+	s, err = OpenTerminalState(path)
+	assert.NoError(t, err)
+	stan, _ = s.NextSTAN()
+	assert.Equal(t, "000002", stan)
+	assert.Equal(t, "000042", s.Batch())
+	assert.Error(t, s.SetBatch("abc"))
+}
+
+func TestTerminalStateWraps(t *testing.T) {
+	s, _ := OpenTerminalState("")
+	s.data.STAN = MaxSTAN - 1
+	s.data.Batch = MaxSTAN
+
+	stan, _ := s.NextSTAN()
+	assert.Equal(t, "999999", stan)
+	stan, _ = s.NextSTAN()
+	assert.Equal(t, "000001", stan)
+	batch, _ := s.NextBatch()
+	assert.Equal(t, "000001", batch)
+}
+
+func TestTerminalStateConcurrent(t *testing.T) {
+	s, _ := OpenTerminalState("")
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				stan, err := s.NextSTAN()
+				assert.NoError(t, err)
+				mu.Lock()
+				seen[stan] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 800, len(seen))
+	assert.Equal(t, "000800", s.STAN())
+}
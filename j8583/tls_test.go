@@ -0,0 +1,116 @@
+package j8583
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	peers := make(chan string, 4)
+	router := NewRouter()
+	router.Handle("0200", func(ctx context.Context, req *Request) (*Message, error) {
+		peers <- req.PeerCommonName()
+		return NewResponse(req.Message, RespApproved), nil
+	})
+	server := NewServer(router.Serve)
+	server.Use(TerminalCertificate())
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "host", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(l)
+	defer server.Close()
+
+	dial := func(cn string) (*Client, error) {
+		config := &tls.Config{RootCAs: ca.pool, ServerName: "127.0.0.1"}
+		if cn != "" {
+			config.Certificates = []tls.Certificate{ca.issue(t, cn, x509.ExtKeyUsageClientAuth)}
+		}
+		return DialTLS(l.Addr().String(), time.Second, config)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := dial("00003042")
+	assert.NoError(t, err)
+	resp, err := client.Send(ctx, newTestRequest("0200", "000001"))
+	assert.NoError(t, err)
+	assert.Equal(t, RespApproved, resp.FieldString(39))
+	assert.Equal(t, "00003042", <-peers)
+	client.Close()
+
+	// a certificate for another terminal is refused by the middleware
+	client, err = dial("00009999")
+	assert.NoError(t, err)
+	resp, err = client.Send(ctx, newTestRequest("0200", "000002"))
+	assert.NoError(t, err)
+	assert.Equal(t, RespSecurity, resp.FieldString(39))
+	client.Close()
+
+	// without a client certificate the handshake fails
+	client, err = dial("")
+	if err == nil {
+		_, err = client.Send(ctx, newTestRequest("0200", "000003"))
+		client.Close()
+	}
+	assert.Error(t, err)
+}
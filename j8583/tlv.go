@@ -0,0 +1,90 @@
+package j8583
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const ERR_BAD_TLV string = "malformed TLV data"
+
+// TLV is one BER-TLV data object as used in field 55 and the EMV parameter
+// downloads in field 62. Tag is the upper case hex tag, e.g. "9F06".
+type TLV struct {
+	Tag   string
+	Value []byte
+}
+
+// ParseTLV splits data into its top level data objects.
+func ParseTLV(data []byte) ([]TLV, error) {
+	var out []TLV
+	for i := 0; i < len(data); {
+		// padding between objects
+		if data[i] == 0x00 || data[i] == 0xFF {
+			i++
+			continue
+		}
+		start := i
+		if data[i]&0x1F == 0x1F {
+			for i++; i < len(data) && data[i]&0x80 != 0; i++ {
+			}
+		}
+		i++
+		if i >= len(data) {
+			return nil, errors.New(ERR_BAD_TLV)
+		}
+		tag := strings.ToUpper(hex.EncodeToString(data[start:i]))
+
+		length := int(data[i])
+		i++
+		if length&0x80 != 0 {
+			n := length & 0x7F
+			if n == 0 || n > 3 || i+n > len(data) {
+				return nil, errors.New(ERR_BAD_TLV)
+			}
+			length = 0
+			for _, b := range data[i : i+n] {
+				length = length<<8 | int(b)
+			}
+			i += n
+		}
+		if i+length > len(data) {
+			return nil, errors.New(ERR_BAD_TLV)
+		}
+		out = append(out, TLV{Tag: tag, Value: data[i : i+length]})
+		i += length
+	}
+	return out, nil
+}
+
+// EncodeTLV serialises tlvs in order.
+func EncodeTLV(tlvs []TLV) ([]byte, error) {
+	var out []byte
+	for _, t := range tlvs {
+		tag, err := hex.DecodeString(t.Tag)
+		if err != nil || len(tag) == 0 {
+			return nil, errors.New(ERR_BAD_TLV)
+		}
+		out = append(out, tag...)
+		switch n := len(t.Value); {
+		case n < 0x80:
+			out = append(out, byte(n))
+		case n <= 0xFF:
+			out = append(out, 0x81, byte(n))
+		default:
+			out = append(out, 0x82, byte(n>>8), byte(n))
+		}
+		out = append(out, t.Value...)
+	}
+	return out, nil
+}
+
+// FindTLV returns the value of the first object with tag.
+func FindTLV(tlvs []TLV, tag string) ([]byte, bool) {
+	for _, t := range tlvs {
+		if t.Tag == tag {
+			return t.Value, true
+		}
+	}
+	return nil, false
+}
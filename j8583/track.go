@@ -0,0 +1,33 @@
+package j8583
+
+import (
+	"8583/security"
+)
+
+// TrackCipher is the FieldCipher for track 2 and 3 data (fields 35 and 36)
+// sent encrypted under the TDK when the message is not enveloped.
+type TrackCipher struct {
+	TDK       []byte
+	Algorithm security.Algorithm
+}
+
+func NewTrackCipher(store security.KeyStore, terminalID string, alg security.Algorithm) (*TrackCipher, error) {
+	tdk, err := store.Get(terminalID, security.TDK)
+	if err != nil {
+		return nil, err
+	}
+	return &TrackCipher{TDK: tdk, Algorithm: alg}, nil
+}
+
+func (c *TrackCipher) EncryptField(value string) (string, error) {
+	return security.EncryptTrack(value, c.TDK, c.Algorithm)
+}
+
+func (c *TrackCipher) DecryptField(value string) (string, error) {
+	return security.DecryptTrack(value, c.TDK, c.Algorithm)
+}
+
+// TrackCiphers returns the decode ciphers for fields 35 and 36.
+func (c *TrackCipher) TrackCiphers() map[int]FieldCipher {
+	return map[int]FieldCipher{35: c, 36: c}
+}
@@ -0,0 +1,35 @@
+package j8583
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"8583/security"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackFieldCipher(t *testing.T) {
+	tdk, _ := hex.DecodeString("4551E676DFEFE6109252683B64B66E1F")
+	cipher := &TrackCipher{TDK: tdk, Algorithm: security.AlgDES}
+	track2 := "6225887912345678D49121010000000000"
+
+	m := &Message{Tpdu: "6000030000", Header: "613100313031", Mti: "0200"}
+	m.Fields = make([]Field, 65)
+	m.Fields[35] = NewFieldVar(LLVAR, BCD, track2, WithCipher(cipher))
+	m.Fields[41] = NewFieldFix(ASCII, 8, "00003042")
+
+	data, err := m.Bytes("")
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(data, BCD2Byte(track2)))
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.False(t, decoded.getFieldValue(35) == track2)
+
+	decoded, err = DecodeWithCiphers(data, cipher.TrackCiphers())
+	assert.NoError(t, err)
+	assert.Equal(t, track2, decoded.getFieldValue(35))
+	assert.Equal(t, "00003042", decoded.getFieldValue(41))
+}
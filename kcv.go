@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"8583/security"
+	"8583/utils"
+)
+
+// runKCV is the "kcv" subcommand used at key ceremonies: it reads 2 or 3 clear
+// components in hex, one per line, and prints the check value of each
+// component and of the combined key. Key material is never printed and
+// terminal echo is switched off while components are typed.
+func runKCV(args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("kcv", flag.ContinueOnError)
+	flags.SetOutput(out)
+	count := flags.Int("components", 2, "number of key components (2 or 3)")
+	keyType := flags.String("type", "des", "key type: des or aes")
+	parity := flags.Bool("parity", true, "adjust DES components and key to odd parity")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *count < 2 || *count > 3 {
+		return errors.New("components must be 2 or 3")
+	}
+	if *keyType != "des" && *keyType != "aes" {
+		return errors.New("type must be des or aes")
+	}
+
+	if f, ok := in.(*os.File); ok {
+		if restore := disableEcho(f); restore != nil {
+			defer restore()
+		}
+	}
+
+	reader := bufio.NewReader(in)
+	components := make([][]byte, 0, *count)
+	defer func() {
+		for _, c := range components {
+			security.Zeroize(c)
+		}
+	}()
+	for i := 1; i <= *count; i++ {
+		fmt.Fprintf(out, "component %d: ", i)
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(out)
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return err
+		}
+		component, err := hex.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return fmt.Errorf("component %d is not valid hex", i)
+		}
+		components = append(components, component)
+		if *keyType == "des" && *parity {
+			security.AdjustParity(component)
+		}
+		kcv, err := checkValue(*keyType, component)
+		if err != nil {
+			return fmt.Errorf("component %d: %s", i, err)
+		}
+		fmt.Fprintf(out, "component %d KCV: %s\n", i, utils.EncodeToString(kcv))
+	}
+
+	key, err := security.CombineComponents(components...)
+	if err != nil {
+		return err
+	}
+	defer security.Zeroize(key)
+	if *keyType == "des" && *parity {
+		security.AdjustParity(key)
+	}
+	kcv, err := checkValue(*keyType, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "combined key KCV: %s\n", utils.EncodeToString(kcv))
+	return nil
+}
+
+func checkValue(keyType string, key []byte) ([]byte, error) {
+	if keyType == "aes" {
+		return security.AESCheckValue(key)
+	}
+	return security.CheckValue(key)
+}
+
+// disableEcho turns off terminal echo with stty when f is a terminal and
+// returns a function restoring it, or nil if echo could not be changed.
+func disableEcho(f *os.File) func() {
+	if info, err := f.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	cmd := exec.Command("stty", "-echo")
+	cmd.Stdin = f
+	if cmd.Run() != nil {
+		return nil
+	}
+	return func() {
+		cmd := exec.Command("stty", "echo")
+		cmd.Stdin = f
+		cmd.Run()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"8583/security"
+	"8583/utils"
+)
+
+func TestRunKCV(t *testing.T) {
+	var out bytes.Buffer
+	in := strings.NewReader("0123456789ABCDEF\nFEDCBA9876543210\n")
+	if err := runKCV([]string{"-components", "2"}, in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := hex.DecodeString("FEFEFEFEFEFEFEFE")
+	kcv, _ := security.CheckValue(key)
+	for _, want := range []string{"component 1 KCV: D5D44FF7", "combined key KCV: " + utils.EncodeToString(kcv)} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "0123456789ABCDEF") {
+		t.Error("component printed in clear")
+	}
+
+	if err := runKCV([]string{"-components", "4"}, strings.NewReader(""), &out); err == nil {
+		t.Error("4 components should fail")
+	}
+	if err := runKCV(nil, strings.NewReader("0123456789ABCDEF\nnot hex\n"), &out); err == nil {
+		t.Error("invalid hex should fail")
+	}
+}
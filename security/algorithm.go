@@ -0,0 +1,154 @@
+package security
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"8583/utils"
+)
+
+// Algorithm selects the block cipher family used for PIN blocks, MACs and
+// message envelopes: DES/3DES or the Chinese national SM4.
+type Algorithm int
+
+const (
+	AlgDES Algorithm = iota
+	AlgSM4
+)
+
+const ERR_UNKNOWN_ALGORITHM string = "unknown algorithm"
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgDES:
+		return "DES"
+	case AlgSM4:
+		return "SM4"
+	}
+	return "UNKNOWN"
+}
+
+// BlockSize is the cipher block size of the algorithm.
+func (a Algorithm) BlockSize() int {
+	if a == AlgSM4 {
+		return SM4BlockSize
+	}
+	return 8
+}
+
+func (a Algorithm) Encrypt(data, key []byte, opts ...Option) ([]byte, error) {
+	switch a {
+	case AlgDES:
+		return EncryptWithDESKey(data, key, opts...)
+	case AlgSM4:
+		return SM4Encrypt(data, key, opts...)
+	}
+	return nil, errors.New(ERR_UNKNOWN_ALGORITHM)
+}
+
+func (a Algorithm) Decrypt(data, key []byte, opts ...Option) ([]byte, error) {
+	switch a {
+	case AlgDES:
+		return DecryptWithDESKey(data, key, opts...)
+	case AlgSM4:
+		return SM4Decrypt(data, key, opts...)
+	}
+	return nil, errors.New(ERR_UNKNOWN_ALGORITHM)
+}
+
+// MAC computes the field 64 MAC. For SM4 the CUP ECB scheme is applied with
+// 16 byte blocks.
+func (a Algorithm) MAC(mak, mab []byte) ([]byte, error) {
+	switch a {
+	case AlgDES:
+		return CalcMAC(mak, mab)
+	case AlgSM4:
+		return SM4MAC(mak, mab)
+	}
+	return nil, errors.New(ERR_UNKNOWN_ALGORITHM)
+}
+
+// EncryptPinBlock builds and encrypts the PIN block for pin and pan under pik.
+func (a Algorithm) EncryptPinBlock(pin, pan string, pik []byte) ([]byte, error) {
+	switch a {
+	case AlgDES:
+		return EncryptPinBlock(pin, pan, pik)
+	case AlgSM4:
+		block, err := SM4PinBlock(pin, pan)
+		if err != nil {
+			return nil, err
+		}
+		return SM4Encrypt(block, pik, WithMode(ECB), WithPadding(NoPadding))
+	}
+	return nil, errors.New(ERR_UNKNOWN_ALGORITHM)
+}
+
+// CheckValue returns the 4 byte check value of key: a zero block encrypted
+// under it.
+func (a Algorithm) CheckValue(key []byte) ([]byte, error) {
+	out, err := a.Encrypt(make([]byte, a.BlockSize()), key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	return out[:4], nil
+}
+
+// SM4MAC is the CUP ECB MAC over 16 byte blocks: the blocks are XORed, the
+// hex form is encrypted in two halves with mak and the first 8 hex
+// characters of the final block are returned.
+func SM4MAC(mak, mab []byte) ([]byte, error) {
+	if len(mak) != 16 {
+		return nil, errors.New(ERR_INVALID_SM4_KEY)
+	}
+	if len(mab) <= 0 {
+		return nil, errors.New("input mab should not be empty")
+	}
+
+	mab = ZeroPadding(append([]byte(nil), mab...), SM4BlockSize)
+	result := make([]byte, SM4BlockSize)
+	for i := 0; i < len(mab); i += SM4BlockSize {
+		for j := 0; j < SM4BlockSize; j++ {
+			result[j] ^= mab[i+j]
+		}
+	}
+
+	hexDecBytes := []byte(utils.EncodeToString(result))
+	out, err := SM4Encrypt(hexDecBytes[:SM4BlockSize], mak, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	for i := range out {
+		out[i] ^= hexDecBytes[SM4BlockSize+i]
+	}
+	out, err = SM4Encrypt(out, mak, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(utils.EncodeToString(out))[:8], nil
+}
+
+// SM4PinBlock widens the ISO 9564-1 format 0 (ANSI X9.8) PIN block to the
+// 16 byte SM4 block as CUP terminals build it for SM4 PIN encryption: the
+// PIN field 0 || N || PIN is padded with F to 32 digits and XORed with 20
+// zeros followed by the 12 rightmost PAN digits before the check digit. For
+// PIN 123456 and PAN 6222021234567890123 the block is
+// 06123456FFFFFFFFFFFFEDCBA9876FED.
+func SM4PinBlock(pin, pan string) ([]byte, error) {
+	if len(pin) < 4 || len(pin) > 12 || strings.Trim(pin, "0123456789") != "" {
+		return nil, errors.New(ERR_INVALID_PIN)
+	}
+	if len(pan) < 13 || strings.Trim(pan, "0123456789") != "" {
+		return nil, errors.New(ERR_INVALID_PAN)
+	}
+	pinField, err := hex.DecodeString((fmt.Sprintf("0%X", len(pin)) + pin + strings.Repeat("F", 30))[:32])
+	if err != nil {
+		return nil, err
+	}
+	panField, err := hex.DecodeString(strings.Repeat("0", 20) + pan[len(pan)-13:len(pan)-1])
+	if err != nil {
+		return nil, err
+	}
+	return xorBytes(pinField, panField), nil
+}
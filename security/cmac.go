@@ -0,0 +1,78 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+)
+
+// CMAC computes the NIST SP 800-38B CMAC of data with any 64 or 128 bit
+// block cipher.
+func CMAC(block cipher.Block, data []byte) []byte {
+	size := block.BlockSize()
+	rb := byte(0x87)
+	if size == 8 {
+		rb = 0x1B
+	}
+	k1 := cmacShift(encryptZero(block), rb)
+	k2 := cmacShift(k1, rb)
+
+	n := (len(data) + size - 1) / size
+	last := make([]byte, size)
+	if n == 0 || len(data)%size != 0 {
+		if n == 0 {
+			n = 1
+		}
+		copy(last, data[(n-1)*size:])
+		last[len(data)-(n-1)*size] = 0x80
+		last = xorBytes(last, k2)
+	} else {
+		last = xorBytes(data[(n-1)*size:], k1)
+	}
+
+	x := make([]byte, size)
+	for i := 0; i < n-1; i++ {
+		block.Encrypt(x, xorBytes(x, data[i*size:(i+1)*size]))
+	}
+	block.Encrypt(x, xorBytes(x, last))
+	return x
+}
+
+// AESCMAC is CMAC with an AES key.
+func AESCMAC(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return CMAC(block, data), nil
+}
+
+// TDESCMAC is CMAC with a double or triple length DES key.
+func TDESCMAC(key, data []byte) ([]byte, error) {
+	if len(key) == 16 {
+		key = append(key[:16:16], key[:8]...)
+	}
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return CMAC(block, data), nil
+}
+
+func encryptZero(block cipher.Block) []byte {
+	out := make([]byte, block.BlockSize())
+	block.Encrypt(out, out)
+	return out
+}
+
+func cmacShift(in []byte, rb byte) []byte {
+	out := make([]byte, len(in))
+	for i := 0; i < len(in)-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[len(in)-1] = in[len(in)-1] << 1
+	if in[0]&0x80 != 0 {
+		out[len(in)-1] ^= rb
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package security
+
+import (
+	"errors"
+	"math/bits"
+)
+
+const (
+	ERR_COMPONENT_COUNT  string = "a key is combined from 2 or 3 components"
+	ERR_COMPONENT_LENGTH string = "key components must have the same length"
+)
+
+// CombineComponents XORs 2 or 3 clear key components into a key.
+func CombineComponents(components ...[]byte) ([]byte, error) {
+	if len(components) < 2 || len(components) > 3 {
+		return nil, errors.New(ERR_COMPONENT_COUNT)
+	}
+	key := append([]byte(nil), components[0]...)
+	for _, c := range components[1:] {
+		if len(c) != len(key) || len(c) == 0 {
+			Zeroize(key)
+			return nil, errors.New(ERR_COMPONENT_LENGTH)
+		}
+		for i := range key {
+			key[i] ^= c[i]
+		}
+	}
+	return key, nil
+}
+
+// AdjustParity sets the low bit of every byte so each has odd parity, as DES
+// keys require. key is modified in place and returned.
+func AdjustParity(key []byte) []byte {
+	for i, b := range key {
+		if bits.OnesCount8(b)%2 == 0 {
+			key[i] = b ^ 0x01
+		}
+	}
+	return key
+}
+
+// HasOddParity reports whether every byte of key has odd parity.
+func HasOddParity(key []byte) bool {
+	for _, b := range key {
+		if bits.OnesCount8(b)%2 == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AESCheckValue is the X9.24 CMAC check value of an AES key: the leftmost 5
+// bytes of the CMAC of a zero block.
+func AESCheckValue(key []byte) ([]byte, error) {
+	out, err := AESCMAC(key, make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	return out[:5], nil
+}
@@ -0,0 +1,28 @@
+package security
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"8583/utils"
+)
+
+func TestCombineComponents(t *testing.T) {
+	c1, _ := hex.DecodeString("0123456789ABCDEF")
+	c2, _ := hex.DecodeString("FEDCBA9876543210")
+	c3, _ := hex.DecodeString("1111111111111111")
+	key, err := CombineComponents(c1, c2, c3)
+	if err != nil || utils.EncodeToString(key) != "EEEEEEEEEEEEEEEE" {
+		t.Error(utils.EncodeToString(key), err)
+	}
+	if _, err := CombineComponents(c1); err == nil {
+		t.Error("single component should fail")
+	}
+	if utils.EncodeToString(AdjustParity(key)) != "EFEFEFEFEFEFEFEF" || !HasOddParity(key) {
+		t.Error(utils.EncodeToString(key))
+	}
+	kcv, _ := CheckValue(c1)
+	if utils.EncodeToString(kcv) != "D5D44FF7" {
+		t.Error(utils.EncodeToString(kcv))
+	}
+}
@@ -7,92 +7,75 @@ import (
 	"errors"
 )
 
-func EncryptWithDESKey(data, key []byte) ([]byte, error) {
+const (
+	ERR_INVALID_KEY_LENGTH string = "input key must has 24 bytes or 16 bytes or 8 bytes"
+	ERR_INVALID_PADDING    string = "invalid padding"
+	ERR_INVALID_BLOCK_SIZE string = "input data is not a multiple of the block size"
+	ERR_INVALID_IV_LENGTH  string = "iv length must equal block size"
+)
+
+func EncryptWithDESKey(data, key []byte, opts ...Option) ([]byte, error) {
 	switch len(key) {
 	case 8:
-		return DesEncrypt(data, key)
+		return DesEncrypt(data, key, opts...)
 	case 16:
-		key = append(key, key[:8]...)
+		key = append(key[:16:16], key[:8]...)
 		fallthrough
 	case 24:
-		return TripleDesEncrypt(data, key)
+		return TripleDesEncrypt(data, key, opts...)
 	default:
-		return nil, errors.New("input key must has 24 bytes or 16 bytes or 8 bytes")
+		return nil, errors.New(ERR_INVALID_KEY_LENGTH)
 
 	}
 }
 
-func DecryptWithDESKey(data, key []byte) ([]byte, error) {
+func DecryptWithDESKey(data, key []byte, opts ...Option) ([]byte, error) {
 	switch len(key) {
 	case 8:
-		return DesDecrypt(data, key)
+		return DesDecrypt(data, key, opts...)
 	case 16:
-		key = append(key, key[:8]...)
+		key = append(key[:16:16], key[:8]...)
 		fallthrough
 	case 24:
-		return TripleDesDecrypt(data, key)
+		return TripleDesDecrypt(data, key, opts...)
 	default:
-		return nil, errors.New("input key must has 24 bytes or 16 bytes or 8 bytes")
+		return nil, errors.New(ERR_INVALID_KEY_LENGTH)
 
 	}
 }
 
-func DesEncrypt(origData, key []byte) ([]byte, error) {
+func DesEncrypt(origData, key []byte, opts ...Option) ([]byte, error) {
 	block, err := des.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	origData = PKCS5Padding(origData, block.BlockSize())
-	// origData = ZeroPadding(origData, block.BlockSize())
-	blockMode := cipher.NewCBCEncrypter(block, key)
-	crypted := make([]byte, len(origData))
-	// 根据CryptBlocks方法的说明，如下方式初始化crypted也可以
-	// crypted := origData
-	blockMode.CryptBlocks(crypted, origData)
-	return crypted, nil
+	return encrypt(block, origData, key[:8], newOptions(opts))
 }
 
-func DesDecrypt(crypted, key []byte) ([]byte, error) {
+func DesDecrypt(crypted, key []byte, opts ...Option) ([]byte, error) {
 	block, err := des.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	blockMode := cipher.NewCBCDecrypter(block, key)
-	origData := make([]byte, len(crypted))
-	// origData := crypted
-	blockMode.CryptBlocks(origData, crypted)
-	origData = PKCS5UnPadding(origData)
-	// origData = ZeroUnPadding(origData)
-	return origData, nil
+	return decrypt(block, crypted, key[:8], newOptions(opts))
 }
 
 // 3DES加密
-func TripleDesEncrypt(origData, key []byte) ([]byte, error) {
+func TripleDesEncrypt(origData, key []byte, opts ...Option) ([]byte, error) {
 	block, err := des.NewTripleDESCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	origData = PKCS5Padding(origData, block.BlockSize())
-	// origData = ZeroPadding(origData, block.BlockSize())
-	blockMode := cipher.NewCBCEncrypter(block, key[:8])
-	crypted := make([]byte, len(origData))
-	blockMode.CryptBlocks(crypted, origData)
-	return crypted, nil
+	return encrypt(block, origData, key[:8], newOptions(opts))
 }
 
 // 3DES解密
-func TripleDesDecrypt(crypted, key []byte) ([]byte, error) {
+func TripleDesDecrypt(crypted, key []byte, opts ...Option) ([]byte, error) {
 	block, err := des.NewTripleDESCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	blockMode := cipher.NewCBCDecrypter(block, key[:8])
-	origData := make([]byte, len(crypted))
-	// origData := crypted
-	blockMode.CryptBlocks(origData, crypted)
-	origData = PKCS5UnPadding(origData)
-	// origData = ZeroUnPadding(origData)
-	return origData, nil
+	return decrypt(block, crypted, key[:8], newOptions(opts))
 }
 
 func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
@@ -101,11 +84,95 @@ func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
 	return append(ciphertext, padtext...)
 }
 
-func PKCS5UnPadding(origData []byte) []byte {
+// PKCS5UnPadding strips PKCS#5/#7 padding; a pad value larger than
+// blockSize is rejected.
+func PKCS5UnPadding(origData []byte, blockSize int) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, errors.New(ERR_INVALID_PADDING)
+	}
 	// 去掉最后一个字节 unpadding 次
 	unpadding := int(origData[length - 1])
-	return origData[:(length - unpadding)]
+	if unpadding == 0 || unpadding > length || unpadding > blockSize {
+		return nil, errors.New(ERR_INVALID_PADDING)
+	}
+	for _, b := range origData[length - unpadding:] {
+		if int(b) != unpadding {
+			return nil, errors.New(ERR_INVALID_PADDING)
+		}
+	}
+	return origData[:(length - unpadding)], nil
+}
+
+// ZeroPadding pads with 0x00 up to the block size; aligned data is left as is.
+func ZeroPadding(ciphertext []byte, blockSize int) []byte {
+	if len(ciphertext) % blockSize == 0 {
+		return ciphertext
+	}
+	padding := blockSize - len(ciphertext) % blockSize
+	return append(ciphertext, make([]byte, padding)...)
+}
+
+func ZeroUnPadding(origData []byte) ([]byte, error) {
+	return bytes.TrimRight(origData, "\x00"), nil
+}
+
+// ISO9797M2Padding appends 0x80 followed by 0x00 up to the block size
+// (ISO/IEC 9797-1 padding method 2).
+func ISO9797M2Padding(ciphertext []byte, blockSize int) []byte {
+	ciphertext = append(ciphertext, 0x80)
+	return ZeroPadding(ciphertext, blockSize)
+}
+
+func ISO9797M2UnPadding(origData []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(origData, "\x00")
+	if len(trimmed) == 0 || trimmed[len(trimmed) - 1] != 0x80 {
+		return nil, errors.New(ERR_INVALID_PADDING)
+	}
+	return trimmed[:len(trimmed) - 1], nil
+}
+
+func encrypt(block cipher.Block, data, keyIV []byte, o *Options) ([]byte, error) {
+	size := block.BlockSize()
+	data = o.Padding.pad(append([]byte(nil), data...), size)
+	if len(data) % size != 0 {
+		return nil, errors.New(ERR_INVALID_BLOCK_SIZE)
+	}
+
+	crypted := make([]byte, len(data))
+	switch o.Mode {
+	case ECB:
+		for i := 0; i < len(data); i += size {
+			block.Encrypt(crypted[i:i + size], data[i:i + size])
+		}
+	default:
+		iv, err := o.iv(keyIV, size)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(crypted, data)
+	}
+	return crypted, nil
 }
 
+func decrypt(block cipher.Block, crypted, keyIV []byte, o *Options) ([]byte, error) {
+	size := block.BlockSize()
+	if len(crypted) % size != 0 {
+		return nil, errors.New(ERR_INVALID_BLOCK_SIZE)
+	}
 
+	origData := make([]byte, len(crypted))
+	switch o.Mode {
+	case ECB:
+		for i := 0; i < len(crypted); i += size {
+			block.Decrypt(origData[i:i + size], crypted[i:i + size])
+		}
+	default:
+		iv, err := o.iv(keyIV, size)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(origData, crypted)
+	}
+	return o.Padding.unpad(origData, size)
+}
@@ -1,6 +1,7 @@
 package security
 
 import (
+	"bytes"
 	"testing"
 	"encoding/hex"
 	"fmt"
@@ -21,4 +22,69 @@ func TestDecodeHex(t *testing.T) {
 	}
 	fmt.Printf("%x\n",d)
 	t.Log(utils.EncodeToString(d))
-}
\ No newline at end of file
+}
+
+func TestDesECBNoPadding(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789ABCDEF")
+	data, _ := hex.DecodeString("4E6F772069732074")
+	out, err := EncryptWithDESKey(data, key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(out) != "3FA40E8A984D4815" {
+		t.Error(utils.EncodeToString(out))
+	}
+}
+
+func TestTripleDesPaddingRoundTrip(t *testing.T) {
+	key, _ := hex.DecodeString("4551E676DFEFE6109252683B64B66E1F")
+	iv, _ := hex.DecodeString("0102030405060708")
+	cases := [][]Option{
+		nil,
+		{WithZeroIV(), WithPadding(ISO9797M2)},
+		{WithIV(iv), WithPadding(Zero)},
+		{WithMode(ECB), WithPadding(PKCS5)},
+	}
+	for i, opts := range cases {
+		out, err := EncryptWithDESKey([]byte("0200abc"), key, opts...)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		plain, err := DecryptWithDESKey(out, key, opts...)
+		if err != nil || string(plain) != "0200abc" {
+			t.Error(i, string(plain), err)
+		}
+	}
+}
+
+func TestUnPaddingErrors(t *testing.T) {
+	if _, err := PKCS5UnPadding(nil, 8); err == nil {
+		t.Error("empty input should fail")
+	}
+	if _, err := PKCS5UnPadding([]byte{1, 2, 3, 9}, 8); err == nil {
+		t.Error("padding longer than data should fail")
+	}
+	if _, err := PKCS5UnPadding(bytes.Repeat([]byte{0x10}, 16), 8); err == nil {
+		t.Error("padding longer than a block should fail")
+	}
+	if _, err := ISO9797M2UnPadding([]byte{1, 2, 0, 0}); err == nil {
+		t.Error("missing 0x80 marker should fail")
+	}
+	key, _ := hex.DecodeString("0123456789ABCDEF")
+	if _, err := DecryptWithDESKey([]byte{1, 2, 3}, key); err == nil {
+		t.Error("partial block should fail")
+	}
+	if _, err := EncryptWithDESKey([]byte("0200abc"), key, WithIV(nil)); err == nil {
+		t.Error("nil IV should fail")
+	}
+}
+
+func TestPinBlock(t *testing.T) {
+	block, err := PinBlock("1234", "4111111111111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(block) != "041225EEEEEEEEEE" {
+		t.Error(utils.EncodeToString(block))
+	}
+}
@@ -0,0 +1,143 @@
+package security
+
+import (
+	"errors"
+)
+
+// ANSI X9.24-1 (TDES) DUKPT. The key serial number is 10 bytes whose
+// rightmost 21 bits are the transaction counter.
+const (
+	KSNLength        = 10
+	dukptCounterBits = 21
+	dukptMaxOnes     = 10
+)
+
+const (
+	ERR_INVALID_KSN      string = "invalid key serial number length"
+	ERR_INVALID_BDK      string = "base derivation key must be 16 bytes"
+	ERR_COUNTER_EXHAUST  string = "dukpt transaction counter exhausted"
+	ERR_UNKNOWN_KEY_KIND string = "unknown dukpt working key kind"
+)
+
+// DukptKeyKind selects the variant applied to a transaction key.
+type DukptKeyKind int
+
+const (
+	DukptPIN DukptKeyKind = iota
+	DukptMACRequest
+	DukptMACResponse
+	DukptDataRequest
+	DukptDataResponse
+)
+
+var keyRegisterMask = []byte{0xC0, 0xC0, 0xC0, 0xC0, 0x00, 0x00, 0x00, 0x00, 0xC0, 0xC0, 0xC0, 0xC0, 0x00, 0x00, 0x00, 0x00}
+
+// DeriveIPEK derives the initial PIN encryption key of a device from the base
+// derivation key and its key serial number.
+func DeriveIPEK(bdk, ksn []byte) ([]byte, error) {
+	if len(bdk) != 16 {
+		return nil, errors.New(ERR_INVALID_BDK)
+	}
+	if len(ksn) != KSNLength {
+		return nil, errors.New(ERR_INVALID_KSN)
+	}
+	data := append([]byte(nil), ksn[:8]...)
+	data[7] &= 0xE0
+
+	left, err := EncryptWithDESKey(data, bdk, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	right, err := EncryptWithDESKey(data, xorBytes(bdk, keyRegisterMask), WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// DeriveTransactionKey derives the transaction key for the counter held in ksn
+// from the initial key, as a host does.
+func DeriveTransactionKey(ipek, ksn []byte) ([]byte, error) {
+	if len(ksn) != KSNLength {
+		return nil, errors.New(ERR_INVALID_KSN)
+	}
+	reg := append([]byte(nil), ksn[2:]...)
+	counter := uint32(reg[5]&0x1F)<<16 | uint32(reg[6])<<8 | uint32(reg[7])
+	reg[5] &= 0xE0
+	reg[6], reg[7] = 0, 0
+
+	key := append([]byte(nil), ipek...)
+	for bit := uint32(1) << (dukptCounterBits - 1); bit > 0; bit >>= 1 {
+		if counter&bit == 0 {
+			continue
+		}
+		setCounterBits(reg, bit)
+		var err error
+		if key, err = nonReversibleKey(key, reg); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// DeriveWorkingKey applies the variant for kind to a transaction key. Data
+// keys are additionally encrypted under themselves as X9.24-1:2009 requires.
+func DeriveWorkingKey(transactionKey []byte, kind DukptKeyKind) ([]byte, error) {
+	variant := make([]byte, 16)
+	switch kind {
+	case DukptPIN:
+		variant[7], variant[15] = 0xFF, 0xFF
+	case DukptMACRequest:
+		variant[6], variant[14] = 0xFF, 0xFF
+	case DukptMACResponse:
+		variant[4], variant[12] = 0xFF, 0xFF
+	case DukptDataRequest:
+		variant[5], variant[13] = 0xFF, 0xFF
+	case DukptDataResponse:
+		variant[3], variant[11] = 0xFF, 0xFF
+	default:
+		return nil, errors.New(ERR_UNKNOWN_KEY_KIND)
+	}
+	key := xorBytes(transactionKey, variant)
+	if kind != DukptDataRequest && kind != DukptDataResponse {
+		return key, nil
+	}
+	return EncryptWithDESKey(key, key, WithMode(ECB), WithPadding(NoPadding))
+}
+
+// nonReversibleKey is the non-reversible key generation process: both halves
+// of the new key are DES encryptions of reg under halves of key and of key
+// XORed with the key register mask.
+func nonReversibleKey(key, reg []byte) ([]byte, error) {
+	right, err := nonReversibleHalf(key, reg)
+	if err != nil {
+		return nil, err
+	}
+	left, err := nonReversibleHalf(xorBytes(key, keyRegisterMask), reg)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+func nonReversibleHalf(key, reg []byte) ([]byte, error) {
+	out, err := DesEncrypt(xorBytes(reg, key[8:]), key[:8], WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	return xorBytes(out, key[8:]), nil
+}
+
+func setCounterBits(reg []byte, bit uint32) {
+	reg[5] |= byte(bit >> 16)
+	reg[6] |= byte(bit >> 8)
+	reg[7] |= byte(bit)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
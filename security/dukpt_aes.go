@@ -0,0 +1,156 @@
+package security
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+)
+
+// ANSI X9.24-3 (AES) DUKPT. The key serial number is 12 bytes: an 8 byte
+// initial key ID followed by a 32 bit transaction counter.
+const (
+	AESKSNLength        = 12
+	aesDukptCounterBits = 32
+	aesDukptMaxOnes     = 16
+)
+
+// DukptKeyUsage is the key usage indicator placed in derivation data.
+type DukptKeyUsage uint16
+
+const (
+	UsageKeyEncryption          DukptKeyUsage = 0x0002
+	UsagePINEncryption          DukptKeyUsage = 0x1000
+	UsageMACGeneration          DukptKeyUsage = 0x2000
+	UsageMACVerification        DukptKeyUsage = 0x2001
+	UsageMACBoth                DukptKeyUsage = 0x2002
+	UsageDataEncrypt            DukptKeyUsage = 0x3000
+	UsageDataDecrypt            DukptKeyUsage = 0x3001
+	UsageDataBoth               DukptKeyUsage = 0x3002
+	UsageKeyDerivation          DukptKeyUsage = 0x8000
+	UsageKeyDerivationInitalKey DukptKeyUsage = 0x8001
+)
+
+// DukptAlgorithm is the algorithm of a derived key.
+type DukptAlgorithm uint16
+
+const (
+	Dukpt2TDEA  DukptAlgorithm = 0x0000
+	Dukpt3TDEA  DukptAlgorithm = 0x0001
+	DukptAES128 DukptAlgorithm = 0x0002
+	DukptAES192 DukptAlgorithm = 0x0003
+	DukptAES256 DukptAlgorithm = 0x0004
+)
+
+const (
+	ERR_INVALID_AES_KSN string = "invalid AES DUKPT key serial number length"
+	ERR_INVALID_ALG     string = "unknown dukpt key algorithm"
+)
+
+func (a DukptAlgorithm) keyLength() int {
+	switch a {
+	case Dukpt2TDEA, DukptAES128:
+		return 16
+	case Dukpt3TDEA, DukptAES192:
+		return 24
+	case DukptAES256:
+		return 32
+	}
+	return 0
+}
+
+func aesAlgorithmFor(key []byte) (DukptAlgorithm, error) {
+	switch len(key) {
+	case 16:
+		return DukptAES128, nil
+	case 24:
+		return DukptAES192, nil
+	case 32:
+		return DukptAES256, nil
+	}
+	return 0, errors.New(ERR_INVALID_ALG)
+}
+
+// DeriveAESInitialKey derives the initial key of a device from an AES BDK and
+// its 12 byte key serial number. The initial key has the BDK's algorithm.
+func DeriveAESInitialKey(bdk, ksn []byte) ([]byte, error) {
+	if len(ksn) != AESKSNLength {
+		return nil, errors.New(ERR_INVALID_AES_KSN)
+	}
+	alg, err := aesAlgorithmFor(bdk)
+	if err != nil {
+		return nil, err
+	}
+	return aesDeriveKey(bdk, UsageKeyDerivationInitalKey, alg, ksn[:8])
+}
+
+// DeriveAESTransactionKey derives the intermediate derivation key for the
+// counter in ksn from the initial key, as a host does.
+func DeriveAESTransactionKey(initialKey, ksn []byte) ([]byte, error) {
+	if len(ksn) != AESKSNLength {
+		return nil, errors.New(ERR_INVALID_AES_KSN)
+	}
+	alg, err := aesAlgorithmFor(initialKey)
+	if err != nil {
+		return nil, err
+	}
+	counter := binary.BigEndian.Uint32(ksn[8:])
+
+	key := append([]byte(nil), initialKey...)
+	var working uint32
+	for bit := uint32(1) << (aesDukptCounterBits - 1); bit > 0; bit >>= 1 {
+		if counter&bit == 0 {
+			continue
+		}
+		working |= bit
+		if key, err = aesDeriveKey(key, UsageKeyDerivation, alg, aesCounterData(ksn, working)); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// DeriveAESWorkingKey derives the key for usage and algorithm from a
+// transaction key.
+func DeriveAESWorkingKey(transactionKey, ksn []byte, usage DukptKeyUsage, alg DukptAlgorithm) ([]byte, error) {
+	if len(ksn) != AESKSNLength {
+		return nil, errors.New(ERR_INVALID_AES_KSN)
+	}
+	return aesDeriveKey(transactionKey, usage, alg, aesCounterData(ksn, binary.BigEndian.Uint32(ksn[8:])))
+}
+
+// aesCounterData is the tail of the derivation data for a transaction key:
+// the rightmost 4 bytes of the initial key ID and the counter.
+func aesCounterData(ksn []byte, counter uint32) []byte {
+	data := make([]byte, 8)
+	copy(data, ksn[4:8])
+	binary.BigEndian.PutUint32(data[4:], counter)
+	return data
+}
+
+// aesDeriveKey AES-encrypts as many derivation data blocks under key as the
+// output algorithm needs.
+func aesDeriveKey(key []byte, usage DukptKeyUsage, alg DukptAlgorithm, tail []byte) ([]byte, error) {
+	length := alg.keyLength()
+	if length == 0 {
+		return nil, errors.New(ERR_INVALID_ALG)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 32)
+	data := make([]byte, 16)
+	data[0] = 0x01
+	binary.BigEndian.PutUint16(data[2:], uint16(usage))
+	binary.BigEndian.PutUint16(data[4:], uint16(alg))
+	binary.BigEndian.PutUint16(data[6:], uint16(length*8))
+	copy(data[8:], tail)
+	for i := 1; len(out) < length; i++ {
+		data[1] = byte(i)
+		result := make([]byte, 16)
+		block.Encrypt(result, data)
+		out = append(out, result...)
+	}
+	return out[:length], nil
+}
@@ -0,0 +1,116 @@
+package security
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+// DukptTerminal is the originating device side of DUKPT. It keeps one future
+// key register per counter bit instead of the initial key, so every
+// transaction key is produced with at most one derivation and used keys are
+// erased. Counter values with too many one bits are skipped as the standards
+// require.
+type DukptTerminal struct {
+	mu         sync.Mutex
+	ksn        []byte
+	counter    uint32
+	counterLen uint
+	maxOnes    int
+	futureKeys [][]byte
+	derive     func(key []byte, counter uint32) ([]byte, error)
+	setCounter func(ksn []byte, counter uint32)
+}
+
+// NewDukptTerminal loads a TDES device with its IPEK and KSN. The counter
+// bits of ksn are ignored; the device starts at counter 1.
+func NewDukptTerminal(ipek, ksn []byte) (*DukptTerminal, error) {
+	if len(ksn) != KSNLength {
+		return nil, errors.New(ERR_INVALID_KSN)
+	}
+	t := &DukptTerminal{ksn: append([]byte(nil), ksn...), counterLen: dukptCounterBits, maxOnes: dukptMaxOnes}
+	t.setCounter = func(ksn []byte, counter uint32) {
+		ksn[7] = ksn[7]&0xE0 | byte(counter>>16)&0x1F
+		ksn[8] = byte(counter >> 8)
+		ksn[9] = byte(counter)
+	}
+	t.derive = func(key []byte, counter uint32) ([]byte, error) {
+		reg := append([]byte(nil), t.ksn[2:]...)
+		reg[5] &= 0xE0
+		reg[6], reg[7] = 0, 0
+		setCounterBits(reg, counter)
+		return nonReversibleKey(key, reg)
+	}
+	return t, t.load(ipek)
+}
+
+// NewAESDukptTerminal loads an AES DUKPT device with its initial key and 12
+// byte KSN.
+func NewAESDukptTerminal(initialKey, ksn []byte) (*DukptTerminal, error) {
+	if len(ksn) != AESKSNLength {
+		return nil, errors.New(ERR_INVALID_AES_KSN)
+	}
+	alg, err := aesAlgorithmFor(initialKey)
+	if err != nil {
+		return nil, err
+	}
+	t := &DukptTerminal{ksn: append([]byte(nil), ksn...), counterLen: aesDukptCounterBits, maxOnes: aesDukptMaxOnes}
+	t.setCounter = func(ksn []byte, counter uint32) {
+		binary.BigEndian.PutUint32(ksn[8:], counter)
+	}
+	t.derive = func(key []byte, counter uint32) ([]byte, error) {
+		return aesDeriveKey(key, UsageKeyDerivation, alg, aesCounterData(t.ksn, counter))
+	}
+	return t, t.load(initialKey)
+}
+
+func (t *DukptTerminal) load(initialKey []byte) error {
+	t.futureKeys = make([][]byte, t.counterLen)
+	for p := uint(0); p < t.counterLen; p++ {
+		key, err := t.derive(initialKey, 1<<p)
+		if err != nil {
+			return err
+		}
+		t.futureKeys[p] = key
+	}
+	t.counter = 1
+	return nil
+}
+
+// Next returns the KSN and transaction key for the next transaction and
+// advances the counter.
+func (t *DukptTerminal) Next() (ksn, key []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counter == 0 || uint64(t.counter) >= uint64(1)<<t.counterLen {
+		return nil, nil, errors.New(ERR_COUNTER_EXHAUST)
+	}
+
+	p := uint(bits.TrailingZeros32(t.counter))
+	current := t.futureKeys[p]
+	ksn = append([]byte(nil), t.ksn...)
+	t.setCounter(ksn, t.counter)
+	key = append([]byte(nil), current...)
+
+	if bits.OnesCount32(t.counter) < t.maxOnes {
+		for q := uint(0); q < p; q++ {
+			if t.futureKeys[q], err = t.derive(current, t.counter|1<<q); err != nil {
+				return nil, nil, err
+			}
+		}
+		t.counter++
+	} else {
+		t.counter += 1 << p
+	}
+	Zeroize(current)
+	t.futureKeys[p] = nil
+	return ksn, key, nil
+}
+
+// Counter returns the counter of the next transaction.
+func (t *DukptTerminal) Counter() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counter
+}
@@ -0,0 +1,132 @@
+package security
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"8583/utils"
+)
+
+// X9.24-1:2009 Annex A test data
+func TestDukptTDESVectors(t *testing.T) {
+	bdk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	ksn, _ := hex.DecodeString("FFFF9876543210E00000")
+	ipek, err := DeriveIPEK(bdk, ksn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(ipek) != "6AC292FAA1315B4D858AB3A3D7D5933A" {
+		t.Error("ipek", utils.EncodeToString(ipek))
+	}
+
+	ksn, _ = hex.DecodeString("FFFF9876543210E00001")
+	key, err := DeriveTransactionKey(ipek, ksn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(key) != "042666B49184CFA368DE9628D0397BC9" {
+		t.Error("transaction key", utils.EncodeToString(key))
+	}
+	pin, _ := DeriveWorkingKey(key, DukptPIN)
+	if utils.EncodeToString(pin) != "042666B49184CF5C68DE9628D0397B36" {
+		t.Error("pin key", utils.EncodeToString(pin))
+	}
+	block, err := EncryptPinBlock("1234", "4012345678909", pin)
+	if err != nil || utils.EncodeToString(block) != "1B9C1845EB993A7A" {
+		t.Error("pin block", utils.EncodeToString(block), err)
+	}
+
+	expected := map[string]string{
+		"FFFF9876543210E00002": "10A01C8D02C69107",
+		"FFFF9876543210E00003": "18DC07B94797B466",
+		"FFFF9876543210E00004": "0BC79509D5645DF7",
+		"FFFF9876543210E00005": "5BC0AF22AD87B327",
+		"FFFF9876543210E00006": "A16DF70AE36158D8",
+		"FFFF9876543210E00007": "27711C16CB257F8E",
+		"FFFF9876543210E00008": "50E55547A5027551",
+	}
+	for k, v := range expected {
+		ksn, _ := hex.DecodeString(k)
+		key, err := DeriveTransactionKey(ipek, ksn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pin, _ := DeriveWorkingKey(key, DukptPIN)
+		block, _ := EncryptPinBlock("1234", "4012345678909", pin)
+		if utils.EncodeToString(block) != v {
+			t.Error(k, utils.EncodeToString(block))
+		}
+	}
+}
+
+// X9.24-3:2017 supplement test data, AES-128 BDK
+func TestDukptAESVectors(t *testing.T) {
+	bdk, _ := hex.DecodeString("FEDCBA9876543210F1F1F1F1F1F1F1F1")
+	ksn, _ := hex.DecodeString("123456789012345600000001")
+	ik, err := DeriveAESInitialKey(bdk, ksn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(ik) != "1273671EA26AC29AFA4D1084127652A1" {
+		t.Error("initial key", utils.EncodeToString(ik))
+	}
+	key, err := DeriveAESTransactionKey(ik, ksn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(key) != "4F21B565BAD9835E112B6465635EAE44" {
+		t.Error("transaction key", utils.EncodeToString(key))
+	}
+	pin, err := DeriveAESWorkingKey(key, ksn, UsagePINEncryption, DukptAES128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(pin) != "AF8CB133A78F8DC2D1359F18527593FB" {
+		t.Error("pin key", utils.EncodeToString(pin))
+	}
+}
+
+func TestDukptTerminalMatchesHost(t *testing.T) {
+	bdk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	ksn, _ := hex.DecodeString("FFFF9876543210E00000")
+	ipek, _ := DeriveIPEK(bdk, ksn)
+	terminal, err := NewDukptTerminal(ipek, ksn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run past 0x3FF, the first counter with ten one bits, to check skipping
+	for i := 0; i < 1100; i++ {
+		txKSN, key, err := terminal.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := DeriveTransactionKey(ipek, txKSN)
+		if utils.EncodeToString(host) != utils.EncodeToString(key) {
+			t.Fatal(utils.EncodeToString(txKSN), "terminal and host keys differ")
+		}
+		if utils.EncodeToString(txKSN) == "FFFF9876543210E00400" && i != 0x3FF {
+			t.Fatal("counter 0x3FF should be followed by 0x400 without skipping earlier values", i)
+		}
+	}
+	if terminal.Counter() <= 1100 {
+		t.Error("counters with more than ten one bits were not skipped", terminal.Counter())
+	}
+
+	aesBDK, _ := hex.DecodeString("FEDCBA9876543210F1F1F1F1F1F1F1F1")
+	aesKSN, _ := hex.DecodeString("123456789012345600000000")
+	ik, _ := DeriveAESInitialKey(aesBDK, aesKSN)
+	aesTerminal, err := NewAESDukptTerminal(ik, aesKSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		txKSN, key, err := aesTerminal.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := DeriveAESTransactionKey(ik, txKSN)
+		if utils.EncodeToString(host) != utils.EncodeToString(key) {
+			t.Fatal(utils.EncodeToString(txKSN), "terminal and host keys differ")
+		}
+	}
+}
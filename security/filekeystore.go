@@ -0,0 +1,186 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const ERR_KEY_FILE_CORRUPT string = "key file entry %s/%s v%d cannot be decrypted"
+
+// FileKeyStore is a KeyStore persisted to a JSON file. Every key is sealed
+// with AES-GCM under a local master key, bound to its terminal, type and
+// version; the file is rewritten atomically on each change.
+type FileKeyStore struct {
+	*MemoryKeyStore
+	path string
+	aead cipher.AEAD
+}
+
+type keyFileEntry struct {
+	TerminalID string  `json:"terminal_id"`
+	KeyType    KeyType `json:"key_type"`
+	Version    int     `json:"version"`
+	Key        string  `json:"key"`
+}
+
+// OpenFileKeyStore loads path, creating an empty store if it does not exist.
+// masterKey must be 16, 24 or 32 bytes.
+func OpenFileKeyStore(path string, masterKey []byte) (*FileKeyStore, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileKeyStore{MemoryKeyStore: NewMemoryKeyStore(), path: path, aead: aead}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []keyFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		sealed, err := hex.DecodeString(e.Key)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, fmt.Errorf(ERR_KEY_FILE_CORRUPT, e.TerminalID, e.KeyType, e.Version)
+		}
+		nonce, body := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		key, err := aead.Open(nil, nonce, body, e.additionalData())
+		if err != nil {
+			return nil, fmt.Errorf(ERR_KEY_FILE_CORRUPT, e.TerminalID, e.KeyType, e.Version)
+		}
+		s.MemoryKeyStore.put(keyID{e.TerminalID, e.KeyType}, e.Version, key)
+		Zeroize(key)
+	}
+	return s, nil
+}
+
+// Put and Remove change a copy of the keys and only keep it once the file is
+// written, so a failed write leaves the store as it was.
+func (s *FileKeyStore) Put(terminalID string, keyType KeyType, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := keyID{terminalID, keyType}
+	next := s.copyKeys()
+	dropped := addVersion(next, id, 0, key)
+	if err := s.save(next); err != nil {
+		versions := next[id]
+		Zeroize(versions[len(versions)-1].key)
+		return err
+	}
+	s.keys = next
+	for _, v := range dropped {
+		Zeroize(v.key)
+	}
+	return nil
+}
+
+func (s *FileKeyStore) Remove(terminalID string, keyType KeyType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := keyID{terminalID, keyType}
+	versions, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	next := s.copyKeys()
+	delete(next, id)
+	if err := s.save(next); err != nil {
+		return err
+	}
+	s.keys = next
+	for _, v := range versions {
+		Zeroize(v.key)
+	}
+	return nil
+}
+
+// copyKeys returns a copy of the key map sharing the version lists, which
+// addVersion does not change in place. Callers hold s.mu.
+func (s *FileKeyStore) copyKeys() map[keyID][]keyVersion {
+	next := make(map[keyID][]keyVersion, len(s.keys)+1)
+	for id, versions := range s.keys {
+		next[id] = versions
+	}
+	return next
+}
+
+// save writes every key version in keys to a temporary file and renames it
+// over the store.
+func (s *FileKeyStore) save(keys map[keyID][]keyVersion) error {
+	entries := make([]keyFileEntry, 0, len(keys))
+	for id, versions := range keys {
+		for _, v := range versions {
+			e := keyFileEntry{TerminalID: id.terminalID, KeyType: id.keyType, Version: v.version}
+			nonce := make([]byte, s.aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return err
+			}
+			e.Key = hex.EncodeToString(s.aead.Seal(nonce, nonce, v.key, e.additionalData()))
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.TerminalID != b.TerminalID {
+			return a.TerminalID < b.TerminalID
+		}
+		if a.KeyType != b.KeyType {
+			return a.KeyType < b.KeyType
+		}
+		return a.Version < b.Version
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (e *keyFileEntry) additionalData() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%d", e.TerminalID, e.KeyType, e.Version))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.New("replace key file: " + err.Error())
+	}
+	return nil
+}
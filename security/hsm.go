@@ -0,0 +1,113 @@
+package security
+
+import (
+	"crypto/hmac"
+	"errors"
+)
+
+const (
+	ERR_HSM_PIN_BLOCK string = "pin block length does not match algorithm"
+)
+
+// KeyRef names a key held by an HSM.
+type KeyRef struct {
+	TerminalID string
+	Type       KeyType
+}
+
+// HSM is the set of host security module operations message processing
+// needs. Keys never leave the HSM in clear; callers refer to them by KeyRef.
+type HSM interface {
+	GenerateMAC(key KeyRef, alg Algorithm, data []byte) ([]byte, error)
+	VerifyMAC(key KeyRef, alg Algorithm, data, mac []byte) (bool, error)
+	// TranslatePIN re-encrypts a PIN block from one PIK to another.
+	TranslatePIN(from, to KeyRef, alg Algorithm, block []byte) ([]byte, error)
+	// ImportKey decrypts a key under kek, checks its check value and stores
+	// it as key.
+	ImportKey(kek, key KeyRef, alg Algorithm, encrypted, kcv []byte) error
+	GenerateKCV(key KeyRef, alg Algorithm) ([]byte, error)
+}
+
+// SoftHSM performs HSM operations in process with keys from a KeyStore. It
+// stands in for a hardware HSM in tests and development.
+type SoftHSM struct {
+	store KeyStore
+}
+
+func NewSoftHSM(store KeyStore) *SoftHSM {
+	return &SoftHSM{store: store}
+}
+
+func (h *SoftHSM) GenerateMAC(key KeyRef, alg Algorithm, data []byte) ([]byte, error) {
+	mak, err := h.get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(mak)
+	return alg.MAC(mak, data)
+}
+
+func (h *SoftHSM) VerifyMAC(key KeyRef, alg Algorithm, data, mac []byte) (bool, error) {
+	expected, err := h.GenerateMAC(key, alg, data)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(expected, mac), nil
+}
+
+func (h *SoftHSM) TranslatePIN(from, to KeyRef, alg Algorithm, block []byte) ([]byte, error) {
+	if len(block) != alg.BlockSize() {
+		return nil, errors.New(ERR_HSM_PIN_BLOCK)
+	}
+	src, err := h.get(from)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(src)
+	dst, err := h.get(to)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(dst)
+
+	clear, err := alg.Decrypt(block, src, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(clear)
+	return alg.Encrypt(clear, dst, WithMode(ECB), WithPadding(NoPadding))
+}
+
+func (h *SoftHSM) ImportKey(kek, key KeyRef, alg Algorithm, encrypted, kcv []byte) error {
+	wrapping, err := h.get(kek)
+	if err != nil {
+		return err
+	}
+	defer Zeroize(wrapping)
+	clear, err := alg.Decrypt(encrypted, wrapping, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return err
+	}
+	defer Zeroize(clear)
+	check, err := alg.CheckValue(clear)
+	if err != nil {
+		return err
+	}
+	if len(kcv) == 0 || len(kcv) > len(check) || !hmac.Equal(check[:len(kcv)], kcv) {
+		return errors.New(ERR_CHECK_VALUE_MISMATCH)
+	}
+	return h.store.Put(key.TerminalID, key.Type, clear)
+}
+
+func (h *SoftHSM) GenerateKCV(key KeyRef, alg Algorithm) ([]byte, error) {
+	clear, err := h.get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(clear)
+	return alg.CheckValue(clear)
+}
+
+func (h *SoftHSM) get(key KeyRef) ([]byte, error) {
+	return h.store.Get(key.TerminalID, key.Type)
+}
@@ -0,0 +1,304 @@
+package security
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HSM command protocol is line based: a two letter command followed by
+// space separated arguments, binary values in hex, key references as
+// TERMINAL:TYPE and algorithms by name. Replies are "OK [value]" or
+// "ER message".
+//
+//	GM key alg data          generate MAC
+//	VM key alg data mac      verify MAC, replies Y or N
+//	TP from to alg block     translate PIN block
+//	IK kek key alg enc kcv   import key
+//	KC key alg               generate key check value
+
+const (
+	ERR_HSM_COMMAND  string = "unknown HSM command: %s"
+	ERR_HSM_ARGS     string = "wrong number of arguments for %s"
+	ERR_HSM_KEY_REF  string = "invalid key reference: %s"
+	ERR_HSM_RESPONSE string = "invalid HSM response: %s"
+)
+
+const maxHSMLine = 64 * 1024
+
+// HSMServer serves an HSM over TCP with the command protocol.
+type HSMServer struct {
+	hsm HSM
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewHSMServer(hsm HSM) *HSMServer {
+	return &HSMServer{hsm: hsm, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *HSMServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("hsm server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			// accepted while Close ran; it will not see this connection
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting, closes open connections and waits for handlers.
+func (s *HSMServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *HSMServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxHSMLine)
+	for scanner.Scan() {
+		reply, err := s.execute(strings.Fields(scanner.Text()))
+		line := "OK"
+		if err != nil {
+			line = "ER " + strings.Replace(err.Error(), "\n", " ", -1)
+		} else if reply != "" {
+			line += " " + reply
+		}
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (s *HSMServer) execute(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf(ERR_HSM_COMMAND, "")
+	}
+	want := map[string]int{"GM": 4, "VM": 5, "TP": 5, "IK": 6, "KC": 3}
+	n, ok := want[args[0]]
+	if !ok {
+		return "", fmt.Errorf(ERR_HSM_COMMAND, args[0])
+	}
+	if len(args) != n {
+		return "", fmt.Errorf(ERR_HSM_ARGS, args[0])
+	}
+
+	var p hsmArgs
+	switch args[0] {
+	case "GM":
+		key, alg, data := p.key(args[1]), p.alg(args[2]), p.hex(args[3])
+		if p.err != nil {
+			return "", p.err
+		}
+		mac, err := s.hsm.GenerateMAC(key, alg, data)
+		return hex.EncodeToString(mac), err
+	case "VM":
+		key, alg, data, mac := p.key(args[1]), p.alg(args[2]), p.hex(args[3]), p.hex(args[4])
+		if p.err != nil {
+			return "", p.err
+		}
+		ok, err := s.hsm.VerifyMAC(key, alg, data, mac)
+		if ok {
+			return "Y", err
+		}
+		return "N", err
+	case "TP":
+		from, to, alg, block := p.key(args[1]), p.key(args[2]), p.alg(args[3]), p.hex(args[4])
+		if p.err != nil {
+			return "", p.err
+		}
+		out, err := s.hsm.TranslatePIN(from, to, alg, block)
+		return hex.EncodeToString(out), err
+	case "IK":
+		kek, key, alg, enc, kcv := p.key(args[1]), p.key(args[2]), p.alg(args[3]), p.hex(args[4]), p.hex(args[5])
+		if p.err != nil {
+			return "", p.err
+		}
+		return "", s.hsm.ImportKey(kek, key, alg, enc, kcv)
+	default:
+		key, alg := p.key(args[1]), p.alg(args[2])
+		if p.err != nil {
+			return "", p.err
+		}
+		kcv, err := s.hsm.GenerateKCV(key, alg)
+		return hex.EncodeToString(kcv), err
+	}
+}
+
+// hsmArgs parses command arguments, keeping the first error.
+type hsmArgs struct {
+	err error
+}
+
+func (p *hsmArgs) hex(s string) []byte {
+	out, err := hex.DecodeString(s)
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	return out
+}
+
+func (p *hsmArgs) key(s string) KeyRef {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		p.fail(fmt.Errorf(ERR_HSM_KEY_REF, s))
+		return KeyRef{}
+	}
+	for _, t := range []KeyType{TMK, PIK, MAK, TDK} {
+		if t.String() == s[i+1:] {
+			return KeyRef{TerminalID: s[:i], Type: t}
+		}
+	}
+	p.fail(fmt.Errorf(ERR_HSM_KEY_REF, s))
+	return KeyRef{}
+}
+
+func (p *hsmArgs) alg(s string) Algorithm {
+	for _, a := range []Algorithm{AlgDES, AlgSM4} {
+		if a.String() == s {
+			return a
+		}
+	}
+	p.fail(errors.New(ERR_UNKNOWN_ALGORITHM + ": " + s))
+	return AlgDES
+}
+
+func (p *hsmArgs) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// HSMClient is an HSM reached over TCP with the command protocol. Commands
+// on one client are serialised over a single connection.
+type HSMClient struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func DialHSM(addr string, timeout time.Duration) (*HSMClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &HSMClient{Timeout: timeout, conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *HSMClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *HSMClient) GenerateMAC(key KeyRef, alg Algorithm, data []byte) ([]byte, error) {
+	return c.callHex("GM", keyRef(key), alg.String(), hex.EncodeToString(data))
+}
+
+func (c *HSMClient) VerifyMAC(key KeyRef, alg Algorithm, data, mac []byte) (bool, error) {
+	reply, err := c.call("VM", keyRef(key), alg.String(), hex.EncodeToString(data), hex.EncodeToString(mac))
+	return reply == "Y", err
+}
+
+func (c *HSMClient) TranslatePIN(from, to KeyRef, alg Algorithm, block []byte) ([]byte, error) {
+	return c.callHex("TP", keyRef(from), keyRef(to), alg.String(), hex.EncodeToString(block))
+}
+
+func (c *HSMClient) ImportKey(kek, key KeyRef, alg Algorithm, encrypted, kcv []byte) error {
+	_, err := c.call("IK", keyRef(kek), keyRef(key), alg.String(), hex.EncodeToString(encrypted), hex.EncodeToString(kcv))
+	return err
+}
+
+func (c *HSMClient) GenerateKCV(key KeyRef, alg Algorithm) ([]byte, error) {
+	return c.callHex("KC", keyRef(key), alg.String())
+}
+
+func (c *HSMClient) callHex(args ...string) ([]byte, error) {
+	reply, err := c.call(args...)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(reply)
+}
+
+func (c *HSMClient) call(args ...string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if _, err := c.conn.Write([]byte(strings.Join(args, " ") + "\n")); err != nil {
+		return "", err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "OK":
+		return "", nil
+	case strings.HasPrefix(line, "OK "):
+		return line[3:], nil
+	case strings.HasPrefix(line, "ER "):
+		return "", errors.New(line[3:])
+	}
+	return "", fmt.Errorf(ERR_HSM_RESPONSE, line)
+}
+
+func keyRef(key KeyRef) string {
+	return key.TerminalID + ":" + key.Type.String()
+}
@@ -0,0 +1,117 @@
+package security
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHSMOverTCP(t *testing.T) {
+	store := NewMemoryKeyStore()
+	tmk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	pik1, _ := hex.DecodeString("1C1C1C1C1C1C1C1C2A2A2A2A2A2A2A2A")
+	pik2, _ := hex.DecodeString("5E5E5E5E5E5E5E5E7A7A7A7A7A7A7A7A")
+	store.Put("T1", TMK, tmk)
+	store.Put("T1", PIK, pik1)
+	store.Put("ACQ", PIK, pik2)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewHSMServer(NewSoftHSM(store))
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err := DialHSM(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mak, _ := hex.DecodeString("1CDC70ABD616015E")
+	encrypted, _ := EncryptWithDESKey(mak, tmk, WithMode(ECB), WithPadding(NoPadding))
+	kcv, _ := CheckValue(mak)
+	ref := KeyRef{TerminalID: "T1", Type: MAK}
+	if err := client.ImportKey(KeyRef{"T1", TMK}, ref, AlgDES, encrypted, kcv); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ImportKey(KeyRef{"T1", TMK}, ref, AlgDES, encrypted, []byte{1, 2, 3, 4}); err == nil {
+		t.Error("wrong check value accepted")
+	}
+
+	remote, err := client.GenerateKCV(ref, AlgDES)
+	if err != nil || !bytes.Equal(remote, kcv) {
+		t.Error(remote, err)
+	}
+
+	mac, err := client.GenerateMAC(ref, AlgDES, []byte("0200 mac block"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ := CalcMAC(mak, []byte("0200 mac block"))
+	if !bytes.Equal(mac, local) {
+		t.Error(mac, local)
+	}
+	if ok, err := client.VerifyMAC(ref, AlgDES, []byte("0200 mac block"), mac); !ok || err != nil {
+		t.Error("valid mac rejected", err)
+	}
+
+	block, _ := EncryptPinBlock("1234", "4111111111111111", pik1)
+	translated, err := client.TranslatePIN(KeyRef{"T1", PIK}, KeyRef{"ACQ", PIK}, AlgDES, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := EncryptPinBlock("1234", "4111111111111111", pik2)
+	if !bytes.Equal(translated, expected) {
+		t.Error("translated pin block differs")
+	}
+
+	if _, err := client.GenerateKCV(KeyRef{"T9", MAK}, AlgDES); err == nil {
+		t.Error("missing key should fail")
+	}
+}
+
+// lateListener hands out one connection only after it is released, to stand
+// in for a connection accepted while Close runs.
+type lateListener struct {
+	accepting chan struct{}
+	release   chan struct{}
+	conn      net.Conn
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	close(l.accepting)
+	<-l.release
+	return l.conn, nil
+}
+
+func (l *lateListener) Close() error   { return nil }
+func (l *lateListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestHSMServerCloseDuringAccept(t *testing.T) {
+	server, peer := net.Pipe()
+	l := &lateListener{accepting: make(chan struct{}), release: make(chan struct{}), conn: server}
+	s := NewHSMServer(NewSoftHSM(NewMemoryKeyStore()))
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	<-l.accepting
+	s.Close()
+	close(l.release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Error("late connection was left open")
+	}
+}
@@ -0,0 +1,165 @@
+package security
+
+import (
+	"errors"
+	"sync"
+)
+
+// KeyType identifies a key held for a terminal.
+type KeyType int
+
+const (
+	TMK KeyType = iota
+	PIK
+	MAK
+	TDK
+)
+
+// MaxKeyVersions is how many versions of a key are kept after rotation; older
+// ones are zeroized and dropped.
+const MaxKeyVersions = 3
+
+var (
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrVersionNotFound = errors.New("key version not found")
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case TMK:
+		return "TMK"
+	case PIK:
+		return "PIK"
+	case MAK:
+		return "MAK"
+	case TDK:
+		return "TDK"
+	}
+	return "UNKNOWN"
+}
+
+// KeyStore holds clear key material per terminal and key type. Put adds a new
+// version of a key, making it current; Get returns the current version.
+type KeyStore interface {
+	Get(terminalID string, keyType KeyType) ([]byte, error)
+	Put(terminalID string, keyType KeyType, key []byte) error
+	GetVersion(terminalID string, keyType KeyType, version int) ([]byte, error)
+	Version(terminalID string, keyType KeyType) (int, error)
+	Remove(terminalID string, keyType KeyType) error
+}
+
+type keyID struct {
+	terminalID string
+	keyType    KeyType
+}
+
+type keyVersion struct {
+	version int
+	key     []byte
+}
+
+// MemoryKeyStore is a KeyStore kept in process memory.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[keyID][]keyVersion
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[keyID][]keyVersion)}
+}
+
+func (s *MemoryKeyStore) Get(terminalID string, keyType KeyType) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions, ok := s.keys[keyID{terminalID, keyType}]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), versions[len(versions)-1].key...), nil
+}
+
+func (s *MemoryKeyStore) GetVersion(terminalID string, keyType KeyType, version int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions, ok := s.keys[keyID{terminalID, keyType}]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	for _, v := range versions {
+		if v.version == version {
+			return append([]byte(nil), v.key...), nil
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+func (s *MemoryKeyStore) Version(terminalID string, keyType KeyType) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions, ok := s.keys[keyID{terminalID, keyType}]
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	return versions[len(versions)-1].version, nil
+}
+
+func (s *MemoryKeyStore) Put(terminalID string, keyType KeyType, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(keyID{terminalID, keyType}, 0, key)
+	return nil
+}
+
+func (s *MemoryKeyStore) Remove(terminalID string, keyType KeyType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(keyID{terminalID, keyType})
+}
+
+// remove zeroizes and drops every version of a key. Callers hold s.mu.
+func (s *MemoryKeyStore) remove(id keyID) error {
+	versions, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	for _, v := range versions {
+		Zeroize(v.key)
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// put stores key as version, or as the next version when version is 0, and
+// drops versions beyond MaxKeyVersions. Callers hold s.mu.
+func (s *MemoryKeyStore) put(id keyID, version int, key []byte) {
+	for _, v := range addVersion(s.keys, id, version, key) {
+		Zeroize(v.key)
+	}
+}
+
+// addVersion is put on keys. The version list is copied rather than changed
+// in place, and the versions dropped are returned for the caller to zeroize.
+func addVersion(keys map[keyID][]keyVersion, id keyID, version int, key []byte) []keyVersion {
+	versions := append([]keyVersion(nil), keys[id]...)
+	if version == 0 {
+		version = 1
+		if len(versions) > 0 {
+			version = versions[len(versions)-1].version + 1
+		}
+	}
+	versions = append(versions, keyVersion{version, append([]byte(nil), key...)})
+	var dropped []keyVersion
+	for len(versions) > MaxKeyVersions {
+		dropped = append(dropped, versions[0])
+		versions = versions[1:]
+	}
+	keys[id] = versions
+	return dropped
+}
+
+// Zeroize overwrites key material in place.
+func Zeroize(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,108 @@
+package security
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyStoreRotateAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	master := bytes.Repeat([]byte{0x11}, 32)
+
+	s, err := OpenFileKeyStore(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= MaxKeyVersions+1; i++ {
+		if err := s.Put("00003042", MAK, bytes.Repeat([]byte{i}, 8)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("00003042", TDK, bytes.Repeat([]byte{0x45}, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := ioutil.ReadFile(path)
+	if bytes.Contains(raw, []byte("0404040404040404")) {
+		t.Error("key file holds clear key material")
+	}
+
+	reloaded, err := OpenFileKeyStore(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := reloaded.Get("00003042", MAK)
+	if err != nil || !bytes.Equal(key, bytes.Repeat([]byte{4}, 8)) {
+		t.Error(key, err)
+	}
+	if v, _ := reloaded.Version("00003042", MAK); v != MaxKeyVersions+1 {
+		t.Error("version", v)
+	}
+	if _, err := reloaded.GetVersion("00003042", MAK, 1); err != ErrVersionNotFound {
+		t.Error("oldest version should be dropped", err)
+	}
+	if _, err := reloaded.GetVersion("00003042", MAK, 2); err != nil {
+		t.Error(err)
+	}
+
+	if err := reloaded.Remove("00003042", TDK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Get("00003042", TDK); err != ErrKeyNotFound {
+		t.Error(err)
+	}
+	if _, err := OpenFileKeyStore(path, bytes.Repeat([]byte{0x22}, 32)); err == nil {
+		t.Error("wrong master key should fail")
+	}
+}
+
+func TestMemoryKeyStoreZeroizeOnRemove(t *testing.T) {
+	s := NewMemoryKeyStore()
+	s.Put("T1", PIK, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	stored := s.keys[keyID{"T1", PIK}][0].key
+	if err := s.Remove("T1", PIK); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, make([]byte, 8)) {
+		t.Error("key material not zeroized", stored)
+	}
+}
+
+func TestFileKeyStoreFailedWriteKeepsKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenFileKeyStore(filepath.Join(dir, "keys.json"), bytes.Repeat([]byte{0x11}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("00003042", MAK, bytes.Repeat([]byte{1}, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	// with the directory gone every write fails
+	os.RemoveAll(dir)
+	if err := s.Put("00003042", MAK, bytes.Repeat([]byte{2}, 8)); err == nil {
+		t.Fatal("put should fail")
+	}
+	if err := s.Remove("00003042", MAK); err == nil {
+		t.Fatal("remove should fail")
+	}
+	key, err := s.Get("00003042", MAK)
+	if err != nil || !bytes.Equal(key, bytes.Repeat([]byte{1}, 8)) {
+		t.Error(key, err)
+	}
+	if v, _ := s.Version("00003042", MAK); v != 1 {
+		t.Error("version", v)
+	}
+}
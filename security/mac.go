@@ -0,0 +1,75 @@
+package security
+
+import (
+	"8583/utils"
+	"bytes"
+	"errors"
+)
+
+const (
+	ERR_CHECK_VALUE_MISMATCH string = "key check value mismatch"
+)
+
+// CalcMAC computes the CUP "ECB" MAC of mab: the blocks are XORed together,
+// the hex form of the result is encrypted in two halves with mak and the
+// first 8 hex characters of the final block are returned.
+func CalcMAC(mak, mab []byte) ([]byte, error) {
+	if len(mak) != 8 {
+		return nil, errors.New("input MAK must has 8 bytes")
+	}
+	if len(mab) <= 0 {
+		return nil, errors.New("input mab should not be empty")
+	}
+
+	mab = ZeroPadding(append([]byte(nil), mab...), 8)
+
+	n := len(mab) / 8
+	result := make([]byte, 8)
+	copy(result, mab[:8])
+	for i := 1; i < n; i++ {
+		for j := 0; j < 8; j++ {
+			result[j] = result[j] ^ mab[i*8+j]
+		}
+	}
+
+	hexDecBytes := []byte(utils.EncodeToString(result))
+	var err error
+	result, err = EncryptWithDESKey(hexDecBytes[:8], mak, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 8; i++ {
+		result[i] = byte(result[i] ^ hexDecBytes[8+i])
+	}
+	result, err = EncryptWithDESKey(result, mak, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+
+	hexDecBytes = []byte(utils.EncodeToString(result))
+	return hexDecBytes[:8], nil
+}
+
+// CheckValue returns the 4 byte key check value of a DES/3DES key: the
+// leading bytes of eight zero bytes encrypted under the key.
+func CheckValue(key []byte) ([]byte, error) {
+	out, err := EncryptWithDESKey(make([]byte, 8), key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return nil, err
+	}
+	return out[:4], nil
+}
+
+// VerifyCheckValue compares the check value of key against kcv, using as many
+// bytes as kcv has.
+func VerifyCheckValue(key, kcv []byte) error {
+	out, err := EncryptWithDESKey(make([]byte, 8), key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		return err
+	}
+	if len(kcv) == 0 || len(kcv) > len(out) || !bytes.Equal(out[:len(kcv)], kcv) {
+		return errors.New(ERR_CHECK_VALUE_MISMATCH)
+	}
+	return nil
+}
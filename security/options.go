@@ -0,0 +1,114 @@
+package security
+
+import (
+	"errors"
+)
+
+// Mode is the block cipher mode of operation.
+type Mode int
+
+const (
+	CBC Mode = iota
+	ECB
+)
+
+// Padding is the scheme used to fill the last block.
+type Padding int
+
+const (
+	PKCS5 Padding = iota
+	NoPadding
+	Zero
+	ISO9797M2
+)
+
+// Options controls how the cipher helpers encrypt and decrypt. The zero value
+// keeps the historical behaviour: CBC, PKCS5 padding and the first 8 bytes of
+// the key as IV.
+type Options struct {
+	Mode    Mode
+	Padding Padding
+	IV      []byte
+
+	ivSet  bool
+	zeroIV bool
+}
+
+type Option func(*Options)
+
+func WithMode(mode Mode) Option {
+	return func(o *Options) {
+		o.Mode = mode
+	}
+}
+
+func WithPadding(padding Padding) Option {
+	return func(o *Options) {
+		o.Padding = padding
+	}
+}
+
+// WithIV sets an explicit CBC initialisation vector. It must be one block
+// long; a nil or empty iv is an error, not a fall back to the key.
+func WithIV(iv []byte) Option {
+	return func(o *Options) {
+		o.IV = iv
+		o.ivSet = true
+		o.zeroIV = false
+	}
+}
+
+// WithZeroIV uses an all-zero CBC initialisation vector.
+func WithZeroIV() Option {
+	return func(o *Options) {
+		o.IV = nil
+		o.ivSet = false
+		o.zeroIV = true
+	}
+}
+
+func newOptions(opts []Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *Options) iv(keyIV []byte, size int) ([]byte, error) {
+	switch {
+	case o.zeroIV:
+		return make([]byte, size), nil
+	case o.IV == nil && !o.ivSet:
+		return keyIV[:size], nil
+	case len(o.IV) != size:
+		return nil, errors.New(ERR_INVALID_IV_LENGTH)
+	}
+	return o.IV, nil
+}
+
+func (p Padding) pad(data []byte, blockSize int) []byte {
+	switch p {
+	case NoPadding:
+		return data
+	case Zero:
+		return ZeroPadding(data, blockSize)
+	case ISO9797M2:
+		return ISO9797M2Padding(data, blockSize)
+	default:
+		return PKCS5Padding(data, blockSize)
+	}
+}
+
+func (p Padding) unpad(data []byte, blockSize int) ([]byte, error) {
+	switch p {
+	case NoPadding:
+		return data, nil
+	case Zero:
+		return ZeroUnPadding(data)
+	case ISO9797M2:
+		return ISO9797M2UnPadding(data)
+	default:
+		return PKCS5UnPadding(data, blockSize)
+	}
+}
@@ -0,0 +1,48 @@
+package security
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	ERR_INVALID_PIN string = "pin must have 4 to 12 digits"
+	ERR_INVALID_PAN string = "pan must have at least 13 digits"
+)
+
+// EncryptPinBlock builds an ISO 9564 format 0 (ANSI X9.8) PIN block for pin
+// and pan and encrypts it under pik.
+func EncryptPinBlock(pin, pan string, pik []byte) ([]byte, error) {
+	block, err := PinBlock(pin, pan)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptWithDESKey(block, pik, WithMode(ECB), WithPadding(NoPadding))
+}
+
+// PinBlock returns the clear ISO 9564 format 0 PIN block.
+func PinBlock(pin, pan string) ([]byte, error) {
+	if len(pin) < 4 || len(pin) > 12 || strings.Trim(pin, "0123456789") != "" {
+		return nil, errors.New(ERR_INVALID_PIN)
+	}
+	if len(pan) < 13 || strings.Trim(pan, "0123456789") != "" {
+		return nil, errors.New(ERR_INVALID_PAN)
+	}
+
+	pinField, err := hex.DecodeString((fmt.Sprintf("0%X", len(pin)) + pin + strings.Repeat("F", 14))[:16])
+	if err != nil {
+		return nil, err
+	}
+	// twelve rightmost digits excluding the check digit
+	panField, err := hex.DecodeString("0000" + pan[len(pan)-13:len(pan)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pinField {
+		pinField[i] ^= panField[i]
+	}
+	return pinField, nil
+}
@@ -0,0 +1,343 @@
+package security
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// SM2 (GB/T 32918-2016) on the recommended sm2p256v1 curve. Point and
+// scalar arithmetic on private data is constant time (see sm2_field.go); the
+// generic elliptic.CurveParams methods are not, and are not used.
+
+const SM2DefaultUID = "1234567812345678"
+
+const (
+	ERR_SM2_INVALID_KEY   string = "invalid SM2 public key"
+	ERR_SM2_INVALID_PRIV  string = "invalid SM2 private key"
+	ERR_SM2_KEY_EXCHANGE  string = "SM2 key exchange produced the point at infinity"
+	ERR_SM2_CONFIRMATION  string = "SM2 key confirmation mismatch"
+	ERR_SM2_UID_TOO_LONG  string = "SM2 user id is too long"
+	ERR_SM2_RANDOM_FAILED string = "SM2 could not draw a usable random scalar"
+)
+
+var (
+	sm2Once   sync.Once
+	sm2Params *elliptic.CurveParams
+	sm2A      *big.Int
+)
+
+// SM2Curve returns the sm2p256v1 curve parameters. Its elliptic.Curve
+// methods are the generic, variable time ones: use it for the parameters
+// only, never for arithmetic on private keys.
+func SM2Curve() elliptic.Curve {
+	sm2Once.Do(func() {
+		sm2Params = &elliptic.CurveParams{Name: "SM2-P-256", BitSize: 256}
+		sm2Params.P, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF00000000FFFFFFFFFFFFFFFF", 16)
+		sm2Params.N, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFF7203DF6B21C6052B53BBF40939D54123", 16)
+		sm2Params.B, _ = new(big.Int).SetString("28E9FA9E9D9F5E344D5A9E4BCF6509A7F39789F515AB8F92DDBCBD414D940E93", 16)
+		sm2Params.Gx, _ = new(big.Int).SetString("32C4AE2C1F1981195F9904466A39C9948FE30BBFF2660BE1715A4589334C74C7", 16)
+		sm2Params.Gy, _ = new(big.Int).SetString("BC3736A2F4F6779C59BDCEE36B692153D0A9877CC62A474002DF32E52139F0A0", 16)
+		sm2A = new(big.Int).Sub(sm2Params.P, big.NewInt(3))
+		initSM2Arith(sm2Params)
+	})
+	return sm2Params
+}
+
+type SM2PublicKey struct {
+	X, Y *big.Int
+}
+
+type SM2PrivateKey struct {
+	SM2PublicKey
+	D *big.Int
+}
+
+// GenerateSM2Key creates a key pair with d in [1, n-2].
+func GenerateSM2Key(rand io.Reader) (*SM2PrivateKey, error) {
+	curve := SM2Curve()
+	d, err := randScalar(rand, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	priv := &SM2PrivateKey{D: d}
+	g := sm2ScalarMult(&sm2Gen, fixed32(d))
+	priv.X, priv.Y = g.affine()
+	return priv, nil
+}
+
+// Bytes returns the uncompressed point encoding 04 || X || Y.
+func (pub *SM2PublicKey) Bytes() []byte {
+	return append(append([]byte{4}, fixed32(pub.X)...), fixed32(pub.Y)...)
+}
+
+// ParseSM2PublicKey parses an uncompressed point and checks it is on the curve.
+func ParseSM2PublicKey(data []byte) (*SM2PublicKey, error) {
+	if len(data) != 65 || data[0] != 4 {
+		return nil, errors.New(ERR_SM2_INVALID_KEY)
+	}
+	x := new(big.Int).SetBytes(data[1:33])
+	y := new(big.Int).SetBytes(data[33:])
+	if !sm2OnCurve(x, y) {
+		return nil, errors.New(ERR_SM2_INVALID_KEY)
+	}
+	return &SM2PublicKey{X: x, Y: y}, nil
+}
+
+// SM2Z computes Z = SM3(ENTL || ID || a || b || Gx || Gy || x || y), the
+// hash binding a user's identity to their public key.
+func SM2Z(uid []byte, pub *SM2PublicKey) ([]byte, error) {
+	if len(uid) > 8191 {
+		return nil, errors.New(ERR_SM2_UID_TOO_LONG)
+	}
+	params := SM2Curve().Params()
+	h := NewSM3()
+	var entl [2]byte
+	binary.BigEndian.PutUint16(entl[:], uint16(len(uid)*8))
+	h.Write(entl[:])
+	h.Write(uid)
+	for _, v := range []*big.Int{sm2A, params.B, params.Gx, params.Gy, pub.X, pub.Y} {
+		h.Write(fixed32(v))
+	}
+	return h.Sum(nil), nil
+}
+
+// SM2Sign signs msg for the user uid, returning (r, s).
+func SM2Sign(rand io.Reader, priv *SM2PrivateKey, uid, msg []byte) (r, s *big.Int, err error) {
+	e, err := sm2Digest(&priv.SM2PublicKey, uid, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := SM2Curve().Params().N
+	if priv.D.Sign() <= 0 || priv.D.Cmp(n) >= 0 {
+		return nil, nil, errors.New(ERR_SM2_INVALID_PRIV)
+	}
+	fn := sm2FieldN
+	d := fn.toMont(sm2ElemFromBig(priv.D))
+	d1 := fn.add(d, fn.one)
+	if fn.isZero(d1) == 1 {
+		return nil, nil, errors.New(ERR_SM2_INVALID_PRIV)
+	}
+	dInv := fn.inv(d1)
+
+	for {
+		k, err := randScalar(rand, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		kb := fixed32(k)
+		p := sm2ScalarMult(&sm2Gen, kb)
+		x1, _ := p.affine()
+		r = new(big.Int).Add(e, x1)
+		r.Mod(r, n)
+		km := fn.toMont(sm2ElemFromBytes(kb))
+		rm := fn.toMont(sm2ElemFromBig(r))
+		if r.Sign() == 0 || fn.isZero(fn.add(rm, km)) == 1 {
+			continue
+		}
+		// s = (1 + d)^-1 * (k - r * d) mod n
+		sm := fn.fromMont(fn.mul(fn.sub(km, fn.mul(rm, d)), dInv))
+		s = new(big.Int).SetBytes(sm.bytes())
+		if s.Sign() != 0 {
+			return r, s, nil
+		}
+	}
+}
+
+// SM2Verify checks an SM2 signature of msg by the user uid.
+func SM2Verify(pub *SM2PublicKey, uid, msg []byte, r, s *big.Int) bool {
+	n := SM2Curve().Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return false
+	}
+	if !sm2OnCurve(pub.X, pub.Y) {
+		return false
+	}
+	e, err := sm2Digest(pub, uid, msg)
+	if err != nil {
+		return false
+	}
+	t := new(big.Int).Add(r, s)
+	t.Mod(t, n)
+	if t.Sign() == 0 {
+		return false
+	}
+	sg := sm2ScalarMult(&sm2Gen, fixed32(s))
+	p := sm2PointFromAffine(pub.X, pub.Y)
+	tp := sm2ScalarMult(&p, fixed32(t))
+	sum := sm2PointAdd(&sg, &tp)
+	x, _ := sum.affine()
+	x.Add(x, e)
+	x.Mod(x, n)
+	return x.Cmp(r) == 0
+}
+
+// SM2KeyExchange is one side of an SM2 key agreement. Each party keeps its
+// static key and a fresh ephemeral key; the ephemeral public keys and user
+// ids are exchanged out of band.
+type SM2KeyExchange struct {
+	Initiator bool
+	Static    *SM2PrivateKey
+	Ephemeral *SM2PrivateKey
+	UID       []byte
+}
+
+// SM2AgreedKey is the result of a key agreement: the shared key and the
+// confirmation values this side sends (Own) and expects from the peer (Peer).
+type SM2AgreedKey struct {
+	Key  []byte
+	Own  []byte
+	Peer []byte
+}
+
+// Agree derives klen bytes of shared key material from the peer's static and
+// ephemeral public keys.
+func (x *SM2KeyExchange) Agree(peerStatic, peerEphemeral *SM2PublicKey, peerUID []byte, klen int) (*SM2AgreedKey, error) {
+	n := SM2Curve().Params().N
+	if !sm2OnCurve(peerEphemeral.X, peerEphemeral.Y) || !sm2OnCurve(peerStatic.X, peerStatic.Y) {
+		return nil, errors.New(ERR_SM2_INVALID_KEY)
+	}
+	if x.Static.D.Sign() <= 0 || x.Static.D.Cmp(n) >= 0 || x.Ephemeral.D.Sign() <= 0 || x.Ephemeral.D.Cmp(n) >= 0 {
+		return nil, errors.New(ERR_SM2_INVALID_PRIV)
+	}
+
+	// t = (d + x̄ * r) mod n
+	fn := sm2FieldN
+	tm := fn.mul(fn.toMont(sm2ElemFromBig(sm2XBar(x.Ephemeral.X))), fn.toMont(sm2ElemFromBig(x.Ephemeral.D)))
+	tm = fn.add(tm, fn.toMont(sm2ElemFromBig(x.Static.D)))
+	t := fn.fromMont(tm)
+
+	// V = t * (P + x̄2 * R), cofactor is 1
+	peerR := sm2PointFromAffine(peerEphemeral.X, peerEphemeral.Y)
+	peerP := sm2PointFromAffine(peerStatic.X, peerStatic.Y)
+	q := sm2ScalarMult(&peerR, fixed32(sm2XBar(peerEphemeral.X)))
+	q = sm2PointAdd(&peerP, &q)
+	v := sm2ScalarMult(&q, t.bytes())
+	vx, vy := v.affine()
+	if vx.Sign() == 0 && vy.Sign() == 0 {
+		return nil, errors.New(ERR_SM2_KEY_EXCHANGE)
+	}
+
+	ownZ, err := SM2Z(x.UID, &x.Static.SM2PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	peerZ, err := SM2Z(peerUID, peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	za, zb := ownZ, peerZ
+	ra, rb := &x.Ephemeral.SM2PublicKey, peerEphemeral
+	if !x.Initiator {
+		za, zb = peerZ, ownZ
+		ra, rb = peerEphemeral, &x.Ephemeral.SM2PublicKey
+	}
+
+	var kdfInput []byte
+	kdfInput = append(kdfInput, fixed32(vx)...)
+	kdfInput = append(kdfInput, fixed32(vy)...)
+	kdfInput = append(kdfInput, za...)
+	kdfInput = append(kdfInput, zb...)
+	agreed := &SM2AgreedKey{Key: SM2KDF(kdfInput, klen)}
+
+	inner := NewSM3()
+	inner.Write(fixed32(vx))
+	inner.Write(za)
+	inner.Write(zb)
+	for _, v := range []*big.Int{ra.X, ra.Y, rb.X, rb.Y} {
+		inner.Write(fixed32(v))
+	}
+	innerSum := inner.Sum(nil)
+	s2 := SM3Sum(append(append([]byte{0x02}, fixed32(vy)...), innerSum...))
+	s3 := SM3Sum(append(append([]byte{0x03}, fixed32(vy)...), innerSum...))
+	// the responder sends S_B (0x02), the initiator answers with S_A (0x03)
+	if x.Initiator {
+		agreed.Own, agreed.Peer = s3, s2
+	} else {
+		agreed.Own, agreed.Peer = s2, s3
+	}
+	return agreed, nil
+}
+
+// Confirm checks the confirmation value received from the peer.
+func (k *SM2AgreedKey) Confirm(peer []byte) error {
+	if !bytes.Equal(k.Peer, peer) {
+		return errors.New(ERR_SM2_CONFIRMATION)
+	}
+	return nil
+}
+
+// SM2KDF is the SM3 based key derivation function of GB/T 32918.
+func SM2KDF(z []byte, klen int) []byte {
+	out := make([]byte, 0, klen+SM3Size)
+	var ct [4]byte
+	for i := uint32(1); len(out) < klen; i++ {
+		binary.BigEndian.PutUint32(ct[:], i)
+		h := NewSM3()
+		h.Write(z)
+		h.Write(ct[:])
+		out = h.Sum(out)
+	}
+	return out[:klen]
+}
+
+func sm2Digest(pub *SM2PublicKey, uid, msg []byte) (*big.Int, error) {
+	z, err := SM2Z(uid, pub)
+	if err != nil {
+		return nil, err
+	}
+	h := NewSM3()
+	h.Write(z)
+	h.Write(msg)
+	return new(big.Int).SetBytes(h.Sum(nil)), nil
+}
+
+// sm2OnCurve reports whether (x, y) is an affine point of sm2p256v1:
+// y^2 = x^3 - 3x + b mod p. Points are public, so big.Int arithmetic is fine.
+func sm2OnCurve(x, y *big.Int) bool {
+	params := SM2Curve().Params()
+	p := params.P
+	if x == nil || y == nil || x.Sign() < 0 || x.Cmp(p) >= 0 || y.Sign() < 0 || y.Cmp(p) >= 0 {
+		return false
+	}
+	y2 := new(big.Int).Mul(y, y)
+	y2.Mod(y2, p)
+	x3 := new(big.Int).Mul(x, x)
+	x3.Mul(x3, x)
+	x3.Add(x3, new(big.Int).Mul(sm2A, x))
+	x3.Add(x3, params.B)
+	x3.Mod(x3, p)
+	return x3.Cmp(y2) == 0
+}
+
+// sm2XBar is 2^w + (x mod 2^w) with w = 127 for a 256 bit order.
+func sm2XBar(x *big.Int) *big.Int {
+	w := uint(127)
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), w), big.NewInt(1))
+	out := new(big.Int).And(x, mask)
+	return out.SetBit(out, int(w), 1)
+}
+
+// randScalar returns a uniform value in [1, max-1].
+func randScalar(rand io.Reader, max *big.Int) (*big.Int, error) {
+	buf := make([]byte, (max.BitLen()+7)/8)
+	for i := 0; i < 100; i++ {
+		if _, err := io.ReadFull(rand, buf); err != nil {
+			return nil, err
+		}
+		k := new(big.Int).SetBytes(buf)
+		if k.Sign() > 0 && k.Cmp(max) < 0 {
+			return k, nil
+		}
+	}
+	return nil, errors.New(ERR_SM2_RANDOM_FAILED)
+}
+
+func fixed32(v *big.Int) []byte {
+	out := make([]byte, 32)
+	return v.FillBytes(out)
+}
@@ -0,0 +1,283 @@
+package security
+
+import (
+	"crypto/elliptic"
+	"crypto/subtle"
+	"math/big"
+	"math/bits"
+)
+
+// Constant time arithmetic for SM2. Field elements and scalars are kept in
+// Montgomery form on four 64 bit limbs, least significant first; points use
+// projective coordinates and the complete addition formulas for a = -3 of
+// Renes, Costello and Batina ("Complete addition formulas for prime order
+// elliptic curves", 2015), so no operation branches on secret data.
+
+type sm2Elem [4]uint64
+
+// sm2Field is arithmetic modulo an odd 256 bit m.
+type sm2Field struct {
+	m     sm2Elem
+	m0inv uint64  // -m^-1 mod 2^64
+	rr    sm2Elem // R^2 mod m, R = 2^256
+	one   sm2Elem // R mod m
+	exp   []byte  // m - 2, for inversion
+}
+
+func newSM2Field(m *big.Int) *sm2Field {
+	f := &sm2Field{m: sm2ElemFromBig(m)}
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - f.m[0]*inv
+	}
+	f.m0inv = -inv
+	r := new(big.Int).Lsh(big.NewInt(1), 256)
+	f.one = sm2ElemFromBig(new(big.Int).Mod(r, m))
+	f.rr = sm2ElemFromBig(new(big.Int).Mod(new(big.Int).Mul(r, r), m))
+	f.exp = new(big.Int).Sub(m, big.NewInt(2)).Bytes()
+	return f
+}
+
+func sm2ElemFromBig(v *big.Int) sm2Elem {
+	return sm2ElemFromBytes(fixed32(v))
+}
+
+// sm2ElemFromBytes reads 32 big endian bytes.
+func sm2ElemFromBytes(b []byte) sm2Elem {
+	var e sm2Elem
+	for i := 0; i < 4; i++ {
+		for _, c := range b[24-8*i : 32-8*i] {
+			e[i] = e[i]<<8 | uint64(c)
+		}
+	}
+	return e
+}
+
+func (e *sm2Elem) bytes() []byte {
+	out := make([]byte, 32)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 8; j++ {
+			out[31-8*i-j] = byte(e[i] >> (8 * uint(j)))
+		}
+	}
+	return out
+}
+
+// reduce returns t - m if t >= m, else t; t has a fifth limb hi.
+func (f *sm2Field) reduce(t sm2Elem, hi uint64) sm2Elem {
+	var d sm2Elem
+	var b uint64
+	for i := 0; i < 4; i++ {
+		d[i], b = bits.Sub64(t[i], f.m[i], b)
+	}
+	_, b = bits.Sub64(hi, 0, b)
+	keep := -b
+	for i := 0; i < 4; i++ {
+		d[i] = t[i]&keep | d[i]&^keep
+	}
+	return d
+}
+
+func (f *sm2Field) add(x, y sm2Elem) sm2Elem {
+	var t sm2Elem
+	var c uint64
+	for i := 0; i < 4; i++ {
+		t[i], c = bits.Add64(x[i], y[i], c)
+	}
+	return f.reduce(t, c)
+}
+
+func (f *sm2Field) sub(x, y sm2Elem) sm2Elem {
+	var t sm2Elem
+	var b uint64
+	for i := 0; i < 4; i++ {
+		t[i], b = bits.Sub64(x[i], y[i], b)
+	}
+	mask := -b
+	var c uint64
+	for i := 0; i < 4; i++ {
+		t[i], c = bits.Add64(t[i], f.m[i]&mask, c)
+	}
+	return t
+}
+
+// mul returns x * y / R mod m (CIOS Montgomery multiplication).
+func (f *sm2Field) mul(x, y sm2Elem) sm2Elem {
+	var t [6]uint64
+	for i := 0; i < 4; i++ {
+		var c uint64
+		for j := 0; j < 4; j++ {
+			hi, lo := bits.Mul64(x[j], y[i])
+			var cc uint64
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j], c = lo, hi
+		}
+		var cc uint64
+		t[4], cc = bits.Add64(t[4], c, 0)
+		t[5] = cc
+
+		q := t[0] * f.m0inv
+		hi, lo := bits.Mul64(q, f.m[0])
+		_, cc = bits.Add64(lo, t[0], 0)
+		c = hi + cc
+		for j := 1; j < 4; j++ {
+			hi, lo = bits.Mul64(q, f.m[j])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j-1], c = lo, hi
+		}
+		t[3], cc = bits.Add64(t[4], c, 0)
+		t[4] = t[5] + cc
+	}
+	return f.reduce(sm2Elem{t[0], t[1], t[2], t[3]}, t[4])
+}
+
+// toMont converts a value below 2^256 into Montgomery form, reducing it.
+func (f *sm2Field) toMont(x sm2Elem) sm2Elem {
+	return f.mul(x, f.rr)
+}
+
+func (f *sm2Field) fromMont(x sm2Elem) sm2Elem {
+	return f.mul(x, sm2Elem{1})
+}
+
+// inv returns x^(m-2), the inverse of x for prime m and 0 for 0. The
+// exponent is public, so the sequence of operations is fixed.
+func (f *sm2Field) inv(x sm2Elem) sm2Elem {
+	z := f.one
+	for _, b := range f.exp {
+		for i := 7; i >= 0; i-- {
+			z = f.mul(z, z)
+			if b>>uint(i)&1 == 1 {
+				z = f.mul(z, x)
+			}
+		}
+	}
+	return z
+}
+
+// isZero returns 1 if x is 0 and 0 otherwise.
+func (f *sm2Field) isZero(x sm2Elem) int {
+	v := x[0] | x[1] | x[2] | x[3]
+	return int(1 ^ (v|-v)>>63)
+}
+
+// sm2Point is a projective point (X:Y:Z) on sm2p256v1 in Montgomery form;
+// the point at infinity is (0:1:0).
+type sm2Point struct {
+	x, y, z sm2Elem
+}
+
+var (
+	sm2FieldP *sm2Field
+	sm2FieldN *sm2Field
+	sm2MontB  sm2Elem
+	sm2Gen    sm2Point
+)
+
+// initSM2Arith sets up the fields and constants; SM2Curve runs it once.
+func initSM2Arith(params *elliptic.CurveParams) {
+	sm2FieldP = newSM2Field(params.P)
+	sm2FieldN = newSM2Field(params.N)
+	sm2MontB = sm2FieldP.toMont(sm2ElemFromBig(params.B))
+	sm2Gen = sm2PointFromAffine(params.Gx, params.Gy)
+}
+
+func sm2Infinity() sm2Point {
+	return sm2Point{y: sm2FieldP.one}
+}
+
+func sm2PointFromAffine(x, y *big.Int) sm2Point {
+	f := sm2FieldP
+	return sm2Point{x: f.toMont(sm2ElemFromBig(x)), y: f.toMont(sm2ElemFromBig(y)), z: f.one}
+}
+
+// affine returns the affine coordinates of p, (0, 0) for the point at
+// infinity.
+func (p *sm2Point) affine() (x, y *big.Int) {
+	f := sm2FieldP
+	zinv := f.inv(p.z)
+	xe, ye := f.fromMont(f.mul(p.x, zinv)), f.fromMont(f.mul(p.y, zinv))
+	return new(big.Int).SetBytes(xe.bytes()), new(big.Int).SetBytes(ye.bytes())
+}
+
+// sm2PointAdd returns p + q; it also doubles, as the formulas are complete.
+func sm2PointAdd(p, q *sm2Point) sm2Point {
+	f := sm2FieldP
+	t0 := f.mul(p.x, q.x)
+	t1 := f.mul(p.y, q.y)
+	t2 := f.mul(p.z, q.z)
+	t3 := f.mul(f.add(p.x, p.y), f.add(q.x, q.y))
+	t3 = f.sub(t3, f.add(t0, t1))
+	t4 := f.mul(f.add(p.y, p.z), f.add(q.y, q.z))
+	t4 = f.sub(t4, f.add(t1, t2))
+	x3 := f.mul(f.add(p.x, p.z), f.add(q.x, q.z))
+	y3 := f.sub(x3, f.add(t0, t2))
+	z3 := f.mul(sm2MontB, t2)
+	x3 = f.sub(y3, z3)
+	z3 = f.add(x3, x3)
+	x3 = f.add(x3, z3)
+	z3 = f.sub(t1, x3)
+	x3 = f.add(t1, x3)
+	y3 = f.mul(sm2MontB, y3)
+	t1 = f.add(t2, t2)
+	t2 = f.add(t1, t2)
+	y3 = f.sub(y3, t2)
+	y3 = f.sub(y3, t0)
+	t1 = f.add(y3, y3)
+	y3 = f.add(t1, y3)
+	t1 = f.add(t0, t0)
+	t0 = f.add(t1, t0)
+	t0 = f.sub(t0, t2)
+	t1 = f.mul(t4, y3)
+	t2 = f.mul(t0, y3)
+	y3 = f.mul(x3, z3)
+	y3 = f.add(y3, t2)
+	x3 = f.mul(t3, x3)
+	x3 = f.sub(x3, t1)
+	z3 = f.mul(t4, z3)
+	t1 = f.mul(t3, t0)
+	z3 = f.add(z3, t1)
+	return sm2Point{x3, y3, z3}
+}
+
+// sm2ScalarMult returns k * p for a 32 byte big endian k, with a fixed 4 bit
+// window and table lookups that touch every entry.
+func sm2ScalarMult(p *sm2Point, k []byte) sm2Point {
+	var table [16]sm2Point
+	table[0] = sm2Infinity()
+	table[1] = *p
+	for i := 2; i < 16; i++ {
+		table[i] = sm2PointAdd(&table[i-1], p)
+	}
+
+	r := sm2Infinity()
+	for _, b := range k {
+		for _, w := range [2]byte{b >> 4, b & 0x0F} {
+			for i := 0; i < 4; i++ {
+				r = sm2PointAdd(&r, &r)
+			}
+			sel := sm2Select(&table, w)
+			r = sm2PointAdd(&r, &sel)
+		}
+	}
+	return r
+}
+
+func sm2Select(table *[16]sm2Point, w byte) sm2Point {
+	var out sm2Point
+	for i := range table {
+		mask := -uint64(subtle.ConstantTimeByteEq(byte(i), w))
+		for j := 0; j < 4; j++ {
+			out.x[j] |= table[i].x[j] & mask
+			out.y[j] |= table[i].y[j] & mask
+			out.z[j] |= table[i].z[j] & mask
+		}
+	}
+	return out
+}
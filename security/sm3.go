@@ -0,0 +1,136 @@
+package security
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// SM3 (GB/T 32905-2016) cryptographic hash with a 256 bit digest.
+const (
+	SM3Size      = 32
+	SM3BlockSize = 64
+)
+
+var sm3IV = [8]uint32{0x7380166f, 0x4914b2b9, 0x172442d7, 0xda8a0600, 0xa96f30bc, 0x163138aa, 0xe38dee4d, 0xb0fb0e4e}
+
+type sm3Digest struct {
+	v   [8]uint32
+	buf []byte
+	len uint64
+}
+
+// NewSM3 returns a hash.Hash computing SM3.
+func NewSM3() hash.Hash {
+	d := &sm3Digest{}
+	d.Reset()
+	return d
+}
+
+// SM3Sum returns the SM3 digest of data.
+func SM3Sum(data []byte) []byte {
+	d := NewSM3()
+	d.Write(data)
+	return d.Sum(nil)
+}
+
+func (d *sm3Digest) Reset() {
+	d.v = sm3IV
+	d.buf = d.buf[:0]
+	d.len = 0
+}
+
+func (d *sm3Digest) Size() int {
+	return SM3Size
+}
+
+func (d *sm3Digest) BlockSize() int {
+	return SM3BlockSize
+}
+
+func (d *sm3Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	d.buf = append(d.buf, p...)
+	for len(d.buf) >= SM3BlockSize {
+		d.compress(d.buf[:SM3BlockSize])
+		d.buf = d.buf[SM3BlockSize:]
+	}
+	d.buf = append([]byte(nil), d.buf...)
+	return n, nil
+}
+
+func (d *sm3Digest) Sum(in []byte) []byte {
+	c := *d
+	c.buf = append([]byte(nil), d.buf...)
+	bitLen := c.len * 8
+	pad := append([]byte{0x80}, make([]byte, (SM3BlockSize*2-9-len(c.buf)%SM3BlockSize)%SM3BlockSize)...)
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], bitLen)
+	c.Write(pad)
+	c.Write(length[:])
+
+	out := make([]byte, SM3Size)
+	for i, v := range c.v {
+		binary.BigEndian.PutUint32(out[4*i:], v)
+	}
+	return append(in, out...)
+}
+
+func (d *sm3Digest) compress(block []byte) {
+	var w [68]uint32
+	var w1 [64]uint32
+	for j := 0; j < 16; j++ {
+		w[j] = binary.BigEndian.Uint32(block[4*j:])
+	}
+	for j := 16; j < 68; j++ {
+		w[j] = sm3P1(w[j-16]^w[j-9]^bits.RotateLeft32(w[j-3], 15)) ^ bits.RotateLeft32(w[j-13], 7) ^ w[j-6]
+	}
+	for j := 0; j < 64; j++ {
+		w1[j] = w[j] ^ w[j+4]
+	}
+
+	a, b, c, dd, e, f, g, h := d.v[0], d.v[1], d.v[2], d.v[3], d.v[4], d.v[5], d.v[6], d.v[7]
+	for j := 0; j < 64; j++ {
+		t := uint32(0x79cc4519)
+		if j >= 16 {
+			t = 0x7a879d8a
+		}
+		ss1 := bits.RotateLeft32(bits.RotateLeft32(a, 12)+e+bits.RotateLeft32(t, j%32), 7)
+		ss2 := ss1 ^ bits.RotateLeft32(a, 12)
+		var ff, gg uint32
+		if j < 16 {
+			ff = a ^ b ^ c
+			gg = e ^ f ^ g
+		} else {
+			ff = (a & b) | (a & c) | (b & c)
+			gg = (e & f) | (^e & g)
+		}
+		tt1 := ff + dd + ss2 + w1[j]
+		tt2 := gg + h + ss1 + w[j]
+		dd = c
+		c = bits.RotateLeft32(b, 9)
+		b = a
+		a = tt1
+		h = g
+		g = bits.RotateLeft32(f, 19)
+		f = e
+		e = sm3P0(tt2)
+	}
+	d.v[0] ^= a
+	d.v[1] ^= b
+	d.v[2] ^= c
+	d.v[3] ^= dd
+	d.v[4] ^= e
+	d.v[5] ^= f
+	d.v[6] ^= g
+	d.v[7] ^= h
+}
+
+func sm3P0(x uint32) uint32 {
+	return x ^ bits.RotateLeft32(x, 9) ^ bits.RotateLeft32(x, 17)
+}
+
+func sm3P1(x uint32) uint32 {
+	return x ^ bits.RotateLeft32(x, 15) ^ bits.RotateLeft32(x, 23)
+}
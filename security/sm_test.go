@@ -0,0 +1,205 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"8583/utils"
+)
+
+func TestSM3Vectors(t *testing.T) {
+	if out := hex.EncodeToString(SM3Sum([]byte("abc"))); out != "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0" {
+		t.Error(out)
+	}
+	long := bytes.Repeat([]byte("abcd"), 16)
+	if out := hex.EncodeToString(SM3Sum(long)); out != "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732" {
+		t.Error(out)
+	}
+}
+
+func TestSM4Vectors(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	out, err := SM4Encrypt(key, key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.EncodeToString(out) != "681EDF34D206965E86B3E94F536E4246" {
+		t.Error(utils.EncodeToString(out))
+	}
+	plain, err := SM4Decrypt(out, key, WithMode(ECB), WithPadding(NoPadding))
+	if err != nil || !bytes.Equal(plain, key) {
+		t.Error(plain, err)
+	}
+
+	block, _ := NewSM4Cipher(key)
+	data := append([]byte(nil), key...)
+	for i := 0; i < 1000000; i++ {
+		block.Encrypt(data, data)
+	}
+	if utils.EncodeToString(data) != "595298C7C6FD271F0402F804C33D3F66" {
+		t.Error(utils.EncodeToString(data))
+	}
+}
+
+func TestSM2SignVerify(t *testing.T) {
+	priv, err := GenerateSM2Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := []byte(SM2DefaultUID)
+	r, s, err := SM2Sign(rand.Reader, priv, uid, []byte("TMK component"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !SM2Verify(&priv.SM2PublicKey, uid, []byte("TMK component"), r, s) {
+		t.Error("valid signature rejected")
+	}
+	if SM2Verify(&priv.SM2PublicKey, uid, []byte("TMK componenT"), r, s) {
+		t.Error("signature over other message accepted")
+	}
+	pub, err := ParseSM2PublicKey(priv.Bytes())
+	if err != nil || pub.X.Cmp(priv.X) != 0 {
+		t.Error(err)
+	}
+}
+
+// TestSM2Vectors checks the sm2p256v1 signature example of GB/T 32918.2
+// (GM/T 0003.2) Appendix A: the public key of d and the signature of
+// "message digest" with uid 1234567812345678 and the given k.
+func TestSM2Vectors(t *testing.T) {
+	d, _ := new(big.Int).SetString("3945208F7B2144B13F36E38AC6D39F95889393692860B51A42FB81EF4DF7C5B8", 16)
+	priv, err := GenerateSM2Key(bytes.NewReader(d.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := hex.EncodeToString(fixed32(priv.X)); x != "09f9df311e5421a150dd7d161e4bc5c672179fad1833fc076bb08ff356f35020" {
+		t.Error(x)
+	}
+	if y := hex.EncodeToString(fixed32(priv.Y)); y != "ccea490ce26775a52dc6ea718cc1aa600aed05fbf35e084a6632f6072da9ad13" {
+		t.Error(y)
+	}
+
+	k, _ := hex.DecodeString("59276E27D506861A16680F3AD9C02DCCEF3CC1FA3CDBE4CE6D54B80DEAC1BC21")
+	msg := []byte("message digest")
+	r, s, err := SM2Sign(bytes.NewReader(k), priv, []byte(SM2DefaultUID), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := hex.EncodeToString(fixed32(r)); out != "f5a03b0648d2c4630eeac513e1bb81a15944da3827d5b74143ac7eaceee720b3" {
+		t.Error(out)
+	}
+	if out := hex.EncodeToString(fixed32(s)); out != "b1b6aa29df212fd8763182bc0d421ca1bb9038fd1f7f42d4840b69c485bbc1aa" {
+		t.Error(out)
+	}
+	if !SM2Verify(&priv.SM2PublicKey, []byte(SM2DefaultUID), msg, r, s) {
+		t.Error("example signature rejected")
+	}
+}
+
+// TestSM2ScalarMult compares the constant time arithmetic with the generic
+// curve implementation, including the scalars around 0 and n.
+func TestSM2ScalarMult(t *testing.T) {
+	curve := SM2Curve()
+	n := curve.Params().N
+	scalars := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(15), big.NewInt(16), new(big.Int).Sub(n, big.NewInt(1))}
+	for i := 0; i < 8; i++ {
+		k, _ := rand.Int(rand.Reader, n)
+		scalars = append(scalars, k)
+	}
+	px, py := curve.ScalarBaseMult([]byte{7})
+	p := sm2PointFromAffine(px, py)
+	for _, k := range scalars {
+		wantX, wantY := curve.ScalarMult(px, py, k.Bytes())
+		q := sm2ScalarMult(&p, fixed32(k))
+		x, y := q.affine()
+		if x.Cmp(wantX) != 0 || y.Cmp(wantY) != 0 {
+			t.Errorf("k=%X: got (%X, %X) want (%X, %X)", k, x, y, wantX, wantY)
+		}
+	}
+	q := sm2ScalarMult(&p, fixed32(n))
+	if x, y := q.affine(); x.Sign() != 0 || y.Sign() != 0 {
+		t.Error("n * P is not the point at infinity")
+	}
+	if sm2OnCurve(px, new(big.Int).Add(py, big.NewInt(1))) {
+		t.Error("point off the curve accepted")
+	}
+}
+
+func TestSM2KeyExchange(t *testing.T) {
+	a, _ := GenerateSM2Key(rand.Reader)
+	ra, _ := GenerateSM2Key(rand.Reader)
+	b, _ := GenerateSM2Key(rand.Reader)
+	rb, _ := GenerateSM2Key(rand.Reader)
+	terminal := &SM2KeyExchange{Initiator: true, Static: a, Ephemeral: ra, UID: []byte("00003042")}
+	host := &SM2KeyExchange{Static: b, Ephemeral: rb, UID: []byte(SM2DefaultUID)}
+
+	ka, err := terminal.Agree(&b.SM2PublicKey, &rb.SM2PublicKey, host.UID, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := host.Agree(&a.SM2PublicKey, &ra.SM2PublicKey, terminal.UID, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ka.Key, kb.Key) || len(ka.Key) != 16 {
+		t.Error("agreed keys differ")
+	}
+	if ka.Confirm(kb.Own) != nil || kb.Confirm(ka.Own) != nil {
+		t.Error("confirmation failed")
+	}
+}
+
+// TestAlgorithmSM4 checks the SM4 PIN block, MAC and check value against
+// values worked out from their definitions with the SM4 block cipher, which
+// TestSM4Vectors checks against GB/T 32907.
+func TestAlgorithmSM4(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	cipher, _ := NewSM4Cipher(key)
+
+	// PIN field 06123456 padded with F, XOR 20 zeros || 123456789012
+	clear, err := SM4PinBlock("123456", "6222021234567890123")
+	if err != nil || utils.EncodeToString(clear) != "06123456FFFFFFFFFFFFEDCBA9876FED" {
+		t.Error(utils.EncodeToString(clear), err)
+	}
+	block, err := AlgSM4.EncryptPinBlock("123456", "6222021234567890123", key)
+	if err != nil || utils.EncodeToString(block) != "D664C07BA219562A239841632F092577" {
+		t.Error(utils.EncodeToString(block), err)
+	}
+	want := make([]byte, 16)
+	cipher.Encrypt(want, clear)
+	if !bytes.Equal(block, want) {
+		t.Error("PIN block is not the SM4 encryption of the clear block")
+	}
+
+	// XOR of the zero padded 16 byte blocks, its hex form encrypted in two
+	// halves, the first 8 hex digits of the result
+	mab := []byte("0200 mac block 1234567890")
+	mac, err := AlgSM4.MAC(key, mab)
+	if err != nil || string(mac) != "750AED72" {
+		t.Error(string(mac), err)
+	}
+	padded := ZeroPadding(append([]byte(nil), mab...), 16)
+	xored := make([]byte, 16)
+	for i := range padded {
+		xored[i%16] ^= padded[i]
+	}
+	hexForm := []byte(utils.EncodeToString(xored))
+	out := make([]byte, 16)
+	cipher.Encrypt(out, hexForm[:16])
+	for i := range out {
+		out[i] ^= hexForm[16+i]
+	}
+	cipher.Encrypt(out, out)
+	if string(mac) != utils.EncodeToString(out)[:8] {
+		t.Error("MAC does not follow the CUP ECB construction")
+	}
+
+	kcv, _ := AlgSM4.CheckValue(key)
+	cipher.Encrypt(out, make([]byte, 16))
+	if !bytes.Equal(kcv, out[:4]) {
+		t.Error(kcv)
+	}
+}
@@ -0,0 +1,428 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ANSI X9.143 / TR-31 key blocks. Version A binds keys with key variants
+// and C is the same method under its current letter, B derives TDES
+// encryption and MAC keys from the KBPK with CMAC, D does the same with AES.
+const (
+	TR31VersionA = 'A'
+	TR31VersionB = 'B'
+	TR31VersionC = 'C'
+	TR31VersionD = 'D'
+
+	tr31HeaderLen = 16
+)
+
+const (
+	ERR_TR31_SHORT         string = "TR-31 key block is too short"
+	ERR_TR31_VERSION       string = "unsupported TR-31 version: %c"
+	ERR_TR31_LENGTH        string = "TR-31 key block length mismatch; header=%d, actual=%d"
+	ERR_TR31_HEADER        string = "invalid TR-31 header: %s"
+	ERR_TR31_MAC           string = "TR-31 key block MAC verification failed"
+	ERR_TR31_KEY_LENGTH    string = "TR-31 key length does not fit key data"
+	ERR_TR31_KBPK          string = "KBPK length does not suit TR-31 version %c"
+	ERR_TR31_USAGE_UNKNOWN string = "no key type for TR-31 key usage %s"
+)
+
+// TR31Header holds the clear header of a key block.
+type TR31Header struct {
+	Version        byte
+	KeyUsage       string
+	Algorithm      byte
+	ModeOfUse      byte
+	KeyVersion     string
+	Exportability  byte
+	OptionalBlocks []TR31OptionalBlock
+}
+
+// TR31OptionalBlock is an optional header block, e.g. KS (key set ID).
+type TR31OptionalBlock struct {
+	ID   string
+	Data string
+}
+
+// WrapTR31 builds a key block protecting key under kbpk. The header length
+// field is computed; a PB block is appended when optional blocks leave the
+// header off the cipher block size.
+func WrapTR31(kbpk []byte, h *TR31Header, key []byte) (string, error) {
+	if len(key) > 0xFFFF/8 {
+		return "", errors.New(ERR_TR31_KEY_LENGTH)
+	}
+	scheme, err := newTR31Scheme(h.Version, kbpk)
+	if err != nil {
+		return "", err
+	}
+
+	size := scheme.blockSize
+	payload := make([]byte, 2, 2+len(key)+size)
+	binary.BigEndian.PutUint16(payload, uint16(len(key)*8))
+	payload = append(payload, key...)
+	if rem := len(payload) % size; rem != 0 {
+		pad := make([]byte, size-rem)
+		if _, err := rand.Read(pad); err != nil {
+			return "", err
+		}
+		payload = append(payload, pad...)
+	}
+
+	optional := h.optionalBlocks(size)
+	total := tr31HeaderLen + len(optional) + 2*len(payload) + 2*scheme.macLen
+	header, err := h.encode(total, len(optional))
+	if err != nil {
+		return "", err
+	}
+	header += optional
+
+	encrypted, mac, err := scheme.seal([]byte(header), payload)
+	if err != nil {
+		return "", err
+	}
+	return header + strings.ToUpper(hex.EncodeToString(encrypted)+hex.EncodeToString(mac)), nil
+}
+
+// UnwrapTR31 verifies a key block under kbpk and returns its header and the
+// clear key.
+func UnwrapTR31(kbpk []byte, block string) (*TR31Header, []byte, error) {
+	if len(block) < tr31HeaderLen {
+		return nil, nil, errors.New(ERR_TR31_SHORT)
+	}
+	length, err := strconv.Atoi(block[1:5])
+	if err != nil {
+		return nil, nil, fmt.Errorf(ERR_TR31_HEADER, "length")
+	}
+	if length != len(block) {
+		return nil, nil, fmt.Errorf(ERR_TR31_LENGTH, length, len(block))
+	}
+	h, headerLen, err := parseTR31Header(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	scheme, err := newTR31Scheme(h.Version, kbpk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := block[headerLen:]
+	if len(body) < 2*scheme.macLen {
+		return nil, nil, errors.New(ERR_TR31_SHORT)
+	}
+	encrypted, err := hex.DecodeString(body[:len(body)-2*scheme.macLen])
+	if err != nil {
+		return nil, nil, fmt.Errorf(ERR_TR31_HEADER, "key data")
+	}
+	mac, err := hex.DecodeString(body[len(body)-2*scheme.macLen:])
+	if err != nil {
+		return nil, nil, fmt.Errorf(ERR_TR31_HEADER, "mac")
+	}
+	if len(encrypted) == 0 || len(encrypted)%scheme.blockSize != 0 {
+		return nil, nil, errors.New(ERR_INVALID_BLOCK_SIZE)
+	}
+
+	payload, err := scheme.open([]byte(block[:headerLen]), encrypted, mac)
+	if err != nil {
+		return nil, nil, err
+	}
+	bitLen := int(binary.BigEndian.Uint16(payload))
+	if bitLen%8 != 0 || 2+bitLen/8 > len(payload) {
+		return nil, nil, errors.New(ERR_TR31_KEY_LENGTH)
+	}
+	return h, append([]byte(nil), payload[2:2+bitLen/8]...), nil
+}
+
+// KeyType maps the header's key usage onto the key store's key types.
+func (h *TR31Header) KeyType() (KeyType, error) {
+	switch h.KeyUsage {
+	case "K0", "K1":
+		return TMK, nil
+	case "P0":
+		return PIK, nil
+	case "M0", "M1", "M3", "M6":
+		return MAK, nil
+	case "D0":
+		return TDK, nil
+	}
+	return 0, fmt.Errorf(ERR_TR31_USAGE_UNKNOWN, h.KeyUsage)
+}
+
+// ImportTR31 unwraps block under the terminal's TMK, used as KBPK, and stores
+// the key under the type its usage maps to.
+func ImportTR31(store KeyStore, terminalID string, block string) (*TR31Header, error) {
+	kbpk, err := store.Get(terminalID, TMK)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(kbpk)
+	h, key, err := UnwrapTR31(kbpk, block)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(key)
+	keyType, err := h.KeyType()
+	if err != nil {
+		return nil, err
+	}
+	return h, store.Put(terminalID, keyType, key)
+}
+
+// SplitTR31 splits concatenated key blocks using the length in each header.
+func SplitTR31(data string) ([]string, error) {
+	var blocks []string
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, errors.New(ERR_TR31_SHORT)
+		}
+		length, err := strconv.Atoi(data[1:5])
+		if err != nil || length < tr31HeaderLen || length > len(data) {
+			return nil, fmt.Errorf(ERR_TR31_HEADER, "length")
+		}
+		blocks = append(blocks, data[:length])
+		data = data[length:]
+	}
+	return blocks, nil
+}
+
+func (h *TR31Header) encode(total, optionalLen int) (string, error) {
+	if len(h.KeyUsage) != 2 || h.Algorithm == 0 || h.ModeOfUse == 0 || h.Exportability == 0 {
+		return "", fmt.Errorf(ERR_TR31_HEADER, "missing field")
+	}
+	if total > 9999 {
+		return "", fmt.Errorf(ERR_TR31_HEADER, "key block too long")
+	}
+	keyVersion := h.KeyVersion
+	if keyVersion == "" {
+		keyVersion = "00"
+	}
+	count := len(h.OptionalBlocks)
+	if optionalLen > 0 && len(h.optionalBlocks(1)) != optionalLen {
+		count++
+	}
+	return fmt.Sprintf("%c%04d%s%c%c%2s%c%02d00", h.Version, total, h.KeyUsage, h.Algorithm,
+		h.ModeOfUse, keyVersion, h.Exportability, count), nil
+}
+
+// optionalBlocks encodes the optional blocks, padded with a PB block so the
+// whole header is a multiple of blockSize.
+func (h *TR31Header) optionalBlocks(blockSize int) string {
+	var out string
+	for _, b := range h.OptionalBlocks {
+		out += fmt.Sprintf("%s%02X%s", b.ID, 4+len(b.Data), b.Data)
+	}
+	if len(out) == 0 {
+		return out
+	}
+	if rem := (tr31HeaderLen + len(out)) % blockSize; rem != 0 {
+		pad := blockSize - rem
+		if pad < 4 {
+			pad += blockSize
+		}
+		out += fmt.Sprintf("PB%02X%s", pad, strings.Repeat("0", pad-4))
+	}
+	return out
+}
+
+func parseTR31Header(block string) (*TR31Header, int, error) {
+	h := &TR31Header{
+		Version:       block[0],
+		KeyUsage:      block[5:7],
+		Algorithm:     block[7],
+		ModeOfUse:     block[8],
+		KeyVersion:    block[9:11],
+		Exportability: block[11],
+	}
+	count, err := strconv.Atoi(block[12:14])
+	if err != nil {
+		return nil, 0, fmt.Errorf(ERR_TR31_HEADER, "optional block count")
+	}
+	pos := tr31HeaderLen
+	for i := 0; i < count; i++ {
+		if len(block) < pos+4 {
+			return nil, 0, fmt.Errorf(ERR_TR31_HEADER, "optional block")
+		}
+		length, err := strconv.ParseUint(block[pos+2:pos+4], 16, 8)
+		if err != nil || length < 4 || len(block) < pos+int(length) {
+			return nil, 0, fmt.Errorf(ERR_TR31_HEADER, "optional block length")
+		}
+		id := block[pos : pos+2]
+		if id != "PB" {
+			h.OptionalBlocks = append(h.OptionalBlocks, TR31OptionalBlock{ID: id, Data: block[pos+4 : pos+int(length)]})
+		}
+		pos += int(length)
+	}
+	return h, pos, nil
+}
+
+// tr31Scheme holds the per-version encryption and MAC keys.
+type tr31Scheme struct {
+	version   byte
+	blockSize int
+	macLen    int
+	kbek      cipher.Block
+	kbmk      []byte
+}
+
+func newTR31Scheme(version byte, kbpk []byte) (*tr31Scheme, error) {
+	s := &tr31Scheme{version: version}
+	switch version {
+	case TR31VersionA, TR31VersionC:
+		if len(kbpk) != 16 && len(kbpk) != 24 {
+			return nil, fmt.Errorf(ERR_TR31_KBPK, version)
+		}
+		s.blockSize, s.macLen = 8, 4
+		kbek := xorConst(kbpk, 0x45)
+		s.kbmk = xorConst(kbpk, 0x4D)
+		return s, s.setTDESKey(kbek)
+	case TR31VersionB:
+		if len(kbpk) != 16 && len(kbpk) != 24 {
+			return nil, fmt.Errorf(ERR_TR31_KBPK, version)
+		}
+		s.blockSize, s.macLen = 8, 8
+		kbek, err := tr31DeriveTDES(kbpk, 0x0000)
+		if err != nil {
+			return nil, err
+		}
+		if s.kbmk, err = tr31DeriveTDES(kbpk, 0x0001); err != nil {
+			return nil, err
+		}
+		return s, s.setTDESKey(kbek)
+	case TR31VersionD:
+		if len(kbpk) != 16 && len(kbpk) != 24 && len(kbpk) != 32 {
+			return nil, fmt.Errorf(ERR_TR31_KBPK, version)
+		}
+		s.blockSize, s.macLen = 16, 16
+		kbek, err := tr31DeriveAES(kbpk, 0x0000)
+		if err != nil {
+			return nil, err
+		}
+		if s.kbmk, err = tr31DeriveAES(kbpk, 0x0001); err != nil {
+			return nil, err
+		}
+		s.kbek, err = aes.NewCipher(kbek)
+		return s, err
+	}
+	return nil, fmt.Errorf(ERR_TR31_VERSION, version)
+}
+
+func (s *tr31Scheme) setTDESKey(key []byte) error {
+	if len(key) == 16 {
+		key = append(key[:16:16], key[:8]...)
+	}
+	block, err := des.NewTripleDESCipher(key)
+	s.kbek = block
+	return err
+}
+
+func (s *tr31Scheme) seal(header, payload []byte) (encrypted, mac []byte, err error) {
+	encrypted = make([]byte, len(payload))
+	switch s.version {
+	case TR31VersionA, TR31VersionC:
+		cipher.NewCBCEncrypter(s.kbek, header[:8]).CryptBlocks(encrypted, payload)
+		mac, err = s.mac(append(append([]byte(nil), header...), encrypted...))
+	default:
+		if mac, err = s.mac(append(append([]byte(nil), header...), payload...)); err != nil {
+			return nil, nil, err
+		}
+		cipher.NewCBCEncrypter(s.kbek, mac).CryptBlocks(encrypted, payload)
+	}
+	return encrypted, mac, err
+}
+
+func (s *tr31Scheme) open(header, encrypted, mac []byte) ([]byte, error) {
+	payload := make([]byte, len(encrypted))
+	var expected []byte
+	var err error
+	switch s.version {
+	case TR31VersionA, TR31VersionC:
+		if expected, err = s.mac(append(append([]byte(nil), header...), encrypted...)); err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(s.kbek, header[:8]).CryptBlocks(payload, encrypted)
+	default:
+		cipher.NewCBCDecrypter(s.kbek, mac).CryptBlocks(payload, encrypted)
+		if expected, err = s.mac(append(append([]byte(nil), header...), payload...)); err != nil {
+			return nil, err
+		}
+	}
+	if !hmac.Equal(expected, mac) {
+		Zeroize(payload)
+		return nil, errors.New(ERR_TR31_MAC)
+	}
+	if len(payload) < 2 {
+		return nil, errors.New(ERR_TR31_KEY_LENGTH)
+	}
+	return payload, nil
+}
+
+func (s *tr31Scheme) mac(data []byte) ([]byte, error) {
+	switch s.version {
+	case TR31VersionA, TR31VersionC:
+		// ISO 9797-1 MAC algorithm 1 with TDES, truncated to 4 bytes
+		out, err := EncryptWithDESKey(data, s.kbmk, WithZeroIV(), WithPadding(Zero))
+		if err != nil {
+			return nil, err
+		}
+		return out[len(out)-8 : len(out)-4], nil
+	case TR31VersionB:
+		return TDESCMAC(s.kbmk, data)
+	default:
+		return AESCMAC(s.kbmk, data)
+	}
+}
+
+// tr31DeriveTDES derives a KBEK (usage 0) or KBMK (usage 1) from a TDES KBPK.
+func tr31DeriveTDES(kbpk []byte, usage uint16) ([]byte, error) {
+	data := []byte{0x01, 0, 0, 0x00, 0x00, 0x00, 0x00, 0x80}
+	binary.BigEndian.PutUint16(data[1:], usage)
+	if len(kbpk) == 24 {
+		data[4], data[5], data[6], data[7] = 0x00, 0x01, 0x00, 0xC0
+	}
+	var out []byte
+	for i := byte(1); len(out) < len(kbpk); i++ {
+		data[0] = i
+		block, err := TDESCMAC(kbpk, data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+	}
+	return out, nil
+}
+
+// tr31DeriveAES derives a KBEK (usage 0) or KBMK (usage 1) from an AES KBPK.
+func tr31DeriveAES(kbpk []byte, usage uint16) ([]byte, error) {
+	data := []byte{0x01, 0, 0, 0x00, 0x00, 0x02, 0x00, 0x80}
+	binary.BigEndian.PutUint16(data[1:], usage)
+	switch len(kbpk) {
+	case 24:
+		data[5], data[6], data[7] = 0x03, 0x00, 0xC0
+	case 32:
+		data[5], data[6], data[7] = 0x04, 0x01, 0x00
+	}
+	var out []byte
+	for i := byte(1); len(out) < len(kbpk); i++ {
+		data[0] = i
+		block, err := AESCMAC(kbpk, data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+	}
+	return out[:len(kbpk)], nil
+}
+
+func xorConst(key []byte, c byte) []byte {
+	return xorBytes(key, bytes.Repeat([]byte{c}, len(key)))
+}
@@ -0,0 +1,140 @@
+package security
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// RFC 4493 AES-CMAC examples
+func TestAESCMACVectors(t *testing.T) {
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	msg, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411")
+	cases := map[int]string{
+		0:  "bb1d6929e95937287fa37d129b756746",
+		16: "070a16b46b4d4144f79bdd9dd04a287c",
+		40: "dfa66747de9ae63030ca32611497c827",
+	}
+	for n, expected := range cases {
+		out, err := AESCMAC(key, msg[:n])
+		if err != nil || hex.EncodeToString(out) != expected {
+			t.Error(n, hex.EncodeToString(out), err)
+		}
+	}
+}
+
+// NIST SP 800-38B TDEA CMAC examples, three and two key
+func TestTDESCMACVectors(t *testing.T) {
+	msg, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	cases := []struct {
+		key      string
+		expected map[int]string
+	}{
+		{"8aa83bf8cbda10620bc1bf19fbb6cd58bc313d4a371ca8b5", map[int]string{
+			0: "b7a688e122ffaf95", 8: "8e8f293136283797", 20: "743ddbe0ce2dc2ed", 32: "33e6b1092400eae5"}},
+		{"4cf15134a2850dd58a3d10ba80570d38", map[int]string{
+			0: "bd2ebf9a3ba00361", 8: "4ff2ab813c53ce83", 20: "62dd1b471902bd4e", 32: "31b1e431dabc4eb8"}},
+	}
+	for _, c := range cases {
+		key, _ := hex.DecodeString(c.key)
+		for n, expected := range c.expected {
+			out, err := TDESCMAC(key, msg[:n])
+			if err != nil || hex.EncodeToString(out) != expected {
+				t.Error(len(key), n, hex.EncodeToString(out), err)
+			}
+		}
+	}
+}
+
+// Example key blocks of ANSI X9 TR-31:2018 Annex A (X9.143), one per
+// version, unwrapped to their published clear keys.
+func TestTR31Vectors(t *testing.T) {
+	cases := []struct {
+		kbpk, block, key, usage string
+	}{
+		{"89E88CF7931444F334BD7547FC3F380C",
+			"A0072P0TE00E0000F5161ED902807AF26F1D62263644BD24192FDB3193C730301CEE8701",
+			"F039121BEC83D26B169BDCD5B22AAF8F", "P0"},
+		{"DD7515F2BFC17F85CE48F3CA25CB21F6",
+			"B0080P0TE00E000094B420079CC80BA3461F86FE26EFC4A3B8E4FA4C5F5341176EED7B727B8A248E",
+			"3F419E1CB7079442AA37474C2EFBF8B8", "P0"},
+		{"B8ED59E0A279A295E9F5ED7944FD06B9",
+			"C0096B0TX12S0100KS1800604B120F9292800000BFB9B689CB567E66FC3FEE5AD5F52161FC6545B9D60989015D02155C",
+			"EDB380DD340BC2620247D445F5B8D678", "B0"},
+		{"88E1AB2A2E3DD38C1FA039A536500CC8A87AB9D62DC92C01058FA79F44657DE6",
+			"D0112P0AE00E0000B82679114F470F540165EDFBF7E250FCEA43F810D215F8D207E2E417C07156A27E8E31DA05F7425509593D03A457DC34",
+			"3F419E1CB7079442AA37474C2EFBF8B8", "P0"},
+	}
+	for _, c := range cases {
+		kbpk, _ := hex.DecodeString(c.kbpk)
+		h, key, err := UnwrapTR31(kbpk, c.block)
+		if err != nil {
+			t.Error(c.block[:1], err)
+			continue
+		}
+		if hex.EncodeToString(key) != strings.ToLower(c.key) || h.KeyUsage != c.usage {
+			t.Error(c.block[:1], hex.EncodeToString(key), h.KeyUsage)
+		}
+	}
+}
+
+func TestTR31RoundTrip(t *testing.T) {
+	tdesKBPK, _ := hex.DecodeString("89E88CF7931444F334BD7547FC3F380C")
+	aesKBPK, _ := hex.DecodeString("88E1AB2A2E3DD38C1FA039A536500CC8A87AB9D62DC92C01058FA79F44657DE6")
+	key, _ := hex.DecodeString("F039121BEC83D26B169BDCD5B22AAF8F")
+
+	cases := []struct {
+		version byte
+		kbpk    []byte
+	}{
+		{TR31VersionA, tdesKBPK},
+		{TR31VersionB, tdesKBPK},
+		{TR31VersionC, tdesKBPK},
+		{TR31VersionD, aesKBPK},
+	}
+	for _, c := range cases {
+		h := &TR31Header{Version: c.version, KeyUsage: "P0", Algorithm: 'T', ModeOfUse: 'E', Exportability: 'N',
+			OptionalBlocks: []TR31OptionalBlock{{ID: "KS", Data: "00604B120F9292800000"}}}
+		block, err := WrapTR31(c.kbpk, h, key)
+		if err != nil {
+			t.Fatal(string(c.version), err)
+		}
+		parsed, clear, err := UnwrapTR31(c.kbpk, block)
+		if err != nil {
+			t.Fatal(string(c.version), err)
+		}
+		if !bytes.Equal(clear, key) || parsed.KeyUsage != "P0" || len(parsed.OptionalBlocks) != 1 {
+			t.Error(string(c.version), block)
+		}
+
+		tampered := []byte(block)
+		tampered[len(tampered)-1] ^= 0x01
+		if _, _, err := UnwrapTR31(c.kbpk, string(tampered)); err == nil {
+			t.Error(string(c.version), "tampered block accepted")
+		}
+	}
+}
+
+func TestImportTR31(t *testing.T) {
+	tmk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	store := NewMemoryKeyStore()
+	store.Put("00003042", TMK, tmk)
+
+	mak, _ := hex.DecodeString("1CDC70ABD616015E1CDC70ABD616015E")
+	block, err := WrapTR31(tmk, &TR31Header{Version: TR31VersionB, KeyUsage: "M3", Algorithm: 'T', ModeOfUse: 'C', Exportability: 'N'}, mak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := SplitTR31(block + block)
+	if err != nil || len(blocks) != 2 {
+		t.Fatal(blocks, err)
+	}
+	if _, err := ImportTR31(store, "00003042", blocks[1]); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.Get("00003042", MAK)
+	if !bytes.Equal(stored, mak) {
+		t.Error(stored)
+	}
+}
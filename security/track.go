@@ -0,0 +1,49 @@
+package security
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"8583/utils"
+)
+
+const ERR_TRACK_TOO_SHORT string = "track data is too short to encrypt"
+
+// EncryptTrack applies the CUP track data encryption to track 2 or 3 data in
+// its BCD digit form ('=' written as 'D'): the block of digits ending just
+// before the last digit (16 digits for DES, 32 for SM4) is encrypted under
+// tdk and put back in place. The length of the track does not change.
+func EncryptTrack(track string, tdk []byte, alg Algorithm) (string, error) {
+	return cryptTrack(track, tdk, alg, true)
+}
+
+// DecryptTrack reverses EncryptTrack.
+func DecryptTrack(track string, tdk []byte, alg Algorithm) (string, error) {
+	return cryptTrack(track, tdk, alg, false)
+}
+
+func cryptTrack(track string, tdk []byte, alg Algorithm, encrypt bool) (string, error) {
+	track = strings.ToUpper(strings.Replace(track, "=", "D", -1))
+	digits := alg.BlockSize() * 2
+	if len(track) < digits+1 {
+		return "", errors.New(ERR_TRACK_TOO_SHORT)
+	}
+	end := len(track) - 1
+	start := end - digits
+
+	block, err := hex.DecodeString(track[start:end])
+	if err != nil {
+		return "", err
+	}
+	var out []byte
+	if encrypt {
+		out, err = alg.Encrypt(block, tdk, WithMode(ECB), WithPadding(NoPadding))
+	} else {
+		out, err = alg.Decrypt(block, tdk, WithMode(ECB), WithPadding(NoPadding))
+	}
+	if err != nil {
+		return "", err
+	}
+	return track[:start] + utils.EncodeToString(out) + track[end:], nil
+}
@@ -0,0 +1,41 @@
+package security
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEncryptTrack(t *testing.T) {
+	tdk, _ := hex.DecodeString("4551E676DFEFE6109252683B64B66E1F")
+	track := "6225887912345678=49121010000000000"
+
+	enc, err := EncryptTrack(track, tdk, AlgDES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) != len(track) {
+		t.Fatalf("length changed: %d != %d", len(enc), len(track))
+	}
+	// only the 16 digits before the last one are replaced
+	if enc[:len(track)-17] != "6225887912345678D" || enc[len(enc)-1] != '0' {
+		t.Fatalf("unexpected layout: %s", enc)
+	}
+	block, _ := hex.DecodeString("4912101000000000")
+	want, _ := EncryptWithDESKey(block, tdk, WithMode(ECB), WithPadding(NoPadding))
+	if enc[17:33] != strings.ToUpper(hex.EncodeToString(want)) {
+		t.Fatalf("unexpected block: %s", enc)
+	}
+
+	dec, err := DecryptTrack(enc, tdk, AlgDES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != "6225887912345678D49121010000000000" {
+		t.Fatalf("unexpected clear track: %s", dec)
+	}
+
+	if _, err := EncryptTrack("1234567890123456", tdk, AlgDES); err == nil {
+		t.Fatal("expected error for short track")
+	}
+}
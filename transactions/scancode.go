@@ -0,0 +1,244 @@
+package transactions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"8583/j8583"
+)
+
+// Scan-code specific codes. The purchase is a sale carrying the payment code
+// in field 62; its status is queried with a 0200 of processing code 330000
+// referring to the purchase in field 61.
+const (
+	ProcScanCodeQuery   = "330000"
+	CondScanCode        = "31"
+	EntryScanCode       = "04"
+	TypeScanCodeQuery   = "36"
+	scanCodeOrderTag    = "UPLDC2"
+	RespRequestInFlight = "09"
+)
+
+const (
+	DefaultPollInterval   = 3 * time.Second
+	DefaultScanCodeWait   = 60 * time.Second
+	DefaultRequestTimeout = 10 * time.Second
+)
+
+const (
+	ERR_SCAN_CODE_TIMEOUT string = "scan-code payment still pending after %s"
+	ERR_EMPTY_RESPONSE    string = "empty response"
+)
+
+// ScanCodeSale builds the scan-code purchase: the payment code the customer
+// shows goes in field 62 and the optional external order number in field 57.
+func (t *Terminal) ScanCodeSale(code, amount, extOrder string) (*j8583.Message, error) {
+	stan, err := t.State.NextSTAN()
+	if err != nil {
+		return nil, err
+	}
+	m := t.scanCodeMessage(stan, ProcSale, j8583.TypeSale, amount)
+	if extOrder != "" {
+		m.Fields[57] = j8583.NewFieldVar(j8583.LLLVAR, j8583.ASCII, fmt.Sprintf("%s%03d%s", scanCodeOrderTag, len(extOrder), extOrder))
+	}
+	m.Fields[62] = j8583.NewFieldVar(j8583.LLLVAR, j8583.BCD, code)
+	return m, nil
+}
+
+// ScanCodeQuery builds the status query of the scan-code purchase sale.
+func (t *Terminal) ScanCodeQuery(sale *j8583.Message) (*j8583.Message, error) {
+	stan, err := t.State.NextSTAN()
+	if err != nil {
+		return nil, err
+	}
+	m := t.scanCodeMessage(stan, ProcScanCodeQuery, TypeScanCodeQuery, sale.FieldString(4))
+	_, batchNum, _ := sale.Field60()
+	m.Fields[61] = j8583.NewFieldVar(j8583.LLLVAR, j8583.BCD, originalData(Original{Batch: batchNum, STAN: sale.FieldString(11)}))
+	return m, nil
+}
+
+func (t *Terminal) scanCodeMessage(stan, procCode, typeCode, amount string) *j8583.Message {
+	m := &j8583.Message{Tpdu: t.Tpdu, Header: t.Header, Mti: "0200"}
+	m.Fields = make([]j8583.Field, 65)
+	m.Fields[3] = j8583.NewFieldFix(j8583.BCD, 6, procCode)
+	if amount != "" {
+		m.Fields[4] = j8583.NewFieldFix(j8583.BCD, 12, amount)
+	}
+	m.Fields[11] = j8583.NewFieldFix(j8583.BCD, 6, stan)
+	m.Fields[22] = j8583.NewFieldFix(j8583.BCD, 3, EntryScanCode+"0")
+	m.Fields[25] = j8583.NewFieldFix(j8583.BCD, 2, CondScanCode)
+	m.Fields[41] = j8583.NewFieldFix(j8583.ASCII, 8, t.TerminalID)
+	m.Fields[42] = j8583.NewFieldFix(j8583.ASCII, 15, t.MerchantID)
+	currency := t.Currency
+	if currency == "" {
+		currency = "156"
+	}
+	m.Fields[49] = j8583.NewFieldFix(j8583.ASCII, 3, currency)
+
+	subField60 := make([]j8583.SubField, 3)
+	subField60[0] = j8583.NewSubFieldFix(j8583.BCD, 2, typeCode)
+	subField60[1] = j8583.NewSubFieldFix(j8583.BCD, 6, t.State.Batch())
+	subField60[2] = j8583.NewSubFieldFix(j8583.BCD, 3, "000")
+	m.Fields[60] = j8583.NewFields(j8583.LLLVAR, j8583.BCD, subField60)
+	return m
+}
+
+// ScanCodeFlow runs a scan-code payment: it sends the purchase and, while
+// the host answers with one of PendingCodes, polls with status queries every
+// PollInterval. If the payment is still open after Wait, the purchase goes
+// unanswered or ctx ends once it has been sent, the purchase is reversed on
+// a context of its own. The reversal is put in Reversals, when set, before
+// it is sent and removed once the host acknowledges it.
+type ScanCodeFlow struct {
+	Terminal       *Terminal
+	Sender         j8583.Sender
+	PollInterval   time.Duration
+	Wait           time.Duration
+	RequestTimeout time.Duration
+	PendingCodes   []string
+	Reversals      *j8583.ReversalQueue
+	// Prepare, if set, finishes every outgoing message, e.g. by setting its
+	// MAC.
+	Prepare func(m *j8583.Message) error
+}
+
+// ScanCodeResult is the outcome of a scan-code payment. Response is the
+// final answer from the host: that of the purchase or of the last query.
+type ScanCodeResult struct {
+	Sale     *j8583.Message
+	Response *j8583.Message
+	Approved bool
+	Reversed bool
+}
+
+func NewScanCodeFlow(terminal *Terminal, sender j8583.Sender) *ScanCodeFlow {
+	return &ScanCodeFlow{
+		Terminal:       terminal,
+		Sender:         sender,
+		PollInterval:   DefaultPollInterval,
+		Wait:           DefaultScanCodeWait,
+		RequestTimeout: DefaultRequestTimeout,
+		PendingCodes:   []string{RespRequestInFlight},
+	}
+}
+
+// Pay runs the payment for code and amount.
+func (f *ScanCodeFlow) Pay(ctx context.Context, code, amount, extOrder string) (*ScanCodeResult, error) {
+	sale, err := f.Terminal.ScanCodeSale(code, amount, extOrder)
+	if err != nil {
+		return nil, err
+	}
+	result := &ScanCodeResult{Sale: sale}
+	deadline := time.Now().Add(f.Wait)
+
+	resp, err := f.send(ctx, sale)
+	if err != nil {
+		if j8583.NotSent(err) {
+			return result, err
+		}
+		return f.abandon(result, err)
+	}
+
+	for f.pending(resp) {
+		result.Response = resp
+		if !time.Now().Before(deadline) {
+			return f.abandon(result, fmt.Errorf(ERR_SCAN_CODE_TIMEOUT, f.Wait))
+		}
+		select {
+		case <-ctx.Done():
+			return f.abandon(result, ctx.Err())
+		case <-time.After(f.PollInterval):
+		}
+
+		query, err := f.Terminal.ScanCodeQuery(sale)
+		if err != nil {
+			return f.abandon(result, err)
+		}
+		next, err := f.send(ctx, query)
+		if err != nil {
+			// a lost query leaves the payment pending; ask again
+			if ctx.Err() != nil {
+				return f.abandon(result, ctx.Err())
+			}
+			continue
+		}
+		resp = next
+	}
+
+	result.Response = resp
+	result.Approved = resp.FieldString(39) == j8583.RespApproved
+	return result, nil
+}
+
+// abandon reverses the sale of result, whose outcome is unknown, and
+// returns err unless the reversal could not even be queued.
+func (f *ScanCodeFlow) abandon(result *ScanCodeResult, err error) (*ScanCodeResult, error) {
+	reversed, qerr := f.reverse(result.Sale)
+	result.Reversed = reversed
+	if qerr != nil {
+		return result, qerr
+	}
+	return result, err
+}
+
+func (f *ScanCodeFlow) pending(resp *j8583.Message) bool {
+	code := resp.FieldString(39)
+	for _, p := range f.PendingCodes {
+		if code == p {
+			return true
+		}
+	}
+	return false
+}
+
+// reverse queues the reversal of sale and sends it on a context of its own,
+// as the caller's may have ended. It reports whether the host acknowledged
+// it; only a failure to queue it is returned as an error.
+func (f *ScanCodeFlow) reverse(sale *j8583.Message) (bool, error) {
+	reversal := j8583.NewReversal(sale, j8583.ReversalTimeout)
+	if f.Reversals != nil {
+		if err := f.Reversals.Add(reversal, j8583.ReversalTimeout); err != nil {
+			return false, err
+		}
+	}
+
+	timeout := f.RequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := f.send(ctx, reversal)
+	if err != nil || !j8583.ReversalAcknowledged(resp) {
+		return false, nil
+	}
+	if f.Reversals != nil {
+		return true, f.Reversals.Remove(reversal.FieldString(41))
+	}
+	return true, nil
+}
+
+// send finishes m with Prepare and sends it. Errors raised before Sender is
+// called are NotSentErrors.
+func (f *ScanCodeFlow) send(ctx context.Context, m *j8583.Message) (*j8583.Message, error) {
+	if f.Prepare != nil {
+		if err := f.Prepare(m); err != nil {
+			return nil, &j8583.NotSentError{Err: err}
+		}
+	}
+	if f.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.RequestTimeout)
+		defer cancel()
+	}
+	resp, err := f.Sender.Send(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New(ERR_EMPTY_RESPONSE)
+	}
+	return resp, nil
+}
@@ -0,0 +1,127 @@
+package transactions
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"8583/j8583"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hostFunc answers requests in process, recording them.
+type hostFunc struct {
+	mu     sync.Mutex
+	sent   []*j8583.Message
+	answer func(m *j8583.Message) (*j8583.Message, error)
+}
+
+func (h *hostFunc) Send(ctx context.Context, m *j8583.Message) (*j8583.Message, error) {
+	h.mu.Lock()
+	h.sent = append(h.sent, m)
+	h.mu.Unlock()
+	return h.answer(m)
+}
+
+func newTestFlow(answer func(m *j8583.Message) (*j8583.Message, error)) (*ScanCodeFlow, *hostFunc) {
+	host := &hostFunc{answer: answer}
+	flow := NewScanCodeFlow(newTestTerminal(), host)
+	flow.PollInterval = time.Millisecond
+	flow.Wait = 50 * time.Millisecond
+	return flow, host
+}
+
+func TestScanCodePolling(t *testing.T) {
+	queries := 0
+	flow, host := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		if m.FieldString(3) == ProcScanCodeQuery {
+			queries++
+			if queries == 2 {
+				return j8583.NewResponse(m, j8583.RespApproved), nil
+			}
+		}
+		return j8583.NewResponse(m, RespRequestInFlight), nil
+	})
+
+	result, err := flow.Pay(context.Background(), "284753193293963468", "000000000001", "ORDER1")
+	assert.NoError(t, err)
+	assert.True(t, result.Approved)
+	assert.Equal(t, 3, len(host.sent))
+	assert.Equal(t, "UPLDC2006ORDER1", host.sent[0].FieldString(57))
+	assert.Equal(t, "0000070000010000", host.sent[1].FieldString(61))
+}
+
+func TestScanCodeTimeoutReverses(t *testing.T) {
+	flow, host := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		return j8583.NewResponse(m, RespRequestInFlight), nil
+	})
+
+	result, err := flow.Pay(context.Background(), "284753193293963468", "000000000001", "")
+	assert.Error(t, err)
+	assert.True(t, result.Reversed)
+	last := host.sent[len(host.sent)-1]
+	assert.Equal(t, "0400", last.Mti)
+	assert.Equal(t, result.Sale.FieldString(11), last.FieldString(11))
+}
+
+func TestScanCodeLostSaleQueuesReversal(t *testing.T) {
+	flow, _ := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		return nil, context.DeadlineExceeded
+	})
+	flow.Reversals, _ = j8583.OpenReversalQueue("", nil)
+
+	result, err := flow.Pay(context.Background(), "284753193293963468", "000000000001", "")
+	assert.Error(t, err)
+	assert.False(t, result.Reversed)
+	assert.Equal(t, 1, flow.Reversals.Len())
+}
+
+func TestScanCodeCancelReverses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	flow, host := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		if m.Mti == "0400" {
+			return j8583.NewResponse(m, j8583.RespApproved), nil
+		}
+		cancel()
+		return j8583.NewResponse(m, RespRequestInFlight), nil
+	})
+	flow.Reversals, _ = j8583.OpenReversalQueue("", nil)
+
+	result, err := flow.Pay(ctx, "284753193293963468", "000000000001", "")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, result.Reversed)
+	assert.Equal(t, "0400", host.sent[len(host.sent)-1].Mti)
+	assert.Equal(t, 0, flow.Reversals.Len())
+}
+
+func TestScanCodeReversalNeedsAcknowledgement(t *testing.T) {
+	flow, _ := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		if m.Mti == "0400" {
+			return j8583.NewResponse(m, j8583.RespSystemError), nil
+		}
+		return nil, context.DeadlineExceeded
+	})
+	flow.Reversals, _ = j8583.OpenReversalQueue("", nil)
+
+	result, err := flow.Pay(context.Background(), "284753193293963468", "000000000001", "")
+	assert.Error(t, err)
+	assert.False(t, result.Reversed)
+	assert.Equal(t, 1, flow.Reversals.Len())
+}
+
+func TestScanCodeUnsentSaleNotReversed(t *testing.T) {
+	flow, host := newTestFlow(func(m *j8583.Message) (*j8583.Message, error) {
+		return j8583.NewResponse(m, j8583.RespApproved), nil
+	})
+	flow.Reversals, _ = j8583.OpenReversalQueue("", nil)
+	flow.Prepare = func(m *j8583.Message) error { return errors.New("no MAK") }
+
+	result, err := flow.Pay(context.Background(), "284753193293963468", "000000000001", "")
+	assert.Error(t, err)
+	assert.False(t, result.Reversed)
+	assert.Equal(t, 0, len(host.sent))
+	assert.Equal(t, 0, flow.Reversals.Len())
+}
@@ -0,0 +1,233 @@
+// Package transactions builds the standard CUP POS transactions on top of
+// j8583: sale, sale void, refund, pre-authorisation and its cancel,
+// completion and its cancel, and balance inquiry.
+package transactions
+
+import (
+	"errors"
+	"fmt"
+
+	"8583/j8583"
+)
+
+// Processing codes (field 3).
+const (
+	ProcSale           = "000000"
+	ProcVoid           = "200000"
+	ProcPreAuth        = "030000"
+	ProcBalanceInquiry = "310000"
+)
+
+// Service condition codes (field 25).
+const (
+	CondNormal  = "00"
+	CondPreAuth = "06"
+)
+
+// Point of service entry modes (field 22), PIN entry digit excluded.
+const (
+	EntryManual      = "01"
+	EntrySwipe       = "02"
+	EntryChip        = "05"
+	EntryContactless = "07"
+)
+
+const (
+	ERR_NO_CARD_DATA    string = "card data requires a PAN or track 2"
+	ERR_ORIGINAL_FIELDS string = "original transaction is missing %s"
+)
+
+// Card is the card data read for a transaction. ICData is the hex encoded
+// field 55 of a chip transaction; PINBlock the hex encoded encrypted PIN.
+type Card struct {
+	PAN            string
+	Expiry         string
+	Track2         string
+	Track3         string
+	EntryMode      string
+	SequenceNumber string
+	ICData         string
+	PINBlock       string
+}
+
+// Original identifies the transaction a void, cancel, completion or refund
+// refers to. Date is the original transaction date, MMDD.
+type Original struct {
+	Batch    string
+	STAN     string
+	RRN      string
+	AuthCode string
+	Date     string
+}
+
+// Terminal holds what every request from a terminal carries. STANs and the
+// batch number come from State. When TrackCipher is set track data is sent
+// encrypted with it.
+type Terminal struct {
+	Tpdu        string
+	Header      string
+	TerminalID  string
+	MerchantID  string
+	Currency    string
+	State       *j8583.TerminalState
+	TrackCipher j8583.FieldCipher
+}
+
+// Sale builds a consume (0200, type 22).
+func (t *Terminal) Sale(card Card, amount string) (*j8583.Message, error) {
+	return t.build("0200", ProcSale, CondNormal, j8583.TypeSale, card, amount, nil)
+}
+
+// SaleVoid builds a consume void (0200, type 23) of orig.
+func (t *Terminal) SaleVoid(card Card, amount string, orig Original) (*j8583.Message, error) {
+	if orig.RRN == "" || orig.STAN == "" {
+		return nil, fmt.Errorf(ERR_ORIGINAL_FIELDS, "RRN or STAN")
+	}
+	return t.build("0200", ProcVoid, CondNormal, j8583.TypeSaleVoid, card, amount, &orig)
+}
+
+// Refund builds a refund advice (0220, type 25) of orig.
+func (t *Terminal) Refund(card Card, amount string, orig Original) (*j8583.Message, error) {
+	if orig.RRN == "" || orig.Date == "" {
+		return nil, fmt.Errorf(ERR_ORIGINAL_FIELDS, "RRN or date")
+	}
+	return t.build("0220", ProcVoid, CondNormal, j8583.TypeRefund, card, amount, &orig)
+}
+
+// PreAuth builds a pre-authorisation (0100, type 10).
+func (t *Terminal) PreAuth(card Card, amount string) (*j8583.Message, error) {
+	return t.build("0100", ProcPreAuth, CondPreAuth, j8583.TypePreAuth, card, amount, nil)
+}
+
+// PreAuthCancel builds a pre-authorisation cancel (0100, type 11) of orig.
+func (t *Terminal) PreAuthCancel(card Card, amount string, orig Original) (*j8583.Message, error) {
+	if orig.AuthCode == "" || orig.Date == "" {
+		return nil, fmt.Errorf(ERR_ORIGINAL_FIELDS, "auth code or date")
+	}
+	orig.Batch, orig.STAN = "", ""
+	return t.build("0100", ProcVoid, CondPreAuth, j8583.TypePreAuthVoid, card, amount, &orig)
+}
+
+// Completion builds a pre-authorisation completion request (0200, type 20)
+// of orig.
+func (t *Terminal) Completion(card Card, amount string, orig Original) (*j8583.Message, error) {
+	if orig.AuthCode == "" || orig.Date == "" {
+		return nil, fmt.Errorf(ERR_ORIGINAL_FIELDS, "auth code or date")
+	}
+	orig.Batch, orig.STAN = "", ""
+	return t.build("0200", ProcSale, CondPreAuth, j8583.TypeCompletion, card, amount, &orig)
+}
+
+// CompletionCancel builds a completion void (0200, type 21) of orig.
+func (t *Terminal) CompletionCancel(card Card, amount string, orig Original) (*j8583.Message, error) {
+	if orig.RRN == "" || orig.STAN == "" {
+		return nil, fmt.Errorf(ERR_ORIGINAL_FIELDS, "RRN or STAN")
+	}
+	return t.build("0200", ProcVoid, CondPreAuth, j8583.TypeCompletionVoid, card, amount, &orig)
+}
+
+// BalanceInquiry builds a balance inquiry (0200, type 01).
+func (t *Terminal) BalanceInquiry(card Card) (*j8583.Message, error) {
+	return t.build("0200", ProcBalanceInquiry, CondNormal, j8583.TypeBalanceInquiry, card, "", nil)
+}
+
+func (t *Terminal) build(mti, procCode, cond, typeCode string, card Card, amount string, orig *Original) (*j8583.Message, error) {
+	if card.PAN == "" && card.Track2 == "" {
+		return nil, errors.New(ERR_NO_CARD_DATA)
+	}
+	stan, err := t.State.NextSTAN()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &j8583.Message{Tpdu: t.Tpdu, Header: t.Header, Mti: mti}
+	m.Fields = make([]j8583.Field, 65)
+	if card.PAN != "" {
+		m.Fields[2] = j8583.NewFieldVar(j8583.LLVAR, j8583.BCD, card.PAN)
+	}
+	m.Fields[3] = j8583.NewFieldFix(j8583.BCD, 6, procCode)
+	if amount != "" {
+		m.Fields[4] = j8583.NewFieldFix(j8583.BCD, 12, amount)
+	}
+	m.Fields[11] = j8583.NewFieldFix(j8583.BCD, 6, stan)
+	if card.Expiry != "" {
+		m.Fields[14] = j8583.NewFieldFix(j8583.BCD, 4, card.Expiry)
+	}
+
+	entryMode := card.EntryMode
+	if entryMode == "" {
+		entryMode = EntrySwipe
+	}
+	pinMode := "2"
+	if card.PINBlock != "" {
+		pinMode = "1"
+	}
+	m.Fields[22] = j8583.NewFieldFix(j8583.BCD, 3, entryMode+pinMode)
+	if card.SequenceNumber != "" {
+		m.Fields[23] = j8583.NewFieldFix(j8583.BCD, 3, card.SequenceNumber)
+	}
+	m.Fields[25] = j8583.NewFieldFix(j8583.BCD, 2, cond)
+
+	var opts []j8583.FieldOption
+	trackEncrypted := "0"
+	if t.TrackCipher != nil {
+		opts = append(opts, j8583.WithCipher(t.TrackCipher))
+		trackEncrypted = "1"
+	}
+	if card.Track2 != "" {
+		m.Fields[35] = j8583.NewFieldVar(j8583.LLVAR, j8583.BCD, card.Track2, opts...)
+	}
+	if card.Track3 != "" {
+		m.Fields[36] = j8583.NewFieldVar(j8583.LLLVAR, j8583.BCD, card.Track3, opts...)
+	}
+
+	if orig != nil {
+		if orig.RRN != "" {
+			m.Fields[37] = j8583.NewFieldFix(j8583.ASCII, 12, orig.RRN)
+		}
+		if orig.AuthCode != "" {
+			m.Fields[38] = j8583.NewFieldFix(j8583.ASCII, 6, orig.AuthCode)
+		}
+	}
+	m.Fields[41] = j8583.NewFieldFix(j8583.ASCII, 8, t.TerminalID)
+	m.Fields[42] = j8583.NewFieldFix(j8583.ASCII, 15, t.MerchantID)
+	currency := t.Currency
+	if currency == "" {
+		currency = "156"
+	}
+	m.Fields[49] = j8583.NewFieldFix(j8583.ASCII, 3, currency)
+
+	if card.PINBlock != "" {
+		m.Fields[26] = j8583.NewFieldFix(j8583.BCD, 2, "12")
+		m.Fields[52] = j8583.NewFieldFix(j8583.BINARY, 8, card.PINBlock)
+	}
+	if card.PINBlock != "" || t.TrackCipher != nil {
+		m.Fields[53] = j8583.NewFieldFix(j8583.BCD, 16, "26"+trackEncrypted+"0000000000000")
+	}
+	if card.ICData != "" {
+		m.Fields[55] = j8583.NewFieldVar(j8583.LLLVAR, j8583.BINARY, card.ICData)
+	}
+
+	subField60 := make([]j8583.SubField, 3)
+	subField60[0] = j8583.NewSubFieldFix(j8583.BCD, 2, typeCode)
+	subField60[1] = j8583.NewSubFieldFix(j8583.BCD, 6, t.State.Batch())
+	subField60[2] = j8583.NewSubFieldFix(j8583.BCD, 3, "000")
+	m.Fields[60] = j8583.NewFields(j8583.LLLVAR, j8583.BCD, subField60)
+
+	if orig != nil {
+		m.Fields[61] = j8583.NewFieldVar(j8583.LLLVAR, j8583.BCD, originalData(*orig))
+	}
+	return m, nil
+}
+
+// originalData is field 61: original batch number, STAN and date, zero
+// filled where the transaction type does not carry them.
+func originalData(orig Original) string {
+	fill := func(value string, n int) string {
+		for len(value) < n {
+			value = "0" + value
+		}
+		return value[len(value)-n:]
+	}
+	return fill(orig.Batch, 6) + fill(orig.STAN, 6) + fill(orig.Date, 4)
+}
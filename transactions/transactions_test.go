@@ -0,0 +1,66 @@
+package transactions
+
+import (
+	"testing"
+
+	"8583/j8583"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTerminal() *Terminal {
+	state, _ := j8583.OpenTerminalState("")
+	state.SetBatch("000007")
+	return &Terminal{Tpdu: "6000030000", Header: "613100313031", TerminalID: "00003042",
+		MerchantID: "666100041213175", State: state}
+}
+
+func TestBuilders(t *testing.T) {
+	term := newTestTerminal()
+	card := Card{PAN: "6225887912345678", Track2: "6225887912345678D49121010000000000"}
+	orig := Original{Batch: "000007", STAN: "000001", RRN: "123456789012", AuthCode: "A12345", Date: "1019"}
+
+	cases := []struct {
+		build    func() (*j8583.Message, error)
+		mti      string
+		proc     string
+		cond     string
+		typeCode string
+		field61  string
+	}{
+		{func() (*j8583.Message, error) { return term.Sale(card, "000000000100") }, "0200", "000000", "00", "22", ""},
+		{func() (*j8583.Message, error) { return term.SaleVoid(card, "000000000100", orig) }, "0200", "200000", "00", "23", "0000070000011019"},
+		{func() (*j8583.Message, error) { return term.Refund(card, "000000000100", orig) }, "0220", "200000", "00", "25", "0000070000011019"},
+		{func() (*j8583.Message, error) { return term.PreAuth(card, "000000000100") }, "0100", "030000", "06", "10", ""},
+		{func() (*j8583.Message, error) { return term.PreAuthCancel(card, "000000000100", orig) }, "0100", "200000", "06", "11", "0000000000001019"},
+		{func() (*j8583.Message, error) { return term.Completion(card, "000000000100", orig) }, "0200", "000000", "06", "20", "0000000000001019"},
+		{func() (*j8583.Message, error) { return term.CompletionCancel(card, "000000000100", orig) }, "0200", "200000", "06", "21", "0000070000011019"},
+		{func() (*j8583.Message, error) { return term.BalanceInquiry(card) }, "0200", "310000", "00", "01", ""},
+	}
+	for i, c := range cases {
+		m, err := c.build()
+		assert.NoError(t, err)
+
+		data, err := m.Bytes("")
+		assert.NoError(t, err)
+		decoded, err := j8583.Decode(data)
+		assert.NoError(t, err)
+
+		assert.Equal(t, c.mti, decoded.Mti)
+		assert.Equal(t, c.proc, decoded.FieldString(3))
+		assert.Equal(t, c.cond, decoded.FieldString(25))
+		typeCode, batchNum, _ := decoded.Field60()
+		assert.Equal(t, c.typeCode, typeCode)
+		assert.Equal(t, "000007", batchNum)
+		assert.Equal(t, c.field61, decoded.FieldString(61))
+		assert.Equal(t, "00000"+string(rune('1'+i)), decoded.FieldString(11))
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	term := newTestTerminal()
+	_, err := term.Sale(Card{}, "000000000100")
+	assert.Error(t, err)
+	_, err = term.SaleVoid(Card{PAN: "6225887912345678"}, "000000000100", Original{})
+	assert.Error(t, err)
+}